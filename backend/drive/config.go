@@ -1,95 +1,214 @@
 package drive
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
-	"github.com/liamvdv/sharedHome/backend"
 	"github.com/liamvdv/sharedHome/config"
-	. "github.com/liamvdv/sharedHome/util"
+	"github.com/liamvdv/sharedHome/errors"
 
-	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
 )
 
 // https://developers.google.com/drive/api/v3/quickstart/go
 // https://developers.google.com/workspace/guides/create-credentials
+// https://developers.google.com/identity/protocols/oauth2/native-app
 // https://pkg.go.dev/google.golang.org/api/drive/v3#AboutService
 
-var _ backend.Service = (*Drive)(nil)
+// authTimeout is the time the user has to complete the authorisation in the
+// browser.
+const authTimeout = 5 * time.Minute
 
-const (
-	DriveCredentialsFilename = "drive-credentials.json"
-	DriveTokenFilename       = "drive-token.json"
-)
-
-var (
-	DriveCredentialsFilepath string
-	DriveTokenFilepath       string
-)
-
-func init() {
-	DriveCredentialsFilepath = filepath.Join(config.Dir, DriveCredentialsFilename)
-	DriveTokenFilepath = filepath.Join(config.Dir, DriveTokenFilename)
+// Auth runs the authorisation flow and stores the token. The OAuth client
+// credentials of a desktop app must have been downloaded to the credentials
+// file before.
+func Auth(env config.Env) error {
+	const op = errors.Op("backend.drive.Auth")
+	cfg, err := oauthConfig()
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if _, err := tokenFromFile(); err == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+	tok, err := tokenFromWeb(ctx, env, cfg)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if err := saveToken(tok); err != nil {
+		return errors.E(op, err)
+	}
+	return nil
 }
 
-// Retrieve a token, saves the token, then returns the generated client.
-func GetClient(cfg *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	tok, err := tokenFromFile(DriveTokenFilepath)
+// oauthConfig reads the OAuth client credentials.
+func oauthConfig() (*oauth2.Config, error) {
+	raw, err := config.LoadBackendCredentials(Name)
+	if os.IsNotExist(err) {
+		fp := filepath.Join(config.BackendConfigFolder, Name+"-credentials.json")
+		return nil, errors.E(errors.NotExist, errors.Errorf("download the OAuth client credentials of your Google Cloud project to %s", fp))
+	}
 	if err != nil {
-		tok = getTokenFromWeb(cfg)
-		saveToken(DriveTokenFilepath, tok)
+		return nil, err
 	}
-	return cfg.Client(context.Background(), tok)
+	// drive.DriveScope allows full access to google drive of user.
+	cfg, err := google.ConfigFromJSON(raw, drive.DriveScope)
+	if err != nil {
+		return nil, errors.E(errors.Invalid, err)
+	}
+	return cfg, nil
 }
 
-// Retrieves a token from a local file.
-func tokenFromFile(fp string) (*oauth2.Token, error) {
-	file, err := os.Open(fp)
+// Retrieves the token stored by Auth.
+func tokenFromFile() (*oauth2.Token, error) {
+	raw, err := config.LoadBackendToken(Name)
 	if err != nil {
 		return nil, err
 	}
-	defer SaveClose(file)
 	tok := &oauth2.Token{}
-	err = json.NewDecoder(file).Decode(tok)
-	return tok, err
+	if err := json.Unmarshal(raw, tok); err != nil {
+		return nil, errors.E(errors.Invalid, err)
+	}
+	return tok, nil
+}
+
+// Saves a token with config.StoreBackendToken.
+func saveToken(tok *oauth2.Token) error {
+	raw, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	return config.StoreBackendToken(Name, raw)
 }
 
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(cfg *oauth2.Config) *oauth2.Token {
-	authURL := cfg.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf(`
-Open the following link in your browser and proceed the prompts. 
-Copy the provided authorization code and paste it in the terminal.
-Follow link: %v
-Authorization code:`, authURL) 
+// tokenFromWeb asks the user to authorise the client in the browser. Google
+// redirects the browser to a server on the loopback interface, which receives
+// the authorisation code. The state protects against forged redirects and
+// PKCE against other programs that intercept the code, see RFC 7636.
+func tokenFromWeb(ctx context.Context, env config.Env, cfg *oauth2.Config) (*oauth2.Token, error) {
+	state, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
 
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)  // TODO(liamvdv)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.E(errors.IO, err)
 	}
+	defer l.Close()
+	c := *cfg
+	c.RedirectURL = fmt.Sprintf("http://%s/", l.Addr())
+
+	codes := make(chan string, 1)
+	errc := make(chan error, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// e. g. the favicon.
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		// any local process can send requests, they must not abort the
+		// authorisation.
+		if q.Get("state") != state {
+			http.Error(w, "The authorisation response has a wrong state.", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch {
+		case q.Get("error") != "":
+			err = errors.E(errors.Permission, errors.Errorf("authorisation failed: %s", q.Get("error")))
+		case q.Get("code") == "":
+			err = errors.E(errors.Invalid, "the authorisation response has no code")
+		}
+		if err != nil {
+			http.Error(w, "Authorisation failed, see the terminal.", http.StatusBadRequest)
+			select {
+			case errc <- err:
+			default:
+			}
+			return
+		}
+		fmt.Fprintln(w, "Authorisation succeeded, you can close this window.")
+		select {
+		case codes <- q.Get("code"):
+		default:
+		}
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
 
-	tok, err := cfg.Exchange(context.TODO(), authCode)
+	authURL := c.AuthCodeURL(state,
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	fmt.Fprintf(env.Stdout, "Open the following link in your browser and follow the prompts:\n%s\n", authURL)
+
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-errc:
+		return nil, err
+	case <-ctx.Done():
+		return nil, errors.E(errors.IO, errors.Errorf("no authorisation received: %v", ctx.Err()))
+	}
+	tok, err := c.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier))
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)  // TODO(liamvdv)
+		return nil, errors.E(errors.Permission, err)
 	}
-	return tok
+	return tok, nil
 }
 
-// Saves a token to a file path.
-func saveToken(fp string, tok *oauth2.Token) {
-	fmt.Printf("Saving credentials file to: %s\n", fp)  // TODO(liamvdv)
-	file, err := os.OpenFile(fp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+// randomString returns 32 random bytes, URL-safe encoded.
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// savingTokenSource stores the tokens of src that differ from the last one,
+// so that renewed access and refresh tokens survive a restart.
+type savingTokenSource struct {
+	src oauth2.TokenSource
+
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err) // TODO(liamvdv)
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil || tok.AccessToken != s.last.AccessToken || tok.RefreshToken != s.last.RefreshToken {
+		// a failed save is repeated with the next token, the renewed token
+		// is valid anyway.
+		if err := saveToken(tok); err == nil {
+			s.last = tok
+		}
 	}
-	defer SaveClose(file)
-	json.NewEncoder(file).Encode(tok)
+	return tok, nil
 }
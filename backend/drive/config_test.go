@@ -0,0 +1,158 @@
+package drive
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"golang.org/x/oauth2"
+)
+
+// fakeOAuth is the token endpoint of Google. It checks the PKCE verifier
+// against the challenge of the authorisation link.
+type fakeOAuth struct {
+	mu        sync.Mutex
+	challenge string
+}
+
+// newFakeOAuth stores credentials of a client that uses a fakeOAuth.
+func newFakeOAuth(t *testing.T) *fakeOAuth {
+	config.InitVars(osx.NewMemMapFs(), "/config")
+	o := &fakeOAuth{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		access := "access"
+		switch r.FormValue("grant_type") {
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			if r.FormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(sum[:]) != o.challenge {
+				http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		case "refresh_token":
+			access = "renewed"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": %q, "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600}`, access)
+	}))
+	t.Cleanup(srv.Close)
+	creds := fmt.Sprintf(`{"installed": {"client_id": "id", "client_secret": "secret",
+		"auth_uri": "%[1]s/auth", "token_uri": "%[1]s/token", "redirect_uris": ["http://localhost"]}}`, srv.URL)
+	if err := config.StoreBackendCredentials(Name, []byte(creds)); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// authorise runs Auth and, like the browser, answers the authorisation link
+// with the queries returned by answers for its state. It returns the status
+// codes of the answers.
+func (o *fakeOAuth) authorise(t *testing.T, answers func(state string) []url.Values) ([]int, error) {
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Auth(config.Env{Stdout: w})
+		w.Close()
+	}()
+	var codes []int
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if !strings.HasPrefix(s.Text(), "http") {
+			continue
+		}
+		u, err := url.Parse(s.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("access_type") != "offline" {
+			t.Errorf("unexpected authorisation link %s", u)
+		}
+		o.mu.Lock()
+		o.challenge = q.Get("code_challenge")
+		o.mu.Unlock()
+		for _, a := range answers(q.Get("state")) {
+			resp, err := http.Get(q.Get("redirect_uri") + "?" + a.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			codes = append(codes, resp.StatusCode)
+		}
+	}
+	return codes, <-done
+}
+
+func TestAuth(t *testing.T) {
+	o := newFakeOAuth(t)
+	denied := func(state string) []url.Values {
+		return []url.Values{{"state": {state}, "error": {"access_denied"}}}
+	}
+	if _, err := o.authorise(t, denied); !errors.Is(errors.Permission, err) {
+		t.Errorf("want Permission error for a denied authorisation, got %v", err)
+	}
+	if _, err := tokenFromFile(); err == nil {
+		t.Error("token stored despite a denied authorisation")
+	}
+
+	// a request with a wrong state is rejected, but the authorisation goes on.
+	forgedFirst := func(state string) []url.Values {
+		return []url.Values{
+			{"state": {"forged"}, "code": {"code"}},
+			{"state": {state}, "code": {"code"}},
+		}
+	}
+	codes, err := o.authorise(t, forgedFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 2 || codes[0] != http.StatusBadRequest || codes[1] != http.StatusOK {
+		t.Errorf("want status codes [400 200], got %v", codes)
+	}
+	tok, err := tokenFromFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+		t.Errorf("unexpected token %+v", tok)
+	}
+}
+
+func TestSavingTokenSource(t *testing.T) {
+	newFakeOAuth(t)
+	cfg, err := oauthConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	expired := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	ts := &savingTokenSource{src: cfg.TokenSource(ctx, expired), last: expired}
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "renewed" {
+		t.Fatalf("want renewed token, got %+v", tok)
+	}
+	stored, err := tokenFromFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.AccessToken != "renewed" || stored.RefreshToken != "refresh" {
+		t.Errorf("want renewed token stored, got %+v", stored)
+	}
+}
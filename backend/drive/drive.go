@@ -5,242 +5,200 @@ import (
 	errs "errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 	"time"
 
-	"github.com/liamvdv/sharedHome/backend"
-	_ "github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/vfs"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/googleapi"
 )
 
-// We need to have a map which stores the ids of the folders.
-
-// TODO(liamvdv): CreateFile and co recieve a header that was generated by the caller,
-// and does not reflect the real fs.FileHeaders. The .Name property is the full
-// filepath encrypted.
+// https://developers.google.com/drive/api/v3/reference/files
+// https://developers.google.com/drive/api/v3/search-files
 
-// https://gist.github.com/TheGU/e6d0ae13f2fa83f3bd8d
-// https://console.cloud.google.com/apis/credentials?project=sharedhome
+const (
+	folderMimeType = "application/vnd.google-apps.folder"
+	binaryMimeType = "application/octet-stream"
 
-// rootId stores the id of the sharedHome folder.
-// Its child is the root of a mounted filesystem.
-var rootId string
+	// fileFields are the fields requested for listed files.
+	fileFields = "id, name, mimeType, size, modifiedTime, parents"
+)
 
-// initGlobals gets or creates the root application folder and stores its id to
-// rootId.
-func initGlobals(srv *drive.Service) error {
-	f, err := getOrCreateFolder(context.Background(), srv, "root", backend.RemoteFolderName, 0) // rename?
-	if err != nil {
-		return err
+// getFile writes the content of the file id after the first off bytes to dst.
+func getFile(ctx context.Context, srv *drive.Service, id string, off int64, dst io.Writer) error {
+	call := srv.Files.Get(id).AcknowledgeAbuse(true).Context(ctx)
+	if off > 0 {
+		call.Header().Set("Range", fmt.Sprintf("bytes=%d-", off))
 	}
-	rootId = f.Id
-	return nil
-}
-
-func getFile(
-	ctx context.Context,
-	srv *drive.Service,
-	fileID string,
-	dst io.Writer,
-) error {
-	resp, err := srv.Files.Get(fileID).AcknowledgeAbuse(true).Context(ctx).Download()
+	resp, err := call.Download()
 	if err != nil {
-		return err
+		return apiError(err)
 	}
 	defer resp.Body.Close()
-
+	if off > 0 && resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return errors.E(errors.IO, err)
+		}
+	}
 	if _, err := io.Copy(dst, resp.Body); err != nil {
-		return err
+		return errors.E(errors.IO, err)
 	}
 	return nil
 }
 
-func createFile(
-	ctx context.Context,
-	srv *drive.Service,
-	parentID string,
-	name string,
-	mtime uint64,
-	src io.Reader,
-) error {
-	t := time.Unix(int64(mtime), 0)
-	file := &drive.File{
+// createFile uploads src as a new file name in the folder parentId.
+func createFile(ctx context.Context, srv *drive.Service, parentId, name string, local *vfs.File, src io.Reader) (*drive.File, error) {
+	f := &drive.File{
 		Name:         name,
-		ModifiedTime: t.Format(time.RFC3339),
-		Parents:      []string{parentID},
-		MimeType:     "application/vnd.google-apps.file", // binary
-		// FileExtension:    ".bin",
+		ModifiedTime: modifiedTime(local),
+		Parents:      []string{parentId},
+		MimeType:     binaryMimeType,
 	}
-
-	// chuck size of media upload should be equal or larger to encryption chuck size / buffer.
-	// googleapi.DefaultUploadChunkSize is 10MB, can be any mulpiple of 256kB.
-	// TODO(liamvdv): look into Media()s googleapi.MediaOptions
-	// googleapi.ContentType
-	_, err := srv.Files.
-		Create(file).
-		Media(src, googleapi.ContentType("application/octet-stream")). // TODO(liamvdv): proper mime type.
+	// googleapi.DefaultUploadChunkSize is 16MB, larger files are uploaded in
+	// chunks of that size.
+	created, err := srv.Files.
+		Create(f).
+		Media(src, googleapi.ContentType(binaryMimeType)).
+		Fields("id").
 		Context(ctx).
 		Do()
-	return handleDoError(err)
+	if err != nil {
+		return nil, apiError(err)
+	}
+	return created, nil
 }
 
-// Do executes the "drive.files.insert" call. Exactly one of *File or error will be non-nil.
-// Any non-2xx status code is an error. Response headers are in either *File.ServerResponse.Header
-// or (if a response was returned at all) in error.(*googleapi.Error).Header.
-// Use googleapi.IsNotModified to check whether the returned error was because http.StatusNotModified was returned.
-func handleDoError(err error) error {
-	// TODO(liamvdv): TODO
-	return err
+// updateFile replaces the content of the file id with src.
+func updateFile(ctx context.Context, srv *drive.Service, id string, local *vfs.File, src io.Reader) error {
+	_, err := srv.Files.
+		Update(id, &drive.File{ModifiedTime: modifiedTime(local)}).
+		Media(src, googleapi.ContentType(binaryMimeType)).
+		Fields("id").
+		Context(ctx).
+		Do()
+	return apiError(err)
 }
 
-func getOrCreateFolder(
-	ctx context.Context,
-	srv *drive.Service,
-	parentID string,
-	name string,
-	mtime uint64,
-) (*drive.File, error) {
-	folder, err := getFolder(ctx, srv, parentID, name)
-	if err == nil {
-		return folder, nil
-	} else if !errs.Is(err, FileNotFoundErr) {
-		return nil, err
+// findChild returns the oldest child called name of the folder parentId. Drive
+// permits several files with the same name, which happens if two clients
+// create a folder at the same time. If folder is true, only folders are
+// considered, else only files.
+func findChild(ctx context.Context, srv *drive.Service, parentId, name string, folder bool) (*drive.File, error) {
+	op := "!="
+	if folder {
+		op = "="
 	}
-	return createFolder(ctx, srv, parentID, name, mtime)
-}
-
-var FileNotFoundErr = errs.New("Remote: no matching file found.")
-var AmbigousFileErr = errs.New("Remote: two files or folders have the same name.")
-
-func getFolder(
-	ctx context.Context,
-	srv *drive.Service,
-	parentID string,
-	name string,
-) (*drive.File, error) {
-	q := fmt.Sprintf("trashed = false and name = '%s' and mimeType = 'application/vnd.google-apps.folder' and '%s' in parents", name, parentID)
-
-	r, err := srv.Files.List().Q(q).Fields("*").Do() // TODO(liamvdv): .Fields("files(id, name, size, trashed, parents)") probably enough.
+	q := fmt.Sprintf("name = '%s' and '%s' in parents and mimeType %s '%s' and trashed = false",
+		escape(name), escape(parentId), op, folderMimeType)
+	list, err := srv.Files.List().
+		Q(q).
+		OrderBy("createdTime").
+		PageSize(1).
+		Fields(googleapi.Field("files(" + fileFields + ")")).
+		Context(ctx).
+		Do()
 	if err != nil {
-		return nil, err
+		return nil, apiError(err)
 	}
-	if l := len(r.Files); l == 0 {
-		return nil, FileNotFoundErr
-	} else if l > 1 {
-		return nil, AmbigousFileErr
+	if len(list.Files) == 0 {
+		return nil, errors.E(errors.NotExist, errors.Errorf("no file %q in folder %s", name, parentId))
 	}
-	return r.Files[0], nil
+	return list.Files[0], nil
+}
+
+// listChildren calls fn for every child of the folder parentId.
+func listChildren(ctx context.Context, srv *drive.Service, parentId string, fn func(*drive.File)) error {
+	q := fmt.Sprintf("'%s' in parents and trashed = false", escape(parentId))
+	err := srv.Files.List().
+		Q(q).
+		PageSize(1000).
+		Fields(googleapi.Field("nextPageToken, files("+fileFields+")")).
+		Pages(ctx, func(list *drive.FileList) error {
+			for _, f := range list.Files {
+				fn(f)
+			}
+			return nil
+		})
+	return apiError(err)
 }
 
-// createFolder does not check if folder already exists. use getOrCreateFolder for that.
-func createFolder(
-	ctx context.Context,
-	srv *drive.Service,
-	parentID string,
-	name string,
-	mtime uint64,
-) (*drive.File, error) {
-	t := time.Unix(int64(mtime), 0)
-	r, err := srv.Files.
-		Create(
-			&drive.File{
-				Name:         name,
-				ModifiedTime: t.Format(time.RFC3339),
-				MimeType:     "application/vnd.google-apps.folder",
-				Parents:      []string{parentID}}).
-		Fields("*").
+// createFolder does not check if the folder already exists, use findChild for
+// that.
+func createFolder(ctx context.Context, srv *drive.Service, parentId, name string, local *vfs.File) (*drive.File, error) {
+	f, err := srv.Files.
+		Create(&drive.File{
+			Name:         name,
+			ModifiedTime: modifiedTime(local),
+			MimeType:     folderMimeType,
+			Parents:      []string{parentId},
+		}).
+		Fields("id").
+		Context(ctx).
 		Do()
 	if err != nil {
-		return nil, handleDoError(err)
+		return nil, apiError(err)
 	}
-	return r, nil
+	return f, nil
 }
 
-// https://developers.google.com/drive/api/v3/search-files
-// https://github.com/mtojek/gdriver/blob/main/internal/upload/
-// getParent is currently unbelivably inefficient, but a quick solution.
-func (d *Drive) getParent(dp string) (string, error) {
-	if dp == "" {
-		panic("calling getParent with empty dirpath")
-	}
-
-	id, found := d.parIDs[dp]
-	if found {
-		return id, nil
+// move renames the file id to name and moves it from the folder oldParentId
+// to newParentId.
+func move(ctx context.Context, srv *drive.Service, id, name, oldParentId, newParentId string) error {
+	call := srv.Files.Update(id, &drive.File{Name: name}).Fields("id").Context(ctx)
+	if oldParentId != newParentId {
+		call = call.AddParents(newParentId).RemoveParents(oldParentId)
 	}
+	_, err := call.Do()
+	return apiError(err)
+}
 
-	// just get all folder for know.
-	// TODO(liamvdv): make this concurently proof
-	q := fmt.Sprintf("trashed = false and mimeType = 'application/vnd.google-apps.folder'")
+// deleteFile deletes the file id permanently. Folders are deleted including
+// their descendants.
+func deleteFile(ctx context.Context, srv *drive.Service, id string) error {
+	return apiError(srv.Files.Delete(id).Context(ctx).Do())
+}
 
-	f, err := d.srv.Files.List().Q(q).Fields("nextPageToken, files(id, name)").OrderBy("orderBy=modifiedTime desc").Do()
-	if err != nil {
-		return "", err
+func modifiedTime(local *vfs.File) string {
+	if local == nil || local.MTime == 0 {
+		return ""
 	}
-	return f.NextPageToken, err //TODO(liamvdv): bullshit
-	// nextPage := f.NextPageToken
-	// for nextPage != "" {
-	// 	for _, f := range f.Files {
-
-	// 	}
+	return time.Unix(0, local.MTime).UTC().Format(time.RFC3339Nano)
+}
 
-	// }
-	// d.parIDs[dp] = f.ID
+// escape quotes s for a query string.
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
 }
 
-// TODO(liamvdv): To difficult for current knowledge of other system, use inefficient per request lookup
-// or i should fetch all folders with a single get (max 1000 folders, then per page.)
-
-// // getParent returns the id of the folder dp.
-// // getParent is quite inefficient, maybe ids should be stores in cache.
-// func (d *Drive) getParent(dp string) (string, error) {
-// 	if dp == "" {
-// 		panic("calling getParent with empty dirpath")
-// 	}
-
-// 	id, found := d.parIDs[dp]
-// 	if found {
-// 		return id, nil
-// 	}
-
-// 	// if it's not found, query remote to find all missing folder IDs in this path.
-// 	names := strings.Split(dp, string(os.PathSeparator))[1:] // exclude "" before seperator
-// 	subq := "name = %q"
-// 	if l := len(names); l > 1 {
-// 		subq = subq + " " + strings.Repeat("or "+subq, l-1)
-// 	}
-
-// 	q := fmt.Sprintf(subq+" and trashed = false and mimeType = 'application/vnd.google-apps.folder'", names)
-
-// 	fl, err := d.srv.Files.List().Q(q).Fields("files(id, name, trashed, parents)").Do()
-// 	if err != nil {
-// 		return "", err
-// 	}
-// 	if l := len(fl.Files); l > len(names) {
-// 		// /abc/foo and /cdu/foo, foo will occure multiple times, check parents.
-// 		// TODO(liamvdv): unable to handle /abc/foo and /abc/foo, sadly permitted by drive api
-// 		var once bool
-// 		var ret string
-
-// 		var localParID string
-// 		for i := len(names)-1; i >= 0; i-- {  // reverse
-// finding parent difficult. Maybe set OrderBy() function and order by createdtime. parent dirs will be older, because they are required to create child dirs.
-// 			name := names[i]
-// 			for _, f := range fl.Files {
-// 				if f.Name == name {
-// 					if !once {
-// 						ret = f.Id
-// 						once = true
-// 					}
-// 					if
-// 					d.parIDs[dp] = f.Id
-// 					dp = filepath.Base(dp) // chop last dir off
-// 					break
-// 				}
-// 			}
-// 		}
-
-// 	} else if l < len(names) {
-// 		return "", FileNotFoundErr // not exactly found.
-// 	}
-// }
+// apiError classifies errors of the Drive API. Rate limits are reported with
+// 403, but resolve after a while like server errors.
+func apiError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var gErr *googleapi.Error
+	if !errs.As(err, &gErr) {
+		if errs.Is(err, context.Canceled) || errs.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		return errors.E(errors.IO, err)
+	}
+	msg := errors.Str(fmt.Sprintf("%d %s", gErr.Code, gErr.Message))
+	for _, e := range gErr.Errors {
+		switch e.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded", "backendError":
+			return errors.E(errors.IO, msg)
+		}
+	}
+	switch {
+	case gErr.Code == http.StatusNotFound:
+		return errors.E(errors.NotExist, msg)
+	case gErr.Code == http.StatusUnauthorized || gErr.Code == http.StatusForbidden:
+		return errors.E(errors.Permission, msg)
+	case gErr.Code == http.StatusTooManyRequests || gErr.Code >= 500:
+		return errors.E(errors.IO, msg)
+	}
+	return errors.E(errors.Invalid, msg)
+}
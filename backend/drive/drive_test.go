@@ -1,49 +1,57 @@
 package drive
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"log"
+	"math/rand"
+	"net/http"
 	"os"
+	"strings"
 	"testing"
 
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
 
+	"github.com/liamvdv/sharedHome/backend"
 	"github.com/liamvdv/sharedHome/config"
-	"github.com/liamvdv/sharedHome/util"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/retry"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
 )
 
 // https://github.com/codyoss/retry
 
+// TestDriveOnline lists files of the drive of the user. It needs the
+// credentials and token in the user config directory and only runs if
+// SHAREDHOME_DRIVE_ONLINE is set.
 func TestDriveOnline(t *testing.T) {
-	util.PrepareTestConfigInit()
-	config.Init()
+	if os.Getenv("SHAREDHOME_DRIVE_ONLINE") == "" {
+		t.Skip("set SHAREDHOME_DRIVE_ONLINE to run against Google Drive")
+	}
+	config.InitVars(osx.NewOsFs(), "")
 
 	ctx := context.Background()
-	fmt.Println(DriveCredentialsFilepath, DriveTokenFilepath)
-	b, err := os.ReadFile(DriveCredentialsFilepath)
+	cfg, err := oauthConfig()
 	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+		t.Skipf("no drive credentials: %v", err)
 	}
-
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, drive.DriveScope)
+	tok, err := tokenFromFile()
 	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		t.Skipf("no drive token: %v", err)
 	}
-	client := GetClient(config)
-
-	srv, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	srv, err := drive.NewService(ctx, option.WithHTTPClient(cfg.Client(ctx, tok)))
 	if err != nil {
-		log.Fatalf("Unable to retrieve Drive client: %v", err)
+		t.Fatalf("Unable to retrieve Drive client: %v", err)
 	}
 
 	// can add own context: List().Context(ctx)...
 	r, err := srv.Files.List().PageSize(10).Fields("nextPageToken, files(id, name)").Do()
 	if err != nil {
-		log.Fatalf("Unable to retrieve files: %v", err)
+		t.Fatalf("Unable to retrieve files: %v", err)
 	}
 	fmt.Println("Files:")
 	if len(r.Files) == 0 {
@@ -53,4 +61,522 @@ func TestDriveOnline(t *testing.T) {
 			fmt.Printf("%s (%s)\n", i.Name, i.Id)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func newDrive(t *testing.T, srv *drive.Service, fs osx.Fs) *Drive {
+	// the fake serves plain HTTP, any client works.
+	d, err := NewWithService(context.Background(), srv, http.DefaultClient, fs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func rf(relpath string) backend.RemoteFile {
+	return backend.RemoteFile{HashRelpath: relpath, HashName: relpath[strings.LastIndex(relpath, "/")+1:]}
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	_, srv := newFakeDrive(t)
+	d := newDrive(t, srv, osx.NewMemMapFs())
+
+	if err := d.CreateDir(ctx, rf("/")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist for root, got %v", err)
+	}
+	// missing folders are created.
+	if err := d.CreateFile(ctx, rf("/a/b/f"), strings.NewReader("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateDir(ctx, rf("/a/b")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if err := d.CreateFile(ctx, rf("/a/b/f"), strings.NewReader("two")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if err := d.UpdateFile(ctx, rf("/a/b/f"), strings.NewReader("two")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := d.ReadFile(ctx, rf("/a/b/f"), &buf); err != nil || buf.String() != "two" {
+		t.Errorf("want %q, got %q %v", "two", buf.String(), err)
+	}
+	buf.Reset()
+	if err := d.ReadFileFrom(ctx, rf("/a/b/f"), 1, &buf); err != nil || buf.String() != "wo" {
+		t.Errorf("want %q, got %q %v", "wo", buf.String(), err)
+	}
+	if err := d.CreateFile(ctx, rf("/a/g"), strings.NewReader("three")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RenameFile(ctx, rf("/a/b/f"), rf("/a/g")); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := d.ReadFile(ctx, rf("/a/g"), &buf); err != nil || buf.String() != "two" {
+		t.Errorf("want replaced %q, got %q %v", "two", buf.String(), err)
+	}
+	if err := d.ReadFile(ctx, rf("/a/b/f"), &buf); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+
+	dir, err := d.ReadDir(ctx, rf("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.Children) != 2 || dir.Size != 2 {
+		t.Fatalf("unexpected dir %v", dir.Children)
+	}
+	for _, c := range dir.Children {
+		switch c.Relpath {
+		case "/a/b":
+			if !c.Mode.IsDir() {
+				t.Errorf("want dir, got %v", c)
+			}
+		case "/a/g":
+			if c.Mode.IsDir() || c.Size != 3 {
+				t.Errorf("want file of size 3, got %v", c)
+			}
+		default:
+			t.Errorf("unexpected child %v", c)
+		}
+	}
+
+	if err := d.RenameDir(ctx, rf("/a"), rf("/c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.ids.get("/c/b"); !ok {
+		t.Error("renamed folder is not cached")
+	}
+	if _, ok := d.ids.get("/a/b"); ok {
+		t.Error("old folder is still cached")
+	}
+	buf.Reset()
+	if err := d.ReadFile(ctx, rf("/c/g"), &buf); err != nil || buf.String() != "two" {
+		t.Errorf("want %q after rename, got %q %v", "two", buf.String(), err)
+	}
+	if err := d.DeleteFile(ctx, rf("/c/g")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteFile(ctx, rf("/c/g")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	if err := d.DeleteDir(ctx, rf("/c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.ids.get("/c/b"); ok {
+		t.Error("deleted folder is still cached")
+	}
+	if _, err := d.ReadDir(ctx, rf("/c")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+}
+
+// TestCreateExclusive checks that a create that raced with another one fails
+// and leaves the file of the other client.
+func TestCreateExclusive(t *testing.T) {
+	defer func(threshold int64) { resumableThreshold = threshold }(resumableThreshold)
+	ctx := context.Background()
+	f, srv := newFakeDrive(t)
+	d := newDrive(t, srv, osx.NewMemMapFs())
+
+	for _, threshold := range []int64{1 << 20, 1} {
+		resumableThreshold = threshold
+		name := fmt.Sprintf("/lock-%d", threshold)
+		f.mu.Lock()
+		f.beforeCreate = func(meta *drive.File) {
+			f.create(&drive.File{Name: meta.Name, Parents: meta.Parents}, []byte("other"), true)
+		}
+		f.mu.Unlock()
+		if err := d.CreateFile(ctx, rf(name), strings.NewReader("mine")); !errors.Is(errors.Exist, err) {
+			t.Errorf("%s: want Exist, got %v", name, err)
+		}
+		var buf bytes.Buffer
+		if err := d.ReadFile(ctx, rf(name), &buf); err != nil || buf.String() != "other" {
+			t.Errorf("%s: want %q, got %q %v", name, "other", buf.String(), err)
+		}
+		f.mu.Lock()
+		var n int
+		for _, file := range f.files {
+			if "/"+file.Name == name {
+				n++
+			}
+		}
+		f.mu.Unlock()
+		if n != 1 {
+			t.Errorf("%s: want the duplicate deleted, got %d files", name, n)
+		}
+	}
+}
+
+// TestRemoteId checks that a second client finds the folders of the first.
+func TestRemoteId(t *testing.T) {
+	ctx := context.Background()
+	f, srv := newFakeDrive(t)
+	first := newDrive(t, srv, osx.NewMemMapFs())
+	for _, dp := range []string{"/a", "/a/b", "/a/b/c", "/d"} {
+		if err := first.CreateDir(ctx, rf(dp)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// folders outside of the remote folder are ignored.
+	if _, err := createFolder(ctx, srv, "root", "a", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newDrive(t, srv, osx.NewMemMapFs())
+	if len(second.ids.ids) != len(first.ids.ids) {
+		t.Errorf("want %v, got %v", first.ids.ids, second.ids.ids)
+	}
+	for rp, id := range first.ids.ids {
+		if got, _ := second.ids.get(rp); got != id {
+			t.Errorf("%s: want %s, got %s", rp, id, got)
+		}
+	}
+
+	// the second client picks up a folder created after it started.
+	if err := first.CreateDir(ctx, rf("/a/e")); err != nil {
+		t.Fatal(err)
+	}
+	before := f.requests["GET /drive/v3/files"]
+	if _, err := second.ReadDir(ctx, rf("/a/e")); err != nil {
+		t.Fatal(err)
+	}
+	if f.requests["GET /drive/v3/files"] == before {
+		t.Error("want a lookup of the unknown folder")
+	}
+	// a folder deleted by the first client is forgotten by the second.
+	if err := first.DeleteDir(ctx, rf("/a/b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.CreateDir(ctx, rf("/a/b/c/x")); err != nil {
+		if !errors.Is(errors.NotExist, err) {
+			t.Fatal(err)
+		}
+		if err := second.CreateDir(ctx, rf("/a/b/c/x")); err != nil {
+			t.Errorf("want folders recreated, got %v", err)
+		}
+	}
+}
+
+func TestApiError(t *testing.T) {
+	ctx := context.Background()
+	f, srv := newFakeDrive(t)
+	d := newDrive(t, srv, osx.NewMemMapFs())
+	for status, kind := range map[int]errors.Kind{
+		404: errors.NotExist,
+		401: errors.Permission,
+		400: errors.Invalid,
+		500: errors.IO,
+		429: errors.IO,
+	} {
+		f.mu.Lock()
+		f.fail = []int{status}
+		f.mu.Unlock()
+		if _, err := d.ReadDir(ctx, rf("/")); !errors.Is(kind, err) {
+			t.Errorf("%d: want %v, got %v", status, kind, err)
+		}
+	}
+	// rate limits are reported with 403.
+	f.mu.Lock()
+	f.fail = []int{403}
+	f.mu.Unlock()
+	if _, err := d.ReadDir(ctx, rf("/")); !errors.Is(errors.IO, err) {
+		t.Errorf("want IO for rate limit, got %v", err)
+	}
+}
+
+// TestRemote shares a file between two clients through the fake drive.
+func TestRemote(t *testing.T) {
+	ctx := context.Background()
+	_, srv := newFakeDrive(t)
+	fs := osx.NewMemMapFs()
+	for _, dp := range []string{"/alice", "/bob"} {
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := []byte("shared via drive")
+	if err := fs.WriteFile("/alice/a.txt", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	key, err := stream.DeriveKeys(stream.HashKey("drive test key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients []*remote.Remote
+	for _, root := range []string{"/alice", "/bob"} {
+		d := newDrive(t, srv, osx.NewMemMapFs())
+		clients = append(clients, remote.New(d, fs, root, key))
+	}
+	alice, bob := clients[0], clients[1]
+	if err := alice.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	if err := alice.Upload(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Download(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile("/bob/a.txt")
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("want %q, got %q %v", content, got, err)
+	}
+	if sun, err := bob.LatestSun(ctx); err != nil || sun != 0 {
+		t.Errorf("want sun 0, got %d %v", sun, err)
+	}
+}
+
+// TestResumeAfterRestart checks that an upload interrupted by a restart of
+// sharedHome continues where it stopped: the encrypted content is cached
+// across runs, so it matches the stored upload session.
+func TestResumeAfterRestart(t *testing.T) {
+	defer func(threshold, size int64) {
+		resumableThreshold, chunkSize = threshold, size
+	}(resumableThreshold, chunkSize)
+	resumableThreshold, chunkSize = 1, 256<<10
+	defer func(temp, uploads string) {
+		config.TempCacheFolder, config.UploadCacheFolder = temp, uploads
+	}(config.TempCacheFolder, config.UploadCacheFolder)
+	config.TempCacheFolder, config.UploadCacheFolder = "/temp", "/uploads"
+
+	ctx := context.Background()
+	f, srv := newFakeDrive(t)
+	fs := osx.NewMemMapFs()
+	for _, dp := range []string{"/src", "/cache", config.TempCacheFolder, config.UploadCacheFolder} {
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// random content is stored uncompressed.
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	if err := fs.WriteFile("/src/big.bin", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	key, err := stream.DeriveKeys(stream.HashKey("drive test key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := func() *remote.Remote {
+		d, err := NewWithService(ctx, srv, http.DefaultClient, fs, "/cache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := remote.New(d, fs, "/src", key)
+		r.SetRetryPolicy(retry.Policy{Attempts: 1})
+		return r
+	}
+	sent := func(cut int) int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		n := f.received
+		f.received, f.cut = 0, cut
+		return n
+	}
+	file := &vfs.File{Relpath: "/big.bin", Mode: 0644}
+
+	r := start()
+	if err := r.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sent(300 << 10)
+	if err := r.Upload(ctx, file, false); !errors.Is(errors.IO, err) {
+		t.Fatalf("want IO error, got %v", err)
+	}
+	before := sent(0)
+	entries, err := fs.ReadDir(config.UploadCacheFolder)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("want the encrypted file cached, got %v %v", entries, err)
+	}
+	info, err := entries[0].Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// main removes the temporary files on exit.
+	if err := config.Delete(fs, config.D_TempCacheFolder); err != nil {
+		t.Fatal(err)
+	}
+	if err := start().Upload(ctx, file, false); err != nil {
+		t.Fatal(err)
+	}
+	if after := sent(0); before+after != int(info.Size()) {
+		t.Errorf("want %d bytes sent in total, got %d + %d", info.Size(), before, after)
+	}
+	if entries, _ := fs.ReadDir(config.UploadCacheFolder); len(entries) != 0 {
+		t.Errorf("want the cached file removed, got %v", entries)
+	}
+}
+
+// TestCache checks that the folder ids are cached across restarts and that
+// the changes of other clients are applied.
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	f, srv := newFakeDrive(t)
+	alice := newDrive(t, srv, osx.NewMemMapFs())
+	for _, dp := range []string{"/a", "/a/b", "/c"} {
+		if err := alice.CreateDir(ctx, rf(dp)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bobFs := osx.NewMemMapFs()
+	newDrive(t, srv, bobFs)
+	if _, err := bobFs.Stat("/" + CacheFilename); err != nil {
+		t.Fatal(err)
+	}
+	// changes while bob is offline.
+	if err := alice.CreateDir(ctx, rf("/a/b/d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.DeleteDir(ctx, rf("/c")); err != nil {
+		t.Fatal(err)
+	}
+
+	lists := f.requests["GET /drive/v3/files"]
+	bob := newDrive(t, srv, bobFs)
+	// the root folder is looked up, but the folders are not listed.
+	if n := f.requests["GET /drive/v3/files"] - lists; n != 1 {
+		t.Errorf("want 1 list request on restart, got %d", n)
+	}
+	want := map[string]string{"/": alice.ids.ids["/"], "/a": alice.ids.ids["/a"], "/a/b": alice.ids.ids["/a/b"], "/a/b/d": alice.ids.ids["/a/b/d"]}
+	if len(bob.ids.ids) != len(want) {
+		t.Errorf("want %v, got %v", want, bob.ids.ids)
+	}
+	for rp, id := range want {
+		if got, _ := bob.ids.get(rp); got != id {
+			t.Errorf("%s: want %s, got %s", rp, id, got)
+		}
+	}
+
+	// changes while bob is online are fetched for unknown folders.
+	if err := alice.RenameDir(ctx, rf("/a"), rf("/e")); err != nil {
+		t.Fatal(err)
+	}
+	lists = f.requests["GET /drive/v3/files"]
+	if _, err := bob.ReadDir(ctx, rf("/e/b/d")); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.requests["GET /drive/v3/files"] - lists; n != 1 {
+		t.Errorf("want only the list of the children, got %d list requests", n)
+	}
+	if _, ok := bob.ids.get("/a/b"); ok {
+		t.Error("renamed folder is still cached under its old name")
+	}
+
+	// an unusable cache is rebuilt.
+	for name, content := range map[string][]byte{
+		"corrupted":     []byte("not a gob"),
+		"expired token": nil,
+	} {
+		if content == nil {
+			bob.ids.mu.Lock()
+			bob.ids.pageToken = "999"
+			bob.ids.saveLocked()
+			bob.ids.mu.Unlock()
+		} else if err := bobFs.WriteFile("/"+CacheFilename, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		rebuilt := newDrive(t, srv, bobFs)
+		if got, _ := rebuilt.ids.get("/e/b/d"); got != want["/a/b/d"] {
+			t.Errorf("%s: want %s, got %v", name, want["/a/b/d"], rebuilt.ids.ids)
+		}
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	defer func(threshold, size int64) {
+		resumableThreshold, chunkSize = threshold, size
+	}(resumableThreshold, chunkSize)
+	resumableThreshold, chunkSize = 1, 256<<10
+
+	ctx := context.Background()
+	f, srv := newFakeDrive(t)
+	fs := osx.NewMemMapFs()
+	content := bytes.Repeat([]byte("0123456789"), 100<<10)
+	changed := bytes.Repeat([]byte("abcdefghij"), 100<<10)
+	// sent returns the bytes the fake received since the last call and sets
+	// the cut for the next uploads. The handler may still run after a cut.
+	sent := func(cut int) int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		n := f.received
+		f.received, f.cut = 0, cut
+		return n
+	}
+	read := func(d *Drive) []byte {
+		var buf bytes.Buffer
+		if err := d.ReadFile(ctx, rf("/big"), &buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// the connection breaks in the second chunk, a restarted client
+	// continues with the received bytes.
+	sent(300 << 10)
+	d := newDrive(t, srv, fs)
+	if err := d.CreateFile(ctx, rf("/big"), bytes.NewReader(content)); !errors.Is(errors.IO, err) {
+		t.Fatalf("want IO error, got %v", err)
+	}
+	d = newDrive(t, srv, fs)
+	if err := d.CreateFile(ctx, rf("/big"), bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if n := sent(0); n != len(content) {
+		t.Errorf("want %d bytes sent, got %d", len(content), n)
+	}
+	if got := read(d); !bytes.Equal(got, content) {
+		t.Error("created content differs")
+	}
+	if _, err := fs.Stat("/" + UploadsFilename); err != nil {
+		t.Fatal(err)
+	}
+	if len(loadUploads(fs, "/"+UploadsFilename).sessions) != 0 {
+		t.Error("finished upload not forgotten")
+	}
+
+	// an interrupted update continues as well.
+	sent(100 << 10)
+	if err := d.UpdateFile(ctx, rf("/big"), bytes.NewReader(changed)); !errors.Is(errors.IO, err) {
+		t.Fatalf("want IO error, got %v", err)
+	}
+	if err := d.UpdateFile(ctx, rf("/big"), bytes.NewReader(changed)); err != nil {
+		t.Fatal(err)
+	}
+	if n := sent(0); n != len(changed) {
+		t.Errorf("want %d bytes sent, got %d", len(changed), n)
+	}
+	if got := read(d); !bytes.Equal(got, changed) {
+		t.Error("updated content differs")
+	}
+
+	// other content or an expired session start over.
+	sent(100 << 10)
+	if err := d.UpdateFile(ctx, rf("/big"), bytes.NewReader(changed)); !errors.Is(errors.IO, err) {
+		t.Fatalf("want IO error, got %v", err)
+	}
+	if err := d.UpdateFile(ctx, rf("/big"), bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if n, want := sent(100<<10), 100<<10+len(content); n != want {
+		t.Errorf("want %d bytes sent, got %d", want, n)
+	}
+	if err := d.UpdateFile(ctx, rf("/big"), bytes.NewReader(changed)); !errors.Is(errors.IO, err) {
+		t.Fatalf("want IO error, got %v", err)
+	}
+	f.mu.Lock()
+	f.sessions = make(map[string]*uploadSession)
+	f.mu.Unlock()
+	if err := d.UpdateFile(ctx, rf("/big"), bytes.NewReader(changed)); err != nil {
+		t.Fatal(err)
+	}
+	if n, want := sent(0), 100<<10+len(changed); n != want {
+		t.Errorf("want %d bytes sent, got %d", want, n)
+	}
+	if got := read(d); !bytes.Equal(got, changed) {
+		t.Error("updated content differs")
+	}
+}
@@ -0,0 +1,417 @@
+package drive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// fakeDrive is a minimal stand-in for the Drive v3 REST API. It understands
+// the queries this package sends and nothing else. The root folder of the
+// drive has the id "root".
+type fakeDrive struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	files   map[string]*drive.File
+	content map[string][]byte
+	nextId  int
+	// changes is the log of the Changes API, a page token is an index.
+	changes []*drive.Change
+	// requests counts the requests by method and path prefix, e. g. "GET /drive/v3/files".
+	requests map[string]int
+	// fail makes the next requests fail with the given status codes.
+	fail []int
+
+	// sessions are the resumable uploads by upload id.
+	sessions    map[string]*uploadSession
+	nextSession int
+	// received counts the content bytes of resumable uploads.
+	received int
+	// cut makes the fake drop the connection of a resumable upload once the
+	// session received cut bytes.
+	cut int
+	// beforeCreate is called with the metadata of a new file before it is
+	// created, e. g. to create a file of the same name concurrently.
+	beforeCreate func(meta *drive.File)
+}
+
+type uploadSession struct {
+	meta *drive.File
+	// fileId is the id of the updated file, it is empty for new files.
+	fileId string
+	size   int
+	data   []byte
+	file   *drive.File
+}
+
+func newFakeDrive(t *testing.T) (*fakeDrive, *drive.Service) {
+	f := &fakeDrive{
+		t:        t,
+		files:    make(map[string]*drive.File),
+		content:  make(map[string][]byte),
+		requests: make(map[string]int),
+		sessions: make(map[string]*uploadSession),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	service, err := drive.NewService(context.Background(),
+		option.WithHTTPClient(srv.Client()),
+		option.WithEndpoint(srv.URL+"/drive/v3/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, service
+}
+
+func (f *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload := strings.HasPrefix(r.URL.Path, "/upload")
+	p := strings.TrimPrefix(r.URL.Path, "/upload")
+	id := strings.TrimPrefix(strings.TrimPrefix(p, "/drive/v3/files"), "/")
+	key := r.Method + " " + r.URL.Path
+	if strings.HasPrefix(p, "/drive/v3/files/") {
+		key = strings.TrimSuffix(key, id) + "{id}"
+	}
+	f.requests[key]++
+	if len(f.fail) > 0 {
+		status := f.fail[0]
+		f.fail = f.fail[1:]
+		reason := "failed"
+		if status == http.StatusForbidden {
+			reason = "rateLimitExceeded"
+		}
+		writeError(w, status, reason)
+		return
+	}
+
+	if upload && r.URL.Query().Get("uploadType") == "resumable" {
+		f.resumable(w, r, id)
+		return
+	}
+
+	switch {
+	case p == "/drive/v3/changes/startPageToken":
+		writeJSON(w, &drive.StartPageToken{StartPageToken: strconv.Itoa(len(f.changes))})
+	case p == "/drive/v3/changes":
+		f.listChanges(w, r)
+	case !strings.HasPrefix(p, "/drive/v3/files"):
+		writeError(w, http.StatusNotFound, "notFound")
+	case r.Method == http.MethodGet && id == "":
+		f.list(w, r)
+	case r.Method == http.MethodPost && id == "":
+		meta, data, err := readBody(r, upload)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "badRequest")
+			return
+		}
+		if !f.create(meta, data, upload) {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		writeJSON(w, meta)
+	case id == "" || f.files[id] == nil:
+		writeError(w, http.StatusNotFound, "notFound")
+	case r.Method == http.MethodGet && r.URL.Query().Get("alt") == "media":
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(f.content[id]))
+	case r.Method == http.MethodGet:
+		writeJSON(w, f.files[id])
+	case r.Method == http.MethodPatch:
+		meta, data, err := readBody(r, upload)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "badRequest")
+			return
+		}
+		writeJSON(w, f.update(id, meta, data, upload, r.URL.Query().Get("addParents")))
+	case r.Method == http.MethodDelete:
+		f.delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "methodNotAllowed")
+	}
+}
+
+// create adds the file meta with content data. It returns false if a parent
+// does not exist.
+func (f *fakeDrive) create(meta *drive.File, data []byte, upload bool) bool {
+	for _, parent := range meta.Parents {
+		if _, ok := f.files[parent]; !ok && parent != "root" {
+			return false
+		}
+	}
+	if hook := f.beforeCreate; hook != nil {
+		f.beforeCreate = nil
+		hook(meta)
+	}
+	f.nextId++
+	meta.Id = fmt.Sprintf("id%d", f.nextId)
+	meta.CreatedTime = time.Unix(int64(f.nextId), 0).UTC().Format(time.RFC3339)
+	if len(meta.Parents) == 0 {
+		meta.Parents = []string{"root"}
+	}
+	if upload {
+		f.content[meta.Id] = data
+		meta.Size = int64(len(data))
+	}
+	f.files[meta.Id] = meta
+	f.record(meta.Id)
+	return true
+}
+
+// update applies the metadata meta and, for uploads, the content data to id.
+func (f *fakeDrive) update(id string, meta *drive.File, data []byte, upload bool, addParent string) *drive.File {
+	file := f.files[id]
+	if meta.Name != "" {
+		file.Name = meta.Name
+	}
+	if meta.ModifiedTime != "" {
+		file.ModifiedTime = meta.ModifiedTime
+	}
+	if addParent != "" {
+		file.Parents = []string{addParent}
+	}
+	if upload {
+		f.content[id] = data
+		file.Size = int64(len(data))
+	}
+	f.record(id)
+	return file
+}
+
+// resumable starts a resumable upload of a new file or of the file id or, if
+// the request names a session, receives content or reports its state.
+func (f *fakeDrive) resumable(w http.ResponseWriter, r *http.Request, id string) {
+	uid := r.URL.Query().Get("upload_id")
+	if uid == "" {
+		if id != "" && f.files[id] == nil {
+			writeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		meta := &drive.File{}
+		size, err := strconv.Atoi(r.Header.Get("X-Upload-Content-Length"))
+		if err != nil || json.NewDecoder(r.Body).Decode(meta) != nil {
+			writeError(w, http.StatusBadRequest, "badRequest")
+			return
+		}
+		f.nextSession++
+		uid = strconv.Itoa(f.nextSession)
+		f.sessions[uid] = &uploadSession{meta: meta, fileId: id, size: size}
+		w.Header().Set("Location", r.URL.Path+"?uploadType=resumable&upload_id="+uid)
+		return
+	}
+
+	s := f.sessions[uid]
+	if s == nil || r.Method != http.MethodPut {
+		writeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+	var start, end, size int
+	contentRange := r.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &size); err == nil {
+		if start != len(s.data) || size != s.size || end >= size {
+			writeError(w, http.StatusBadRequest, "badContentRange")
+			return
+		}
+		var body io.Reader = r.Body
+		if f.cut > len(s.data) {
+			body = io.LimitReader(r.Body, int64(f.cut-len(s.data)))
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "badRequest")
+			return
+		}
+		s.data = append(s.data, data...)
+		f.received += len(data)
+		if f.cut > 0 && len(s.data) >= f.cut {
+			f.cut = 0
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				f.t.Error(err)
+				return
+			}
+			conn.Close()
+			return
+		}
+	} else if contentRange != fmt.Sprintf("bytes */%d", s.size) {
+		writeError(w, http.StatusBadRequest, "badContentRange")
+		return
+	}
+
+	switch {
+	case len(s.data) < s.size:
+		if len(s.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+	case s.file != nil:
+		writeJSON(w, s.file)
+	case s.fileId != "":
+		s.file = f.update(s.fileId, s.meta, s.data, true, "")
+		writeJSON(w, s.file)
+	case !f.create(s.meta, s.data, true):
+		writeError(w, http.StatusNotFound, "notFound")
+	default:
+		s.file = s.meta
+		writeJSON(w, s.file)
+	}
+}
+
+// record adds a change of id to the log.
+func (f *fakeDrive) record(id string) {
+	c := &drive.Change{FileId: id, Removed: f.files[id] == nil}
+	if !c.Removed {
+		file := *f.files[id]
+		c.File = &file
+	}
+	f.changes = append(f.changes, c)
+}
+
+func (f *fakeDrive) listChanges(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	if err != nil || start > len(f.changes) {
+		writeError(w, http.StatusBadRequest, "invalid")
+		return
+	}
+	list := &drive.ChangeList{Changes: f.changes[start:]}
+	// small pages exercise the pagination.
+	if end := start + 2; end < len(f.changes) {
+		list.Changes = f.changes[start:end]
+		list.NextPageToken = strconv.Itoa(end)
+	} else {
+		list.NewStartPageToken = strconv.Itoa(len(f.changes))
+	}
+	writeJSON(w, list)
+}
+
+// delete removes id and its descendants.
+func (f *fakeDrive) delete(id string) {
+	delete(f.files, id)
+	delete(f.content, id)
+	f.record(id)
+	for child, file := range f.files {
+		if file.Parents[0] == id {
+			f.delete(child)
+		}
+	}
+}
+
+func (f *fakeDrive) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var match []*drive.File
+	for _, file := range f.files {
+		if matches(file, q.Get("q")) {
+			match = append(match, file)
+		}
+	}
+	sort.Slice(match, func(i, j int) bool {
+		if q.Get("orderBy") == "createdTime" {
+			return match[i].CreatedTime < match[j].CreatedTime
+		}
+		return match[i].Id < match[j].Id
+	})
+	start, _ := strconv.Atoi(q.Get("pageToken"))
+	size, _ := strconv.Atoi(q.Get("pageSize"))
+	// small pages exercise the pagination.
+	if size == 0 || size > 2 {
+		size = 2
+	}
+	list := &drive.FileList{Files: []*drive.File{}}
+	if start < len(match) {
+		end := start + size
+		if end < len(match) {
+			list.NextPageToken = strconv.Itoa(end)
+		} else {
+			end = len(match)
+		}
+		list.Files = match[start:end]
+	}
+	writeJSON(w, list)
+}
+
+// matches evaluates the conjunctions of q that this package uses.
+func matches(file *drive.File, q string) bool {
+	for _, clause := range strings.Split(q, " and ") {
+		clause = strings.TrimSpace(clause)
+		switch {
+		case clause == "trashed = false":
+		case strings.HasSuffix(clause, " in parents"):
+			if file.Parents[0] != unquote(strings.TrimSuffix(clause, " in parents")) {
+				return false
+			}
+		case strings.HasPrefix(clause, "name = "):
+			if file.Name != unquote(strings.TrimPrefix(clause, "name = ")) {
+				return false
+			}
+		case strings.HasPrefix(clause, "mimeType = "):
+			if file.MimeType != unquote(strings.TrimPrefix(clause, "mimeType = ")) {
+				return false
+			}
+		case strings.HasPrefix(clause, "mimeType != "):
+			if file.MimeType == unquote(strings.TrimPrefix(clause, "mimeType != ")) {
+				return false
+			}
+		default:
+			panic("fakeDrive: unsupported query " + clause)
+		}
+	}
+	return true
+}
+
+func unquote(s string) string {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "'"), "'")
+	return strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(s)
+}
+
+// readBody reads the metadata and, for uploads, the content of the request.
+func readBody(r *http.Request, upload bool) (*drive.File, []byte, error) {
+	meta := &drive.File{}
+	if !upload {
+		return meta, nil, json.NewDecoder(r.Body).Decode(meta)
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.NewDecoder(part).Decode(meta); err != nil {
+		return nil, nil, err
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(part)
+	return meta, data, err
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q, "errors": [{"reason": %q}]}}`, status, reason, reason)
+}
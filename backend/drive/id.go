@@ -1,15 +1,16 @@
 package drive
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
-	"fmt"
-	"log"
-	"os"
-	"path/filepath"
+	"path"
+	"strings"
 	"sync"
 
 	"github.com/liamvdv/sharedHome/backend"
-	. "github.com/liamvdv/sharedHome/util"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
 	"google.golang.org/api/drive/v3"
 )
 
@@ -18,134 +19,341 @@ import (
 	since Google Drive is neither hierachical, nor ensures it name uniqueness.
 	Files have to be linked to their parents, so we need to build a local
 	representation of the remote file system.
-	We will store the hash paths to a map, which we can then serialise to a cache.
+	We store the ids of all folders below the backend.RemoteFolderName folder by
+	their hashed relpath. The relpath of that folder is "/".
+
+	The ids are cached in a file together with a start page token of the
+	Changes API. On startup, only the changes since that token are fetched, so
+	that we neither list the whole drive nor miss folders created, moved or
+	deleted by other clients.
 */
 
 // remoteId is a workaround because the drive isn't hierarchical.
 type remoteId struct {
+	fs      osx.Fs
+	cacheFp string
+
 	mu  sync.RWMutex
 	ids map[string]string
+	// paths is the inverse of ids.
+	paths map[string]string
+	// pageToken is the start page token of the Changes API up to which the
+	// changes are reflected in ids.
+	pageToken string
 }
 
-// newRemoteId first looks if it can read from the provided cache. If it exists
-// but reading from it fails, newRemoteId deletes it and moves on to the second option.
-// If it cannot read from cache, newRemoteID fetches all directories from drive,
-// and stores them in the cache. If it is not possible to fetch from remote,
-// an error is returned and the application to be terminated.
-func newRemoteId(cacheFp string, srv *drive.Service) *remoteId {
-	r := remoteId{}
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if err := remoteIdFromCache(cacheFp, r.ids); err == nil {
-		return &r
+// remoteIdCache is the content of the cache file.
+type remoteIdCache struct {
+	Ids       map[string]string
+	PageToken string
+}
+
+// newRemoteId loads the ids from the cache at cacheFp and applies the
+// changes since. If that is not possible, it fetches all folders below the
+// folder rootId from drive and creates the cache.
+func newRemoteId(ctx context.Context, srv *drive.Service, fs osx.Fs, cacheFp, rootId string) (*remoteId, error) {
+	r := &remoteId{fs: fs, cacheFp: cacheFp}
+	if err := r.load(rootId); err == nil {
+		err := r.update(ctx, srv)
+		if err == nil {
+			return r, nil
+		}
+		if errors.Is(errors.IO, err) || errors.Is(errors.Permission, err) {
+			return nil, err
+		}
+		// the cache is outdated, e. g. because the page token expired or the
+		// root folder was replaced.
+	}
+
+	// the token must be taken before listing, so that no change is lost.
+	token, err := srv.Changes.GetStartPageToken().Context(ctx).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	ids := map[string]string{"/": rootId}
+	if err := remoteIdFromRemote(ctx, srv, rootId, ids); err != nil {
+		return nil, err
 	}
-	if err := remoteIdFromRemote(srv, r.ids); err != nil {
-		// TODO
-		return nil
+	r.reset(ids, token.StartPageToken)
+	if err := r.save(); err != nil {
+		return nil, err
 	}
-	return &r
+	return r, nil
 }
 
-// remoteIdFromCache will try to load the cache located in fp to ids. If that is
-// not possible because the cache doesn't exist, or the decoding fails, it returns
-// a non-nil error. If the decoding fails, it will also delete the cache file.
-func remoteIdFromCache(fp string, ids map[string]string) error {
-	f, err := os.Open(fp)
+type folder struct {
+	name    string
+	parent  string
+	created string
+}
+
+// remoteIdFromRemote gets all folders in the drive and adds the relpaths of
+// those below the folder rootId to ids. Folders of the same name in the same
+// parent resolve to the oldest one.
+func remoteIdFromRemote(ctx context.Context, srv *drive.Service, rootId string, ids map[string]string) error {
+	folders := make(map[string]folder)
+	err := srv.Files.List().
+		Q("mimeType = '"+folderMimeType+"' and trashed = false").
+		PageSize(1000).
+		Fields("nextPageToken, files(id, name, parents, createdTime)").
+		Pages(ctx, func(list *drive.FileList) error {
+			for _, f := range list.Files {
+				if len(f.Parents) > 0 {
+					folders[f.Id] = folder{name: f.Name, parent: f.Parents[0], created: f.CreatedTime}
+				}
+			}
+			return nil
+		})
 	if err != nil {
-		return err
+		return apiError(err)
 	}
-	defer f.Close()
-	dec := gob.NewDecoder(f)
-	err = dec.Decode(&ids)
-	if err != nil {
-		log.Printf("gob: remoteId cache corrupted %v\n", err)
-		if err := os.Remove(fp); err != nil {
-			log.Printf("remoteId: cannot remove corrupted cache at %q %v\n", fp, err)
+
+	// relpaths memoises the resolved relpaths, "" marks folders that are not
+	// below the root.
+	relpaths := map[string]string{rootId: "/"}
+	var resolve func(id string) string
+	resolve = func(id string) string {
+		if rp, ok := relpaths[id]; ok {
+			return rp
 		}
-		return err
+		relpaths[id] = "" // breaks cycles
+		f, ok := folders[id]
+		if !ok {
+			return ""
+		}
+		dp := resolve(f.parent)
+		if dp == "" {
+			return ""
+		}
+		rp := path.Join(dp, f.name)
+		relpaths[id] = rp
+		return rp
+	}
+	for id := range folders {
+		rp := resolve(id)
+		if rp == "" {
+			continue
+		}
+		if other, ok := ids[rp]; ok && other != id && folders[other].created <= folders[id].created {
+			continue
+		}
+		ids[rp] = id
 	}
 	return nil
 }
 
-type tempTree struct {
-	name     string
-	id       string
-	parentId string
-}
-
-// remoteIdFromeRemote gets all folders in the drive and inserts them into the tempTree.
-// Can use linear insertion because folders are ordered by mod time asc, so
-// parent folders are guaratneed to come before child folders.
-func remoteIdFromRemote(srv *drive.Service, ids map[string]string) error {
-	q := fmt.Sprintf("trashed = false and mimeType = 'application/vnd.google-apps.folder'")
-	o := "modifiedTime asc"
+// update applies the changes since the page token and saves the cache. It
+// fails with errors.Invalid if the root folder was removed.
+func (r *remoteId) update(ctx context.Context, srv *drive.Service) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// only the latest change of each file matters.
+	latest := make(map[string]*drive.Change)
+	var order []string
+	token := r.pageToken
+	for token != "" {
+		list, err := srv.Changes.List(token).
+			PageSize(1000).
+			Spaces("drive").
+			Fields("nextPageToken, newStartPageToken, changes(fileId, removed, file(id, name, mimeType, parents, trashed))").
+			Context(ctx).
+			Do()
+		if err != nil {
+			return apiError(err)
+		}
+		for _, c := range list.Changes {
+			if _, ok := latest[c.FileId]; !ok {
+				order = append(order, c.FileId)
+			}
+			latest[c.FileId] = c
+		}
+		if list.NewStartPageToken != "" {
+			r.pageToken = list.NewStartPageToken
+			break
+		}
+		token = list.NextPageToken
+	}
 
-	var list *drive.FileList
-	var err error
-	var nextPageToken string
-	for more := true; more; more = nextPageToken != "" {
-		req := srv.Files.List().Fields("nextPageToken, files(id, name, parents)").Q(q)
-		if nextPageToken != "" {
-			req = req.PageToken(nextPageToken)
+	var pending []*drive.File
+	for _, id := range order {
+		c := latest[id]
+		removed := c.Removed || c.File == nil || c.File.Trashed
+		if id == r.ids["/"] && (removed || c.File.Name != backend.RemoteFolderName) {
+			return errors.E(errors.Invalid, "the remote folder was removed")
 		}
-		list, err = req.OrderBy(o).Do()
-		if err != nil {
-			return err
-		}
-		if len(list.Files) == 0 {
-			log.Println("no remote files found.")
-		}
-		// linear search fine because ordered and remote folder last mtime 1970.
-		// BUG(liamvdv): Actually, this is only true for the created time, which we don't know for the local files.
-		seen := make(map[string]string)
-		for _, f := range list.Files {
-			log.Printf("Name: %s Id: %s Parents: %v\n", f.Name, f.Id, f.Parents)
-			// key: id value: relpath, backend.RemoteFolderName has relpath ""
-			// check if a parent exists and if so, add it.
-			if dp, exists := seen[f.Parents[0]]; exists {
-				relpath := filepath.Join(dp, f.Name)
-				ids[relpath] = f.Id
-				seen[f.Id] = relpath
-			} else if f.Name == backend.RemoteFolderName {
-				seen[f.Id] = ""
+		if removed {
+			if rp, ok := r.paths[id]; ok {
+				r.forgetLocked(rp)
 			}
+			continue
+		}
+		if c.File.MimeType == folderMimeType {
+			pending = append(pending, c.File)
 		}
-		nextPageToken = list.NextPageToken
 	}
-	return nil
+
+	// a folder may be reported before its parent, thus we apply the changes
+	// until no more folders can be placed.
+	for progress := true; progress && len(pending) > 0; {
+		progress = false
+		rest := pending[:0]
+		for _, f := range pending {
+			if r.place(f) {
+				progress = true
+			} else {
+				rest = append(rest, f)
+			}
+		}
+		pending = rest
+	}
+	// the remaining folders are not below the root (anymore).
+	for _, f := range pending {
+		if rp, ok := r.paths[f.Id]; ok {
+			r.forgetLocked(rp)
+		}
+	}
+	return r.saveLocked()
 }
 
-// TODO(liamvdv): remove TestRemoveIdList
-func TestRemoteIdList() {
-	// util.PrepareTestConfigInit()
-	// config.Init()
+// place updates the relpath of the folder f. It returns false if the parent of
+// f is unknown.
+func (r *remoteId) place(f *drive.File) bool {
+	if len(f.Parents) == 0 {
+		return false
+	}
+	dp, ok := r.paths[f.Parents[0]]
+	if !ok {
+		return false
+	}
+	rp := path.Join(dp, f.Name)
+	if old, ok := r.paths[f.Id]; ok {
+		if old == rp {
+			return true
+		}
+		r.renameLocked(old, rp)
+		return true
+	}
+	// an older folder of the same name takes precedence.
+	if _, ok := r.ids[rp]; !ok {
+		r.setLocked(rp, f.Id)
+	}
+	return true
+}
 
-	drive, err := New()
-	if err != nil {
-		log.Println(err)
-		return
+// get returns the id of the folder relpath.
+func (r *remoteId) get(relpath string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.ids[relpath]
+	return id, ok
+}
+
+// set, forget and rename save the cache, but ignore errors. The cache is only
+// an optimisation and an outdated cache is corrected by the changes since its
+// page token on the next start.
+
+func (r *remoteId) set(relpath, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setLocked(relpath, id)
+	r.saveLocked()
+}
+
+// forget removes the folder relpath and its descendants. The root is kept.
+func (r *remoteId) forget(relpath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forgetLocked(relpath)
+	r.saveLocked()
+}
+
+// rename moves the folder old and its descendants to new.
+func (r *remoteId) rename(old, new string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.renameLocked(old, new)
+	r.saveLocked()
+}
+
+func (r *remoteId) setLocked(relpath, id string) {
+	if old, ok := r.ids[relpath]; ok {
+		delete(r.paths, old)
+	}
+	r.ids[relpath] = id
+	r.paths[id] = relpath
+}
+
+func (r *remoteId) forgetLocked(relpath string) {
+	for rp, id := range r.ids {
+		if rp != "/" && isBelow(rp, relpath) {
+			delete(r.ids, rp)
+			delete(r.paths, id)
+		}
 	}
-	// fp := filepath.Join(config.Temp, "drive-id-cache.gob")
+}
 
-	m := make(map[string]string)
-	if err := remoteIdFromRemote(drive.srv, m); err != nil {
-		log.Println(err)
+func (r *remoteId) renameLocked(old, new string) {
+	r.forgetLocked(new)
+	moved := make(map[string]string)
+	for rp, id := range r.ids {
+		if isBelow(rp, old) {
+			moved[new+rp[len(old):]] = id
+			delete(r.ids, rp)
+		}
+	}
+	for rp, id := range moved {
+		r.setLocked(rp, id)
+	}
+}
+
+func (r *remoteId) reset(ids map[string]string, pageToken string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids = ids
+	r.paths = make(map[string]string, len(ids))
+	for rp, id := range ids {
+		r.paths[id] = rp
 	}
+	r.pageToken = pageToken
 }
 
-func remoteIdToCache(fp string, ids map[string]string) error {
-	f, err := os.OpenFile(fp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+// load reads the cache. It fails if there is none, it is corrupted or it
+// belongs to another root folder.
+func (r *remoteId) load(rootId string) error {
+	raw, err := r.fs.ReadFile(r.cacheFp)
 	if err != nil {
 		return err
 	}
-	defer SaveClose(f)
-	enc := gob.NewEncoder(f)
-	return enc.Encode(&ids)
+	var c remoteIdCache
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&c); err != nil {
+		return errors.E(errors.Invalid, err)
+	}
+	if c.Ids["/"] != rootId || c.PageToken == "" {
+		return errors.E(errors.Invalid, "cache of another remote folder")
+	}
+	r.reset(c.Ids, c.PageToken)
+	return nil
 }
 
-func (r *remoteId) get(relpath string) string {
+func (r *remoteId) save() error {
 	r.mu.RLock()
-	ret := r.ids[relpath]
-	r.mu.RUnlock()
-	return ret
+	defer r.mu.RUnlock()
+	return r.saveLocked()
+}
+
+// saveLocked writes the cache. The caller must hold mu.
+func (r *remoteId) saveLocked() error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(remoteIdCache{Ids: r.ids, PageToken: r.pageToken}); err != nil {
+		return err
+	}
+	if err := r.fs.WriteFile(r.cacheFp, buf.Bytes(), 0600); err != nil {
+		return errors.E(errors.Path(r.cacheFp), err)
+	}
+	return nil
+}
+
+// isBelow returns true if relpath is dirpath or one of its descendants.
+func isBelow(relpath, dirpath string) bool {
+	return relpath == dirpath || strings.HasPrefix(relpath, strings.TrimSuffix(dirpath, "/")+"/")
 }
@@ -1,95 +1,334 @@
 package drive
 
 import (
+	"context"
 	"io"
-	"log"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
 	"github.com/liamvdv/sharedHome/errors"
-	"github.com/liamvdv/sharedHome/fs"
-	"golang.org/x/net/context"
-	"golang.org/x/oauth2/google"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/vfs"
+	"golang.org/x/oauth2"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
 )
 
+// Name is the value of config.Config.UseBackend that selects this backend.
+const Name = "drive"
+
 var (
-	_ backend.Service = (*Drive)(nil)
+	_ backend.Service         = (*Drive)(nil)
+	_ backend.FileRangeReader = (*Drive)(nil)
 )
 
+func init() {
+	backend.Register(backend.Backend{
+		Name: Name,
+		New: func(env config.Env) (backend.Service, error) {
+			return NewFromConfig(context.Background(), env.Fs)
+		},
+		Auth: Auth,
+	})
+}
+
 // Drive must implement Service.
 type Drive struct {
-	srv    *drive.Service
-	parIDs map[string]string
+	srv *drive.Service
+	// client is the authorised client of srv, used for resumable uploads.
+	client  *http.Client
+	ids     *remoteId
+	uploads *uploads
+	// createMu serialises the creation of folders, so that concurrent calls
+	// do not create the same folder twice.
+	createMu sync.Mutex
 }
 
-func New() (*Drive, error) {
-	const op = errors.Op("backend.drive.New")
+// CacheFilename is the name of the folder id cache in config.IndexCacheFolder.
+const CacheFilename = "drive-folders.gob"
 
-	raw, err := os.ReadFile(DriveCredentialsFilepath)
+// NewFromConfig authorises with the stored credentials and token, which is
+// stored again whenever it is renewed, and calls NewWithService.
+func NewFromConfig(ctx context.Context, fs osx.Fs) (*Drive, error) {
+	const op = errors.Op("backend.drive.NewFromConfig")
+	cfg, err := oauthConfig()
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
-	// drive.DriveScope allows full access to google drive of user.
-	cfg, err := google.ConfigFromJSON(raw, drive.DriveScope)
+	tok, err := tokenFromFile()
+	if os.IsNotExist(err) {
+		return nil, errors.E(op, errors.NotExist, errors.Errorf("the %s backend is not authorised, run init", Name))
+	}
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
-	client := GetClient(cfg)
-
-	ctx := context.Background()
+	client := oauth2.NewClient(ctx, &savingTokenSource{src: cfg.TokenSource(ctx, tok), last: tok})
 	srv, err := drive.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
-		log.Fatalf("Unable to retrieve Drive client: %v", err)
+		return nil, errors.E(op, err)
 	}
+	return NewWithService(ctx, srv, client, fs, config.IndexCacheFolder)
+}
 
-	if err := initGlobals(srv); err != nil {
-		log.Panicf("could not initGlobals: %v\n", err) // TODO(liamvdv): remove
-		return nil, err
+// NewWithService gets or creates the backend.RemoteFolderName folder in the
+// root of the drive and loads the ids of all folders below it, see remoteId.
+// client must be the HTTP client of srv. The ids are cached in the file
+// CacheFilename and unfinished uploads in UploadsFilename, both in cacheDir.
+func NewWithService(ctx context.Context, srv *drive.Service, client *http.Client, fs osx.Fs, cacheDir string) (*Drive, error) {
+	const op = errors.Op("backend.drive.NewWithService")
+	root, err := findChild(ctx, srv, "root", backend.RemoteFolderName, true)
+	if errors.Is(errors.NotExist, err) {
+		root, err = createFolder(ctx, srv, "root", backend.RemoteFolderName, nil)
+	}
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	ids, err := newRemoteId(ctx, srv, fs, filepath.Join(cacheDir, CacheFilename), root.Id)
+	if err != nil {
+		return nil, errors.E(op, err)
 	}
-
 	return &Drive{
-		srv: srv,
+		srv:     srv,
+		client:  client,
+		ids:     ids,
+		uploads: loadUploads(fs, filepath.Join(cacheDir, UploadsFilename)),
 	}, nil
 }
 
-func (d *Drive) CreateFile(ctx context.Context, h backend.RemoteFileHeader, src io.Reader) error {
-	parentId := "TODO" // TODO(liamvdv): proper parent
+// CreateFile creates h. Drive allows several files of the same name in a
+// folder, thus a concurrent create is detected afterwards: the oldest file of
+// the name wins, the others are deleted and fail with errors.Exist.
+func (d *Drive) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	const op = errors.Op("backend.drive.CreateFile")
+	dp, name := path.Split(h.HashRelpath)
+	parentId, err := d.dirId(ctx, path.Clean(dp), true)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if _, err := findChild(ctx, d.srv, parentId, name, false); err == nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+	} else if !errors.Is(errors.NotExist, err) {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	var id string
+	if rs, size, ok := resumable(src); ok {
+		meta := &drive.File{
+			Name:         name,
+			ModifiedTime: modifiedTime(h.Local),
+			Parents:      []string{parentId},
+			MimeType:     binaryMimeType,
+		}
+		id, err = d.upload(ctx, h.HashRelpath, rs, size, meta, "")
+	} else {
+		var f *drive.File
+		if f, err = createFile(ctx, d.srv, parentId, name, h.Local, src); err == nil {
+			id = f.Id
+		}
+	}
+	if err != nil {
+		d.stale(ctx, path.Clean(dp), err)
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	oldest, err := findChild(ctx, d.srv, parentId, name, false)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if oldest.Id != id {
+		if err := deleteFile(ctx, d.srv, id); err != nil {
+			return errors.E(op, errors.Path(h.HashRelpath), errors.Errorf("lost a concurrent create, cannot delete the duplicate: %v", err))
+		}
+		return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+	}
+	return nil
+}
+
+func (d *Drive) ReadFile(ctx context.Context, h backend.RemoteFile, dst io.Writer) error {
+	return d.readFile(ctx, errors.Op("backend.drive.ReadFile"), h, 0, dst)
+}
 
-	return createFile(ctx, d.srv, parentId, h.Name, h.Local.ModTime, src)
+func (d *Drive) ReadFileFrom(ctx context.Context, h backend.RemoteFile, off int64, dst io.Writer) error {
+	return d.readFile(ctx, errors.Op("backend.drive.ReadFileFrom"), h, off, dst)
 }
 
-func (d *Drive) ReadFile(ctx context.Context, h backend.RemoteFileHeader, dst io.Writer) error {
+func (d *Drive) readFile(ctx context.Context, op errors.Op, h backend.RemoteFile, off int64, dst io.Writer) error {
+	f, err := d.file(ctx, h.HashRelpath)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if err := getFile(ctx, d.srv, f.Id, off, dst); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
 	return nil
 }
 
-func (d *Drive) UpdateFile(ctx context.Context, h backend.RemoteFileHeader, src io.Reader) error {
+// UpdateFile replaces the content of h. It creates h if it does not exist.
+func (d *Drive) UpdateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	const op = errors.Op("backend.drive.UpdateFile")
+	f, err := d.file(ctx, h.HashRelpath)
+	if errors.Is(errors.NotExist, err) {
+		if err := d.CreateFile(ctx, h, src); err != nil {
+			return errors.E(op, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if rs, size, ok := resumable(src); ok {
+		_, err = d.upload(ctx, h.HashRelpath, rs, size, &drive.File{ModifiedTime: modifiedTime(h.Local)}, f.Id)
+	} else {
+		err = updateFile(ctx, d.srv, f.Id, h.Local, src)
+	}
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
 	return nil
 }
 
-func (d *Drive) DeleteFile(ctx context.Context, h backend.RemoteFileHeader) error {
+func (d *Drive) DeleteFile(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.drive.DeleteFile")
+	f, err := d.file(ctx, h.HashRelpath)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if err := deleteFile(ctx, d.srv, f.Id); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
 	return nil
 }
 
-func (d *Drive) RenameFile(ctx context.Context, oldHeader, newHeader backend.RemoteFileHeader) error {
+// RenameFile moves old to new. An existing file new is replaced.
+func (d *Drive) RenameFile(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.drive.RenameFile")
+	f, err := d.file(ctx, old.HashRelpath)
+	if err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	dp, name := path.Split(new.HashRelpath)
+	parentId, err := d.dirId(ctx, path.Clean(dp), true)
+	if err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	if existing, err := findChild(ctx, d.srv, parentId, name, false); err == nil {
+		if err := deleteFile(ctx, d.srv, existing.Id); err != nil {
+			return errors.E(op, errors.Path(old.HashRelpath), err)
+		}
+	} else if !errors.Is(errors.NotExist, err) {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	oldParentId := parentId
+	if len(f.Parents) > 0 {
+		oldParentId = f.Parents[0]
+	}
+	if err := move(ctx, d.srv, f.Id, name, oldParentId, parentId); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
 	return nil
 }
 
-//
-func (d *Drive) CreateDir(ctx context.Context, h backend.RemoteDirHeader) error {
+// CreateDir creates the folder h and its missing parents.
+func (d *Drive) CreateDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.drive.CreateDir")
+	if _, ok := d.ids.get(h.HashRelpath); ok {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+	}
+	d.createMu.Lock()
+	defer d.createMu.Unlock()
+	dp, name := path.Split(h.HashRelpath)
+	parentId, err := d.mkdirAll(ctx, path.Clean(dp))
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if f, err := findChild(ctx, d.srv, parentId, name, true); err == nil {
+		d.ids.set(h.HashRelpath, f.Id)
+		return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+	} else if !errors.Is(errors.NotExist, err) {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	f, err := createFolder(ctx, d.srv, parentId, name, h.Local)
+	if err != nil {
+		d.stale(ctx, path.Clean(dp), err)
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	d.ids.set(h.HashRelpath, f.Id)
 	return nil
 }
 
-func (d *Drive) ReadDir(ctx context.Context, h backend.RemoteDirHeader) (fs.DirHeader, error) {
-	return fs.DirHeader{}, nil
+func (d *Drive) ReadDir(ctx context.Context, h backend.RemoteFile) (*vfs.File, error) {
+	const op = errors.Op("backend.drive.ReadDir")
+	id, err := d.dirId(ctx, h.HashRelpath, false)
+	if err != nil {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	dir := &vfs.File{
+		Relpath:  h.HashRelpath,
+		Mode:     os.ModeDir | 0700,
+		Children: []vfs.File{},
+	}
+	err = listChildren(ctx, d.srv, id, func(f *drive.File) {
+		child := toFile(f)
+		child.Relpath = path.Join(h.HashRelpath, f.Name)
+		if child.Mode.IsDir() {
+			if _, ok := d.ids.get(child.Relpath); !ok {
+				d.ids.set(child.Relpath, f.Id)
+			}
+		}
+		dir.Children = append(dir.Children, child)
+	})
+	if err != nil {
+		d.stale(ctx, h.HashRelpath, err)
+		return nil, errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	dir.Size = int64(len(dir.Children))
+	return dir, nil
 }
 
-func (d *Drive) DeleteDir(ctx context.Context, h backend.RemoteDirHeader) error {
+func (d *Drive) DeleteDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.drive.DeleteDir")
+	id, err := d.dirId(ctx, h.HashRelpath, false)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if err := deleteFile(ctx, d.srv, id); err != nil {
+		d.stale(ctx, h.HashRelpath, err)
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	d.ids.forget(h.HashRelpath)
 	return nil
 }
 
-func (d *Drive) RenameDir(ctx context.Context, oldHeader, newHeader backend.RemoteDirHeader) error {
+// RenameDir moves old to new. It fails if new exists.
+func (d *Drive) RenameDir(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.drive.RenameDir")
+	id, err := d.dirId(ctx, old.HashRelpath, false)
+	if err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	if _, err := d.dirId(ctx, new.HashRelpath, false); err == nil {
+		return errors.E(op, errors.Path(new.HashRelpath), errors.Exist)
+	} else if !errors.Is(errors.NotExist, err) {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	oldParentId, err := d.dirId(ctx, path.Dir(old.HashRelpath), false)
+	if err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	dp, name := path.Split(new.HashRelpath)
+	parentId, err := d.dirId(ctx, path.Clean(dp), true)
+	if err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	if err := move(ctx, d.srv, id, name, oldParentId, parentId); err != nil {
+		d.stale(ctx, old.HashRelpath, err)
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	d.ids.rename(old.HashRelpath, new.HashRelpath)
 	return nil
 }
 
@@ -97,3 +336,105 @@ func (d *Drive) RenameDir(ctx context.Context, oldHeader, newHeader backend.Remo
 func (d *Drive) AddContext(ctx context.Context) {
 
 }
+
+// dirId returns the id of the folder relpath. If it is not known yet, the
+// changes of other clients are fetched. If it is still unknown, it is looked
+// up and, if create is set, created with all missing parents.
+func (d *Drive) dirId(ctx context.Context, relpath string, create bool) (string, error) {
+	if id, ok := d.ids.get(relpath); ok {
+		return id, nil
+	}
+	if err := d.ids.update(ctx, d.srv); err != nil {
+		return "", err
+	}
+	if id, ok := d.ids.get(relpath); ok {
+		return id, nil
+	}
+	if create {
+		d.createMu.Lock()
+		defer d.createMu.Unlock()
+		return d.mkdirAll(ctx, relpath)
+	}
+	return d.lookup(ctx, relpath)
+}
+
+// lookup returns the id of the folder relpath and looks up the unknown folders
+// of the path by name.
+func (d *Drive) lookup(ctx context.Context, relpath string) (string, error) {
+	if id, ok := d.ids.get(relpath); ok {
+		return id, nil
+	}
+	parentId, err := d.lookup(ctx, path.Dir(relpath))
+	if err != nil {
+		return "", err
+	}
+	f, err := findChild(ctx, d.srv, parentId, path.Base(relpath), true)
+	if err != nil {
+		return "", err
+	}
+	d.ids.set(relpath, f.Id)
+	return f.Id, nil
+}
+
+// mkdirAll returns the id of the folder relpath and creates it and its
+// parents if necessary. The caller must hold createMu.
+func (d *Drive) mkdirAll(ctx context.Context, relpath string) (string, error) {
+	if id, ok := d.ids.get(relpath); ok {
+		return id, nil
+	}
+	parentId, err := d.mkdirAll(ctx, path.Dir(relpath))
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(relpath)
+	f, err := findChild(ctx, d.srv, parentId, name, true)
+	if errors.Is(errors.NotExist, err) {
+		f, err = createFolder(ctx, d.srv, parentId, name, nil)
+		d.stale(ctx, path.Dir(relpath), err)
+	}
+	if err != nil {
+		return "", err
+	}
+	d.ids.set(relpath, f.Id)
+	return f.Id, nil
+}
+
+// file returns the metadata of the file relpath.
+func (d *Drive) file(ctx context.Context, relpath string) (*drive.File, error) {
+	parentId, err := d.dirId(ctx, path.Dir(relpath), false)
+	if err != nil {
+		return nil, err
+	}
+	return findChild(ctx, d.srv, parentId, path.Base(relpath), false)
+}
+
+// stale is called with the error of a call that used the id of the folder
+// relpath. If the folder was not found, e. g. because another client deleted
+// it, stale forgets it and all cached parents that no longer exist either.
+func (d *Drive) stale(ctx context.Context, relpath string, err error) {
+	if !errors.Is(errors.NotExist, err) {
+		return
+	}
+	for rp := relpath; rp != "/"; rp = path.Dir(rp) {
+		id, ok := d.ids.get(rp)
+		if !ok {
+			continue
+		}
+		if f, err := d.srv.Files.Get(id).Fields("id, trashed").Context(ctx).Do(); err == nil && !f.Trashed {
+			return
+		}
+		d.ids.forget(rp)
+	}
+}
+
+func toFile(f *drive.File) vfs.File {
+	file := vfs.File{Mode: 0600, Size: f.Size}
+	if f.MimeType == folderMimeType {
+		file.Mode = os.ModeDir | 0700
+		file.Size = 0
+	}
+	if t, err := time.Parse(time.RFC3339Nano, f.ModifiedTime); err == nil {
+		file.MTime = t.UnixNano()
+	}
+	return file
+}
@@ -0,0 +1,313 @@
+package drive
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+/*
+	Large files are uploaded with the resumable upload protocol of Drive, see
+	https://developers.google.com/drive/api/guides/manage-uploads#resumable.
+	The session URI of an upload is stored in the file UploadsFilename, so
+	that an interrupted upload continues at the last byte Drive acknowledged,
+	even after a restart. This only works if the same bytes are sent again,
+	which remote.Upload guarantees by keeping the encrypted file until the
+	upload succeeded. The SHA-256 of the content detects if they are not.
+*/
+
+// UploadsFilename is the name of the file in config.IndexCacheFolder that
+// holds the sessions of unfinished uploads.
+const UploadsFilename = "drive-uploads.json"
+
+var (
+	// resumableThreshold is the size from which files are uploaded resumably.
+	resumableThreshold int64 = 8 << 20
+	// chunkSize is the size of the parts of a resumable upload. Drive
+	// requires a multiple of 256 KiB.
+	chunkSize int64 = 8 << 20
+)
+
+// sessionTTL is the time after which Drive forgets an upload session.
+const sessionTTL = 7 * 24 * time.Hour
+
+// session is a resumable upload.
+type session struct {
+	URI string
+	// FileId is the id of the updated file. It is empty if a file is created.
+	FileId string
+	// ParentId is the id of the folder a file is created in.
+	ParentId string
+	Size     int64
+	// Hash is the hex encoded SHA-256 of the content.
+	Hash    string
+	Created time.Time
+}
+
+// uploads stores the sessions of unfinished uploads by the remote path of
+// the file.
+type uploads struct {
+	fs osx.Fs
+	fp string
+
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+// loadUploads reads the sessions stored in fp. A missing or corrupt file is
+// treated like an empty one, the uploads then start over.
+func loadUploads(fs osx.Fs, fp string) *uploads {
+	u := &uploads{fs: fs, fp: fp, sessions: make(map[string]session)}
+	raw, err := fs.ReadFile(fp)
+	if err != nil {
+		return u
+	}
+	if err := json.Unmarshal(raw, &u.sessions); err != nil {
+		u.sessions = make(map[string]session)
+		return u
+	}
+	for key, s := range u.sessions {
+		if time.Since(s.Created) > sessionTTL {
+			delete(u.sessions, key)
+		}
+	}
+	return u
+}
+
+func (u *uploads) get(key string) (session, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s, ok := u.sessions[key]
+	return s, ok
+}
+
+// set stores s as the session of key. Like remoteId.set, it ignores errors
+// of writing the file, the upload then cannot be resumed after a restart.
+func (u *uploads) set(key string, s session) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sessions[key] = s
+	_ = u.saveLocked()
+}
+
+func (u *uploads) delete(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.sessions[key]; !ok {
+		return
+	}
+	delete(u.sessions, key)
+	_ = u.saveLocked()
+}
+
+// saveLocked writes the sessions. The caller must hold mu.
+func (u *uploads) saveLocked() error {
+	raw, err := json.Marshal(u.sessions)
+	if err != nil {
+		return err
+	}
+	if err := u.fs.WriteFile(u.fp, raw, 0600); err != nil {
+		return errors.E(errors.Path(u.fp), err)
+	}
+	return nil
+}
+
+// resumable returns src as an io.ReadSeeker and its size if it should be
+// uploaded resumably. It rewinds src, which must be at its start.
+func resumable(src io.Reader) (io.ReadSeeker, int64, bool) {
+	rs, ok := src.(io.ReadSeeker)
+	if !ok {
+		return nil, 0, false
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, false
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, false
+	}
+	return rs, size, size >= resumableThreshold
+}
+
+// upload uploads src of the given size resumably. It creates the file meta if
+// fileId is empty and updates the file fileId otherwise. The upload continues
+// the stored session of key if that has the same target and content. It
+// returns the id of the uploaded file.
+func (d *Drive) upload(ctx context.Context, key string, src io.ReadSeeker, size int64, meta *drive.File, fileId string) (string, error) {
+	hash, err := hashContent(src)
+	if err != nil {
+		return "", err
+	}
+	var parentId string
+	if fileId == "" {
+		parentId = meta.Parents[0]
+	}
+
+	offset := int64(-1)
+	s, ok := d.uploads.get(key)
+	if ok && s.FileId == fileId && s.ParentId == parentId && s.Size == size && s.Hash == hash {
+		received, f, err := d.send(ctx, s.URI, src, 0, 0, size)
+		switch {
+		case errors.Is(errors.NotExist, err):
+			// the session expired, start over.
+		case err != nil:
+			return "", err
+		case f != nil:
+			d.uploads.delete(key)
+			return f.Id, nil
+		default:
+			offset = received
+		}
+	}
+	if offset < 0 {
+		uri, err := d.startSession(ctx, meta, fileId, size)
+		if err != nil {
+			return "", err
+		}
+		s = session{URI: uri, FileId: fileId, ParentId: parentId, Size: size, Hash: hash, Created: time.Now()}
+		d.uploads.set(key, s)
+		offset = 0
+	}
+
+	for {
+		n := size - offset
+		if n > chunkSize {
+			n = chunkSize
+		}
+		received, f, err := d.send(ctx, s.URI, src, offset, n, size)
+		if err != nil {
+			if errors.Is(errors.NotExist, err) {
+				// the next attempt starts a new session.
+				d.uploads.delete(key)
+				return "", errors.E(errors.IO, errors.Str("upload session expired"))
+			}
+			if !errors.Is(errors.IO, err) {
+				d.uploads.delete(key)
+			}
+			return "", err
+		}
+		if f != nil {
+			d.uploads.delete(key)
+			return f.Id, nil
+		}
+		offset = received
+	}
+}
+
+// startSession starts a resumable upload and returns the session URI.
+func (d *Drive) startSession(ctx context.Context, meta *drive.File, fileId string, size int64) (string, error) {
+	method, urls := http.MethodPost, googleapi.ResolveRelative(d.srv.BasePath, "/upload/drive/v3/files")
+	if fileId != "" {
+		method, urls = http.MethodPatch, urls+"/"+url.PathEscape(fileId)
+	}
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, urls+"?uploadType=resumable&fields=id", bytes.NewReader(body))
+	if err != nil {
+		return "", errors.E(errors.Invalid, err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", binaryMimeType)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", errors.E(errors.IO, err)
+	}
+	defer googleapi.CloseBody(resp)
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return "", apiError(err)
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return "", errors.E(errors.Invalid, err)
+	}
+	return loc.String(), nil
+}
+
+// send sends n bytes of src starting at offset to the session uri. With n = 0
+// it only asks for the state of the upload. It returns the number of bytes
+// Drive received and, once the upload is complete, the uploaded file. An
+// expired session results in an error of kind errors.NotExist.
+func (d *Drive) send(ctx context.Context, uri string, src io.ReadSeeker, offset, n, size int64) (int64, *drive.File, error) {
+	var body io.Reader = http.NoBody
+	contentRange := fmt.Sprintf("bytes */%d", size)
+	if n > 0 {
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return 0, nil, err
+		}
+		body = io.LimitReader(src, n)
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, uri, body)
+	if err != nil {
+		return 0, nil, errors.E(errors.Invalid, err)
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, nil, errors.E(errors.IO, err)
+	}
+	defer googleapi.CloseBody(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		f := new(drive.File)
+		if err := json.NewDecoder(resp.Body).Decode(f); err != nil {
+			return 0, nil, errors.E(errors.IO, err)
+		}
+		return size, f, nil
+	case http.StatusPermanentRedirect:
+		received, err := parseRange(resp.Header.Get("Range"))
+		if err != nil {
+			return 0, nil, err
+		}
+		return received, nil, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, nil, errors.E(errors.NotExist, errors.Str("upload session expired"))
+	}
+	return 0, nil, apiError(googleapi.CheckResponse(resp))
+}
+
+// parseRange returns the number of received bytes from the Range header of an
+// incomplete upload, e. g. "bytes=0-42". Without the header, nothing was
+// received.
+func parseRange(h string) (int64, error) {
+	if h == "" {
+		return 0, nil
+	}
+	last, err := strconv.ParseInt(strings.TrimPrefix(h, "bytes=0-"), 10, 64)
+	if err != nil || !strings.HasPrefix(h, "bytes=0-") {
+		return 0, errors.E(errors.Invalid, errors.Errorf("unexpected range %q", h))
+	}
+	return last + 1, nil
+}
+
+// hashContent returns the hex encoded SHA-256 of src.
+func hashContent(src io.ReadSeeker) (string, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return "", errors.E(errors.IO, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
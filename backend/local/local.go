@@ -0,0 +1,276 @@
+// Package local implements a backend.Service that stores the remote tree in a
+// directory, e. g. on a mounted network share or an external drive.
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+// Name is the value of config.Config.UseBackend that selects this backend.
+const Name = "local"
+
+var (
+	_ backend.Service         = (*Local)(nil)
+	_ backend.FileRangeReader = (*Local)(nil)
+)
+
+func init() {
+	backend.Register(backend.Backend{
+		Name: Name,
+		New: func(env config.Env) (backend.Service, error) {
+			return NewFromConfig(env.Fs)
+		},
+		Schema: []backend.Field{{
+			Name:        "Dirpath",
+			Description: "existing directory in which the remote folder is created",
+			Required:    true,
+		}},
+	})
+}
+
+// Config is stored with config.StoreBackendConfig.
+type Config struct {
+	// Dirpath is the directory in which the backend.RemoteFolderName folder
+	// is created.
+	Dirpath string `json:"Dirpath"`
+}
+
+// Local stores all files below root on fs.
+type Local struct {
+	fs   osx.Fs
+	root string
+}
+
+// New returns a Local backend that keeps the remote folder in dirpath. The
+// directory dirpath must exist.
+func New(fs osx.Fs, dirpath string) (*Local, error) {
+	const op = errors.Op("backend.local.New")
+	fi, err := fs.Stat(dirpath)
+	if err != nil {
+		return nil, errors.E(op, errors.Path(dirpath), kind(err), err)
+	}
+	if !fi.IsDir() {
+		return nil, errors.E(op, errors.Path(dirpath), errors.NotDir)
+	}
+	return &Local{
+		fs:   fs,
+		root: filepath.Join(dirpath, backend.RemoteFolderName),
+	}, nil
+}
+
+// NewFromConfig reads the backend configuration file and calls New.
+func NewFromConfig(fs osx.Fs) (*Local, error) {
+	const op = errors.Op("backend.local.NewFromConfig")
+	raw, err := config.LoadBackendConfig(Name)
+	if os.IsNotExist(err) {
+		return nil, errors.E(op, errors.NotExist, errors.Errorf(
+			"the %s backend is not configured, run init", Name))
+	}
+	if err != nil {
+		return nil, errors.E(op, kind(err), err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	if cfg.Dirpath == "" {
+		return nil, errors.E(op, errors.Invalid, "Dirpath is not set in the local backend configuration")
+	}
+	return New(fs, cfg.Dirpath)
+}
+
+// CreateFile claims h by creating an empty file exclusively, which is then
+// replaced by the content. Thus only one of concurrent calls succeeds.
+func (l *Local) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	const op = errors.Op("backend.local.CreateFile")
+	fp := l.abspath(h)
+	if _, err := l.fs.Stat(fp); err == nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+	}
+	tmp, err := l.writeTemp(h, src)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+	}
+	f, err := l.fs.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		err = f.Close()
+		if err == nil {
+			err = l.fs.Rename(tmp, fp)
+		}
+	}
+	if err != nil {
+		_ = l.fs.Remove(tmp)
+		return errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+	}
+	return nil
+}
+
+func (l *Local) UpdateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	const op = errors.Op("backend.local.UpdateFile")
+	if err := l.write(h, src); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+	}
+	return nil
+}
+
+func (l *Local) ReadFile(ctx context.Context, h backend.RemoteFile, dst io.Writer) error {
+	return l.readFile(errors.Op("backend.local.ReadFile"), h, 0, dst)
+}
+
+func (l *Local) ReadFileFrom(ctx context.Context, h backend.RemoteFile, off int64, dst io.Writer) error {
+	return l.readFile(errors.Op("backend.local.ReadFileFrom"), h, off, dst)
+}
+
+func (l *Local) readFile(op errors.Op, h backend.RemoteFile, off int64, dst io.Writer) error {
+	f, err := l.fs.Open(l.abspath(h))
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.IO, err)
+	}
+	if _, err := io.Copy(dst, f); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.IO, err)
+	}
+	return nil
+}
+
+func (l *Local) DeleteFile(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.local.DeleteFile")
+	if err := l.fs.Remove(l.abspath(h)); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+	}
+	return nil
+}
+
+func (l *Local) RenameFile(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.local.RenameFile")
+	if err := l.fs.Rename(l.abspath(old), l.abspath(new)); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), kind(err), err)
+	}
+	return nil
+}
+
+func (l *Local) CreateDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.local.CreateDir")
+	if err := l.fs.Mkdir(l.abspath(h), 0700); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+	}
+	return nil
+}
+
+func (l *Local) ReadDir(ctx context.Context, h backend.RemoteFile) (*vfs.File, error) {
+	const op = errors.Op("backend.local.ReadDir")
+	fp := l.abspath(h)
+	fi, err := l.fs.Stat(fp)
+	if err != nil {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+	}
+	entries, err := l.fs.ReadDir(fp)
+	if err != nil {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+	}
+	dir := &vfs.File{
+		Relpath:  h.HashRelpath,
+		MTime:    fi.ModTime().UnixNano(),
+		Mode:     fi.Mode(),
+		Size:     int64(len(entries)),
+		Children: make([]vfs.File, 0, len(entries)),
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+		}
+		dir.Children = append(dir.Children, vfs.File{
+			Relpath: path.Join(h.HashRelpath, e.Name()),
+			MTime:   info.ModTime().UnixNano(),
+			Mode:    info.Mode(),
+			Size:    info.Size(),
+		})
+	}
+	return dir, nil
+}
+
+func (l *Local) DeleteDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.local.DeleteDir")
+	fp := l.abspath(h)
+	if _, err := l.fs.Stat(fp); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+	}
+	if err := l.fs.RemoveAll(fp); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), kind(err), err)
+	}
+	return nil
+}
+
+func (l *Local) RenameDir(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.local.RenameDir")
+	if err := l.fs.Rename(l.abspath(old), l.abspath(new)); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), kind(err), err)
+	}
+	return nil
+}
+
+func (l *Local) AddContext(ctx context.Context) {}
+
+// write replaces the file h with the content of src. The content is written
+// to a temporary file first, so that readers never see a partial file.
+func (l *Local) write(h backend.RemoteFile, src io.Reader) error {
+	tmp, err := l.writeTemp(h, src)
+	if err != nil {
+		return err
+	}
+	if err := l.fs.Rename(tmp, l.abspath(h)); err != nil {
+		_ = l.fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes src to a new temporary file next to h and returns its path.
+func (l *Local) writeTemp(h backend.RemoteFile, src io.Reader) (string, error) {
+	tmp, err := l.fs.CreateTemp(filepath.Dir(l.abspath(h)), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, src)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = l.fs.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func (l *Local) abspath(h backend.RemoteFile) string {
+	return filepath.Join(l.root, filepath.FromSlash(h.HashRelpath))
+}
+
+// kind classifies filesystem errors. Unknown errors are considered IO errors,
+// since a network mount may recover from them.
+func kind(err error) errors.Kind {
+	switch {
+	case os.IsNotExist(err):
+		return errors.NotExist
+	case os.IsExist(err):
+		return errors.Exist
+	case os.IsPermission(err):
+		return errors.Permission
+	}
+	return errors.IO
+}
@@ -0,0 +1,164 @@
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/backend/local"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+func rf(relpath string) backend.RemoteFile {
+	return backend.RemoteFile{HashRelpath: relpath, HashName: relpath[strings.LastIndex(relpath, "/")+1:]}
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	if _, err := local.New(fs, "/mnt/missing"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist for missing dir, got %v", err)
+	}
+	if err := fs.MkdirAll("/mnt/nas", 0755); err != nil {
+		t.Fatal(err)
+	}
+	l, err := local.New(fs, "/mnt/nas")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.CreateDir(ctx, rf("/")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CreateDir(ctx, rf("/d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CreateDir(ctx, rf("/d")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if err := l.CreateFile(ctx, rf("/d/f"), strings.NewReader("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CreateFile(ctx, rf("/d/f"), strings.NewReader("two")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if err := l.UpdateFile(ctx, rf("/d/f"), strings.NewReader("two")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := l.ReadFile(ctx, rf("/d/f"), &buf); err != nil || buf.String() != "two" {
+		t.Errorf("want %q, got %q %v", "two", buf.String(), err)
+	}
+	buf.Reset()
+	if err := l.ReadFileFrom(ctx, rf("/d/f"), 1, &buf); err != nil || buf.String() != "wo" {
+		t.Errorf("want %q, got %q %v", "wo", buf.String(), err)
+	}
+	if err := l.RenameFile(ctx, rf("/d/f"), rf("/d/g")); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := l.ReadDir(ctx, rf("/d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.Children) != 1 || dir.Children[0].Relpath != "/d/g" || dir.Children[0].Size != 3 {
+		t.Errorf("unexpected dir %v", dir.Children)
+	}
+	if err := l.DeleteFile(ctx, rf("/d/g")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ReadFile(ctx, rf("/d/g"), &buf); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	if err := l.RenameDir(ctx, rf("/d"), rf("/e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.DeleteDir(ctx, rf("/e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.DeleteDir(ctx, rf("/e")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+}
+
+// TestRemote shares a file between two clients through the local backend.
+func TestRemote(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	for _, dp := range []string{"/mnt/nas", "/alice", "/bob"} {
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := []byte("shared via nfs")
+	if err := fs.WriteFile("/alice/a.txt", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := local.New(fs, "/mnt/nas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := stream.DeriveKeys(stream.HashKey("local test key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := remote.New(l, fs, "/alice", key)
+	bob := remote.New(l, fs, "/bob", key)
+
+	if err := alice.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	if err := alice.Upload(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Download(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile("/bob/a.txt")
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("want %q, got %q %v", content, got, err)
+	}
+	if sun, err := bob.LatestSun(ctx); err != nil || sun != 0 {
+		t.Errorf("want sun 0, got %d %v", sun, err)
+	}
+	if _, err := fs.Stat("/mnt/nas/" + backend.RemoteFolderName); os.IsNotExist(err) {
+		t.Error("remote folder not created in the backend directory")
+	}
+}
+
+// TestCreateExclusive checks that only one of concurrent creates succeeds.
+func TestCreateExclusive(t *testing.T) {
+	ctx := context.Background()
+	l, err := local.New(osx.NewOsFs(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CreateDir(ctx, rf("/")); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			errc <- l.CreateFile(ctx, rf("/lock"), strings.NewReader("holder"))
+		}()
+	}
+	var created int
+	for i := 0; i < 8; i++ {
+		switch err := <-errc; {
+		case err == nil:
+			created++
+		case !errors.Is(errors.Exist, err):
+			t.Errorf("want Exist, got %v", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("want one create to succeed, got %d", created)
+	}
+}
@@ -0,0 +1,380 @@
+// Package mock implements an in-memory backend.Service with fault injection
+// for tests. Tests that select backends by name call Register to make it
+// available as "mock"; the application does not include it.
+package mock
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+// Name is the value of config.Config.UseBackend that selects this backend.
+const Name = "mock"
+
+var _ backend.Service = (*Mock)(nil)
+
+var register sync.Once
+
+// Register makes the backend available under Name. It may be called more
+// than once.
+func Register() {
+	register.Do(func() {
+		backend.Register(backend.Backend{
+			Name: Name,
+			// a new Mock for every call, thus only useful within one process.
+			New: func(env config.Env) (backend.Service, error) {
+				return New(), nil
+			},
+		})
+	})
+}
+
+// Names of the operations, used as keys of Faults.FailureRate and for Fail.
+const (
+	OpCreateFile = "CreateFile"
+	OpReadFile   = "ReadFile"
+	OpUpdateFile = "UpdateFile"
+	OpDeleteFile = "DeleteFile"
+	OpRenameFile = "RenameFile"
+	OpCreateDir  = "CreateDir"
+	OpReadDir    = "ReadDir"
+	OpDeleteDir  = "DeleteDir"
+	OpRenameDir  = "RenameDir"
+)
+
+// Faults configures the injected faults. Injected failures are of kind
+// errors.IO, like a lost network connection.
+type Faults struct {
+	// Latency delays every operation.
+	Latency time.Duration
+	// FailureRate maps operation names to the probability in [0, 1] that
+	// the operation fails.
+	FailureRate map[string]float64
+	// PartialWrite is the probability in [0, 1] that a failing create or
+	// update leaves a truncated file behind.
+	PartialWrite float64
+}
+
+// Mock is a thread-safe in-memory backend. Paths are the HashRelpath of the
+// backend.RemoteFile, the root "/" always exists.
+type Mock struct {
+	mu     sync.Mutex
+	files  map[string]entry
+	dirs   map[string]time.Time
+	faults Faults
+	rand   *rand.Rand
+	fail   map[string]int
+	calls  map[string]int
+}
+
+type entry struct {
+	data  []byte
+	mtime time.Time
+}
+
+// New returns an empty Mock without faults.
+func New() *Mock {
+	return NewWithFaults(Faults{}, 1)
+}
+
+// NewWithFaults returns an empty Mock that injects faults. Random decisions
+// are made with seed, so that tests are reproducible.
+func NewWithFaults(f Faults, seed int64) *Mock {
+	return &Mock{
+		files:  make(map[string]entry),
+		dirs:   map[string]time.Time{"/": time.Now()},
+		faults: f,
+		rand:   rand.New(rand.NewSource(seed)),
+		fail:   make(map[string]int),
+		calls:  make(map[string]int),
+	}
+}
+
+// SetFaults replaces the injected faults.
+func (m *Mock) SetFaults(f Faults) {
+	m.mu.Lock()
+	m.faults = f
+	m.mu.Unlock()
+}
+
+// Fail lets the next n calls of op fail, independent of the failure rates.
+func (m *Mock) Fail(op string, n int) {
+	m.mu.Lock()
+	m.fail[op] += n
+	m.mu.Unlock()
+}
+
+// Calls returns how often op was called, including failed calls.
+func (m *Mock) Calls(op string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[op]
+}
+
+// Files returns a copy of the content of all files keyed by path.
+func (m *Mock) Files() map[string][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := make(map[string][]byte, len(m.files))
+	for p, e := range m.files {
+		files[p] = append([]byte(nil), e.data...)
+	}
+	return files
+}
+
+func (m *Mock) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	return m.write(ctx, OpCreateFile, h, src, false)
+}
+
+func (m *Mock) UpdateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	return m.write(ctx, OpUpdateFile, h, src, true)
+}
+
+func (m *Mock) ReadFile(ctx context.Context, h backend.RemoteFile, dst io.Writer) error {
+	const op = errors.Op("backend.mock.ReadFile")
+	data, err := func() ([]byte, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		e, ok := m.files[h.HashRelpath]
+		if !ok {
+			return nil, errors.E(errors.NotExist)
+		}
+		return e.data, nil
+	}()
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if err := m.inject(ctx, OpReadFile); err != nil {
+		// a broken connection delivers some of the content.
+		dst.Write(data[:len(data)/2])
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if _, err := dst.Write(data); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.IO, err)
+	}
+	return nil
+}
+
+func (m *Mock) DeleteFile(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.mock.DeleteFile")
+	if err := m.inject(ctx, OpDeleteFile); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[h.HashRelpath]; !ok {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.NotExist)
+	}
+	delete(m.files, h.HashRelpath)
+	return nil
+}
+
+func (m *Mock) RenameFile(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.mock.RenameFile")
+	if err := m.inject(ctx, OpRenameFile); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.files[old.HashRelpath]
+	if !ok {
+		return errors.E(op, errors.Path(old.HashRelpath), errors.NotExist)
+	}
+	if _, ok := m.dirs[path.Dir(new.HashRelpath)]; !ok {
+		return errors.E(op, errors.Path(new.HashRelpath), errors.NotExist)
+	}
+	delete(m.files, old.HashRelpath)
+	m.files[new.HashRelpath] = e
+	return nil
+}
+
+func (m *Mock) CreateDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.mock.CreateDir")
+	if err := m.inject(ctx, OpCreateDir); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkNew(h.HashRelpath); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	m.dirs[h.HashRelpath] = time.Now()
+	return nil
+}
+
+func (m *Mock) ReadDir(ctx context.Context, h backend.RemoteFile) (*vfs.File, error) {
+	const op = errors.Op("backend.mock.ReadDir")
+	if err := m.inject(ctx, OpReadDir); err != nil {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mtime, ok := m.dirs[h.HashRelpath]
+	if !ok {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), errors.NotExist)
+	}
+	dir := &vfs.File{
+		Relpath:  h.HashRelpath,
+		MTime:    mtime.UnixNano(),
+		Mode:     os.ModeDir | 0700,
+		Children: []vfs.File{},
+	}
+	for p, t := range m.dirs {
+		if p != "/" && path.Dir(p) == h.HashRelpath {
+			dir.Children = append(dir.Children, vfs.File{Relpath: p, MTime: t.UnixNano(), Mode: os.ModeDir | 0700})
+		}
+	}
+	for p, e := range m.files {
+		if path.Dir(p) == h.HashRelpath {
+			dir.Children = append(dir.Children, vfs.File{Relpath: p, MTime: e.mtime.UnixNano(), Mode: 0600, Size: int64(len(e.data))})
+		}
+	}
+	sort.Slice(dir.Children, func(i, j int) bool { return dir.Children[i].Relpath < dir.Children[j].Relpath })
+	dir.Size = int64(len(dir.Children))
+	return dir, nil
+}
+
+func (m *Mock) DeleteDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.mock.DeleteDir")
+	if err := m.inject(ctx, OpDeleteDir); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.dirs[h.HashRelpath]; !ok {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.NotExist)
+	}
+	for p := range m.dirs {
+		if within(h.HashRelpath, p) {
+			delete(m.dirs, p)
+		}
+	}
+	for p := range m.files {
+		if within(h.HashRelpath, p) {
+			delete(m.files, p)
+		}
+	}
+	if h.HashRelpath == "/" {
+		m.dirs["/"] = time.Now()
+	}
+	return nil
+}
+
+func (m *Mock) RenameDir(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.mock.RenameDir")
+	if err := m.inject(ctx, OpRenameDir); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.dirs[old.HashRelpath]; !ok || old.HashRelpath == "/" {
+		return errors.E(op, errors.Path(old.HashRelpath), errors.NotExist)
+	}
+	if err := m.checkNew(new.HashRelpath); err != nil {
+		return errors.E(op, errors.Path(new.HashRelpath), err)
+	}
+	move := func(p string) string { return new.HashRelpath + p[len(old.HashRelpath):] }
+	for p, t := range m.dirs {
+		if within(old.HashRelpath, p) {
+			delete(m.dirs, p)
+			m.dirs[move(p)] = t
+		}
+	}
+	for p, e := range m.files {
+		if within(old.HashRelpath, p) {
+			delete(m.files, p)
+			m.files[move(p)] = e
+		}
+	}
+	return nil
+}
+
+func (m *Mock) AddContext(ctx context.Context) {}
+
+func (m *Mock) write(ctx context.Context, opName string, h backend.RemoteFile, src io.Reader, replace bool) error {
+	op := errors.Op("backend.mock." + opName)
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.IO, err)
+	}
+	injected := m.inject(ctx, opName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[h.HashRelpath]; !ok && replace {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.NotExist)
+	}
+	if !replace {
+		if err := m.checkNew(h.HashRelpath); err != nil {
+			return errors.E(op, errors.Path(h.HashRelpath), err)
+		}
+	}
+	if injected != nil {
+		if len(data) > 0 && m.rand.Float64() < m.faults.PartialWrite {
+			n := m.rand.Intn(len(data))
+			m.files[h.HashRelpath] = entry{data: data[:n:n], mtime: time.Now()}
+		}
+		return errors.E(op, errors.Path(h.HashRelpath), injected)
+	}
+	m.files[h.HashRelpath] = entry{data: data, mtime: time.Now()}
+	return nil
+}
+
+// checkNew must be called with m.mu held.
+func (m *Mock) checkNew(p string) error {
+	if _, ok := m.dirs[path.Dir(p)]; !ok {
+		return errors.E(errors.NotExist, "parent directory does not exist")
+	}
+	_, isFile := m.files[p]
+	_, isDir := m.dirs[p]
+	if isFile || isDir {
+		return errors.E(errors.Exist)
+	}
+	return nil
+}
+
+// inject counts the call of op, waits for the latency and decides whether op
+// fails.
+func (m *Mock) inject(ctx context.Context, op string) error {
+	m.mu.Lock()
+	m.calls[op]++
+	latency := m.faults.Latency
+	fail := m.fail[op] > 0
+	if fail {
+		m.fail[op]--
+	} else if rate := m.faults.FailureRate[op]; rate > 0 {
+		fail = m.rand.Float64() < rate
+	}
+	m.mu.Unlock()
+
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	if fail {
+		return errors.E(errors.IO, "injected failure")
+	}
+	return nil
+}
+
+// within returns true if p is dir or lies within dir.
+func within(dir, p string) bool {
+	return dir == "/" || p == dir || strings.HasPrefix(p, dir+"/")
+}
@@ -0,0 +1,189 @@
+package mock_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/backend/mock"
+	"github.com/liamvdv/sharedHome/core"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/retry"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+func rf(relpath string) backend.RemoteFile {
+	return backend.RemoteFile{HashRelpath: relpath}
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	m := mock.NewWithFaults(mock.Faults{PartialWrite: 1}, 1)
+
+	m.Fail(mock.OpCreateFile, 1)
+	if err := m.CreateFile(ctx, rf("/a"), strings.NewReader("content")); !errors.Is(errors.IO, err) {
+		t.Errorf("want injected IO error, got %v", err)
+	}
+	if got := m.Files()["/a"]; len(got) >= len("content") {
+		t.Errorf("want partial write, got %q", got)
+	}
+	if err := m.UpdateFile(ctx, rf("/a"), strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := m.ReadFile(ctx, rf("/a"), &buf); err != nil || buf.String() != "content" {
+		t.Errorf("want %q, got %q %v", "content", buf.String(), err)
+	}
+	if err := m.CreateFile(ctx, rf("/missing/a"), strings.NewReader("")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist without parent, got %v", err)
+	}
+
+	m.SetFaults(mock.Faults{FailureRate: map[string]float64{mock.OpReadDir: 1}})
+	for i := 0; i < 3; i++ {
+		if _, err := m.ReadDir(ctx, rf("/")); !errors.Is(errors.IO, err) {
+			t.Errorf("want IO error at failure rate 1, got %v", err)
+		}
+	}
+	if n := m.Calls(mock.OpReadDir); n != 3 {
+		t.Errorf("want 3 calls, got %d", n)
+	}
+
+	m.SetFaults(mock.Faults{Latency: time.Hour})
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := m.DeleteFile(cctx, rf("/a")); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestDirs(t *testing.T) {
+	ctx := context.Background()
+	m := mock.New()
+	for _, dp := range []string{"/d", "/d/e"} {
+		if err := m.CreateDir(ctx, rf(dp)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.CreateFile(ctx, rf("/d/e/f"), strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RenameDir(ctx, rf("/d"), rf("/g")); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := m.ReadDir(ctx, rf("/g/e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.Children) != 1 || dir.Children[0].Relpath != "/g/e/f" {
+		t.Errorf("unexpected children %v", dir.Children)
+	}
+	if err := m.DeleteDir(ctx, rf("/g")); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files()) != 0 {
+		t.Errorf("files left after DeleteDir: %v", m.Files())
+	}
+}
+
+// TestSync runs the sync pipeline of core and remote against a failing
+// backend. The failed tasks must succeed on the next run and a second client
+// must receive all files.
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	for i := 0; i < 20; i++ {
+		dp := fmt.Sprintf("/alice/d%d", i%4)
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.WriteFile(fmt.Sprintf("%s/f%d", dp, i), []byte(fmt.Sprint("content ", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.MkdirAll("/bob", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := mock.NewWithFaults(mock.Faults{
+		FailureRate:  map[string]float64{mock.OpCreateFile: 0.3, mock.OpCreateDir: 0.2},
+		PartialWrite: 0.5,
+	}, 42)
+	key, err := stream.DeriveKeys(stream.HashKey("mock test key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := remote.New(m, fs, "/alice", key)
+	alice.SetRetryPolicy(retry.Policy{Attempts: 1})
+	empty := index(t, fs, "/bob")
+
+	remoteIdx, base, failed := sync(t, ctx, fs, "/alice", alice, empty, nil)
+	if failed == 0 {
+		t.Fatal("want some injected failures")
+	}
+	m.SetFaults(mock.Faults{})
+	remoteIdx, _, failed = sync(t, ctx, fs, "/alice", alice, remoteIdx, base)
+	if failed != 0 {
+		t.Fatalf("%d tasks failed without faults", failed)
+	}
+
+	bob := remote.New(m, fs, "/bob", key)
+	if _, _, failed := sync(t, ctx, fs, "/bob", bob, remoteIdx, nil); failed != 0 {
+		t.Fatalf("%d downloads failed", failed)
+	}
+	for i := 0; i < 20; i++ {
+		fp := fmt.Sprintf("/d%d/f%d", i%4, i)
+		got, err := fs.ReadFile("/bob" + fp)
+		if want := fmt.Sprint("content ", i); err != nil || string(got) != want {
+			t.Errorf("%s: want %q, got %q %v", fp, want, got, err)
+		}
+	}
+}
+
+// sync synchronises root with the remote and returns the new remote and base
+// index and the number of failed tasks.
+func sync(t *testing.T, ctx context.Context, fs osx.Fs, root string, r *remote.Remote, remoteIdx, base *vfs.FileIndex) (*vfs.FileIndex, *vfs.FileIndex, int) {
+	s := core.New(index(t, fs, root), remoteIdx, base)
+	tasks := make(chan core.Task)
+	go s.Compare(tasks)
+	x := core.Executor{NetworkWorkers: 4, DiskWorkers: 1, Handle: core.NewHandler(fs, root, r)}
+	var failed int
+	for res := range x.Run(ctx, tasks) {
+		if res.Err != nil {
+			failed++
+			continue
+		}
+		if err := s.Commit(res.Task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next, err := s.Remote()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextBase, err := s.Base()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return next, nextBase, failed
+}
+
+func index(t *testing.T, fs osx.Fs, root string) *vfs.FileIndex {
+	walk := vfs.NewFromWalk(fs, root, nil)
+	go func() {
+		for err := range walk.Errc {
+			t.Error(err)
+		}
+	}()
+	idx, err := walk.DoAndWait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
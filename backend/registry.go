@@ -0,0 +1,179 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+)
+
+/*
+	Backends register themselves in an init function of their package, so that
+	importing the package makes them available to config validation, init and
+	sync:
+
+	func init() {
+		backend.Register(backend.Backend{
+			Name:   Name,
+			New:    func(env config.Env) (backend.Service, error) { return NewFromConfig(env.Fs) },
+			Schema: []backend.Field{{Name: "Dirpath", Description: "...", Required: true}},
+		})
+	}
+*/
+
+// Field describes a value of the backend configuration file, which is a JSON
+// object stored with config.StoreBackendConfig.
+type Field struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// Backend describes a registered backend.
+type Backend struct {
+	// Name is the value of config.Config.UseBackend that selects the backend.
+	Name string
+	New  New
+	// Schema lists the fields of the backend configuration. It is nil if the
+	// backend needs no configuration.
+	Schema []Field
+	// Auth authorises the client interactively, e. g. with OAuth, and stores
+	// the credentials. It is nil if the backend needs no authorisation.
+	Auth func(env config.Env) error
+}
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]Backend)
+)
+
+// Register makes b available under b.Name. It panics if the name is taken.
+func Register(b Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := registry[b.Name]; ok {
+		panic(fmt.Sprintf("backend: %q registered twice", b.Name))
+	}
+	if b.New == nil {
+		panic(fmt.Sprintf("backend: %q registered without New", b.Name))
+	}
+	registry[b.Name] = b
+	config.RegisterBackend(b.Name)
+}
+
+// Lookup returns the backend registered as name.
+func Lookup(name string) (Backend, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	b, ok := registry[name]
+	if !ok {
+		return Backend{}, errors.E(errors.Invalid, errors.Errorf("backend %q is not available", name))
+	}
+	return b, nil
+}
+
+// Names returns the names of all registered backends in order.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open returns the Service of the backend registered as name.
+func Open(env config.Env, name string) (Service, error) {
+	const op = errors.Op("backend.Open")
+	b, err := Lookup(name)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	srv, err := b.New(env)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	return srv, nil
+}
+
+// Setup prepares the backend registered as name for its first use. Fields of
+// the schema are taken from values, else the existing configuration file or
+// else prompted for. Afterwards the authorisation flow is run.
+func Setup(env config.Env, name string, values map[string]string) error {
+	const op = errors.Op("backend.Setup")
+	b, err := Lookup(name)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if len(b.Schema) > 0 {
+		if err := configure(env, b, values); err != nil {
+			return errors.E(op, err)
+		}
+	}
+	if b.Auth != nil {
+		if err := b.Auth(env); err != nil {
+			return errors.E(op, err)
+		}
+	}
+	return nil
+}
+
+func configure(env config.Env, b Backend, values map[string]string) error {
+	cfg := make(map[string]string)
+	raw, err := config.LoadBackendConfig(b.Name)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return errors.E(errors.Invalid, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	for k, v := range values {
+		cfg[k] = v
+	}
+
+	in := bufio.NewReader(env.Stdin)
+	for _, f := range b.Schema {
+		if cfg[f.Name] != "" || !f.Required {
+			continue
+		}
+		fmt.Fprintf(env.Stdout, "%s (%s): ", f.Name, f.Description)
+		v, err := in.ReadString('\n')
+		if v = strings.TrimSpace(v); v == "" {
+			if err == nil {
+				err = errors.Errorf("%s is required", f.Name)
+			}
+			return errors.E(errors.Invalid, err)
+		}
+		cfg[f.Name] = v
+	}
+	for k := range cfg {
+		if !inSchema(b.Schema, k) {
+			return errors.E(errors.Invalid, errors.Errorf("backend %q has no option %q", b.Name, k))
+		}
+	}
+
+	raw, err = json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return config.StoreBackendConfig(b.Name, raw)
+}
+
+func inSchema(schema []Field, name string) bool {
+	for _, f := range schema {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package backend_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+)
+
+func TestRegistry(t *testing.T) {
+	fs := osx.NewMemMapFs()
+	config.InitVars(fs, "/config")
+
+	var authorised bool
+	backend.Register(backend.Backend{
+		Name: "fake",
+		New: func(env config.Env) (backend.Service, error) {
+			return nil, errors.E(errors.NotExist, "fake backend has no service")
+		},
+		Schema: []backend.Field{
+			{Name: "Host", Description: "server", Required: true},
+			{Name: "Port", Description: "server port"},
+		},
+		Auth: func(env config.Env) error {
+			authorised = true
+			return nil
+		},
+	})
+
+	found := false
+	for _, name := range config.SupportedBackends {
+		found = found || name == "fake"
+	}
+	if !found {
+		t.Errorf("fake not in config.SupportedBackends %v", config.SupportedBackends)
+	}
+	if names := backend.Names(); len(names) == 0 {
+		t.Error("no backend names")
+	}
+	if _, err := backend.Lookup("missing"); !errors.Is(errors.Invalid, err) {
+		t.Errorf("want Invalid for unknown backend, got %v", err)
+	}
+	if _, err := backend.Open(config.Env{Fs: fs}, "fake"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want error of New, got %v", err)
+	}
+
+	env := config.Env{Fs: fs, Stdin: strings.NewReader("example.com\n"), Stdout: &bytes.Buffer{}}
+	if err := backend.Setup(env, "fake", map[string]string{"Port": "22"}); err != nil {
+		t.Fatal(err)
+	}
+	if !authorised {
+		t.Error("auth flow not run")
+	}
+	raw, err := config.LoadBackendConfig("fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["Host"] != "example.com" || got["Port"] != "22" {
+		t.Errorf("unexpected backend config %v", got)
+	}
+	if err := backend.Setup(env, "fake", map[string]string{"User": "x"}); !errors.Is(errors.Invalid, err) {
+		t.Errorf("want Invalid for unknown option, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice must panic")
+		}
+	}()
+	backend.Register(backend.Backend{Name: "fake", New: func(config.Env) (backend.Service, error) { return nil, nil }})
+}
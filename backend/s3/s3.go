@@ -0,0 +1,486 @@
+// Package s3 implements a backend.Service for S3 compatible object storage,
+// e. g. AWS S3, MinIO or Backblaze B2.
+//
+// Every file is an object whose key is the HashRelpath below Prefix.
+// Directories are emulated with empty marker objects whose key ends with a
+// slash, since object storage has no directories. Renaming copies and
+// deletes all affected objects.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+// Name is the value of config.Config.UseBackend that selects this backend.
+const Name = "s3"
+
+var (
+	_ backend.Service         = (*S3)(nil)
+	_ backend.FileRangeReader = (*S3)(nil)
+)
+
+func init() {
+	backend.Register(backend.Backend{
+		Name: Name,
+		New: func(env config.Env) (backend.Service, error) {
+			return NewFromConfig()
+		},
+		Schema: []backend.Field{
+			{Name: "Endpoint", Description: "URL of the S3 API, e. g. https://s3.eu-central-1.amazonaws.com", Required: true},
+			{Name: "Region", Description: "region of the bucket, e. g. eu-central-1", Required: true},
+			{Name: "Bucket", Description: "name of an existing bucket", Required: true},
+			{Name: "AccessKeyID", Description: "access key id", Required: true},
+			{Name: "SecretAccessKey", Description: "secret access key", Required: true},
+			{Name: "Prefix", Description: "key prefix of all objects, defaults to " + backend.RemoteFolderName},
+		},
+	})
+}
+
+// Config is stored with config.StoreBackendConfig.
+type Config struct {
+	Endpoint        string `json:"Endpoint"`
+	Region          string `json:"Region"`
+	Bucket          string `json:"Bucket"`
+	AccessKeyID     string `json:"AccessKeyID"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Prefix          string `json:"Prefix"`
+}
+
+// S3 uses path-style requests, i. e. Endpoint/Bucket/Key, which all S3
+// compatible services support.
+type S3 struct {
+	cfg    Config
+	base   *url.URL
+	client *http.Client
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// New returns an S3 backend. If client is nil, http.DefaultClient is used.
+func New(cfg Config, client *http.Client) (*S3, error) {
+	const op = errors.Op("backend.s3.New")
+	if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.Region == "" {
+		return nil, errors.E(op, errors.Invalid, "Endpoint, Region and Bucket are required")
+	}
+	base, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = backend.RemoteFolderName
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3{cfg: cfg, base: base, client: client, now: time.Now}, nil
+}
+
+// NewFromConfig reads the backend configuration file and calls New.
+func NewFromConfig() (*S3, error) {
+	const op = errors.Op("backend.s3.NewFromConfig")
+	raw, err := config.LoadBackendConfig(Name)
+	if os.IsNotExist(err) {
+		return nil, errors.E(op, errors.NotExist, errors.Errorf("the %s backend is not configured, run init", Name))
+	}
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	return New(cfg, nil)
+}
+
+func (s *S3) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	const op = errors.Op("backend.s3.CreateFile")
+	if err := s.checkParent(ctx, h.HashRelpath); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	// servers that ignore If-None-Match still detect existing objects.
+	if err := s.head(ctx, s.key(h.HashRelpath)); err == nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+	} else if !errors.Is(errors.NotExist, err) {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	// the conditional write fails with 412 if the object was created
+	// meanwhile, thus only one of concurrent calls succeeds.
+	if err := s.put(ctx, s.key(h.HashRelpath), http.Header{"If-None-Match": {"*"}}, src); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	return nil
+}
+
+func (s *S3) UpdateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	const op = errors.Op("backend.s3.UpdateFile")
+	if err := s.put(ctx, s.key(h.HashRelpath), nil, src); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	return nil
+}
+
+func (s *S3) ReadFile(ctx context.Context, h backend.RemoteFile, dst io.Writer) error {
+	return s.readFile(ctx, errors.Op("backend.s3.ReadFile"), h, 0, dst)
+}
+
+func (s *S3) ReadFileFrom(ctx context.Context, h backend.RemoteFile, off int64, dst io.Writer) error {
+	return s.readFile(ctx, errors.Op("backend.s3.ReadFileFrom"), h, off, dst)
+}
+
+func (s *S3) readFile(ctx context.Context, op errors.Op, h backend.RemoteFile, off int64, dst io.Writer) error {
+	var header http.Header
+	if off > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", off)}}
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.key(h.HashRelpath), nil, header, nil)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	defer resp.Body.Close()
+	// a server that ignores the range sends the whole object.
+	if off > 0 && resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return errors.E(op, errors.Path(h.HashRelpath), errors.IO, err)
+		}
+	}
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.IO, err)
+	}
+	return nil
+}
+
+func (s *S3) DeleteFile(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.s3.DeleteFile")
+	// DELETE succeeds for missing objects, but we must report them.
+	if err := s.head(ctx, s.key(h.HashRelpath)); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if err := s.delete(ctx, s.key(h.HashRelpath)); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	return nil
+}
+
+func (s *S3) RenameFile(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.s3.RenameFile")
+	if err := s.move(ctx, s.key(old.HashRelpath), s.key(new.HashRelpath)); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	return nil
+}
+
+func (s *S3) CreateDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.s3.CreateDir")
+	if h.HashRelpath != "/" {
+		if err := s.checkParent(ctx, h.HashRelpath); err != nil {
+			return errors.E(op, errors.Path(h.HashRelpath), err)
+		}
+	}
+	marker := s.dirKey(h.HashRelpath)
+	if err := s.head(ctx, marker); err == nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+	} else if !errors.Is(errors.NotExist, err) {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if err := s.put(ctx, marker, nil, bytes.NewReader(nil)); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	return nil
+}
+
+func (s *S3) ReadDir(ctx context.Context, h backend.RemoteFile) (*vfs.File, error) {
+	const op = errors.Op("backend.s3.ReadDir")
+	marker := s.dirKey(h.HashRelpath)
+	if err := s.head(ctx, marker); err != nil {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	dir := &vfs.File{
+		Relpath:  h.HashRelpath,
+		Mode:     os.ModeDir | 0700,
+		Children: []vfs.File{},
+	}
+	err := s.list(ctx, marker, "/", func(obj object) {
+		name := strings.TrimSuffix(obj.Key[len(marker):], "/")
+		if name == "" {
+			return // the marker itself
+		}
+		child := vfs.File{Relpath: path.Join(h.HashRelpath, name), Mode: 0600, Size: obj.Size}
+		if t, err := time.Parse(time.RFC3339, obj.LastModified); err == nil {
+			child.MTime = t.UnixNano()
+		}
+		if strings.HasSuffix(obj.Key, "/") {
+			child.Mode = os.ModeDir | 0700
+		}
+		dir.Children = append(dir.Children, child)
+	})
+	if err != nil {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	dir.Size = int64(len(dir.Children))
+	return dir, nil
+}
+
+func (s *S3) DeleteDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.s3.DeleteDir")
+	marker := s.dirKey(h.HashRelpath)
+	if err := s.head(ctx, marker); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	keys, err := s.keys(ctx, marker)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	// delete the marker last, so that a failed attempt can be repeated.
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := s.delete(ctx, keys[i]); err != nil {
+			return errors.E(op, errors.Path(h.HashRelpath), err)
+		}
+	}
+	return nil
+}
+
+func (s *S3) RenameDir(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.s3.RenameDir")
+	oldMarker, newMarker := s.dirKey(old.HashRelpath), s.dirKey(new.HashRelpath)
+	if err := s.head(ctx, oldMarker); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	keys, err := s.keys(ctx, oldMarker)
+	if err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := s.move(ctx, keys[i], newMarker+keys[i][len(oldMarker):]); err != nil {
+			return errors.E(op, errors.Path(old.HashRelpath), err)
+		}
+	}
+	return nil
+}
+
+func (s *S3) AddContext(ctx context.Context) {}
+
+// key returns the object key of the file relpath.
+func (s *S3) key(relpath string) string {
+	return s.cfg.Prefix + relpath
+}
+
+// dirKey returns the key of the marker object of the directory relpath.
+func (s *S3) dirKey(relpath string) string {
+	return strings.TrimSuffix(s.key(relpath), "/") + "/"
+}
+
+func (s *S3) checkParent(ctx context.Context, relpath string) error {
+	if err := s.head(ctx, s.dirKey(path.Dir(relpath))); err != nil {
+		if errors.Is(errors.NotExist, err) {
+			return errors.E(errors.NotExist, "parent directory does not exist")
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *S3) head(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3) put(ctx context.Context, key string, header http.Header, src io.Reader) error {
+	resp, err := s.do(ctx, http.MethodPut, key, nil, header, src)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3) delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// move copies the object from to the key to and deletes from.
+func (s *S3) move(ctx context.Context, from, to string) error {
+	header := http.Header{"x-amz-copy-source": {"/" + s.cfg.Bucket + "/" + uriEncode(from, false)}}
+	resp, err := s.do(ctx, http.MethodPut, to, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	// CopyObject may fail after the status was sent, then the body has an error.
+	raw, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return errors.E(errors.IO, err)
+	}
+	if bytes.Contains(raw, []byte("<Error>")) {
+		return responseError(resp.StatusCode, raw)
+	}
+	return s.delete(ctx, from)
+}
+
+// keys returns all keys that start with prefix in lexical order.
+func (s *S3) keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.list(ctx, prefix, "", func(obj object) {
+		keys = append(keys, obj.Key)
+	})
+	return keys, err
+}
+
+type object struct {
+	Key          string
+	Size         int64
+	LastModified string
+}
+
+type listResult struct {
+	Contents              []object
+	CommonPrefixes        []struct{ Prefix string }
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list calls fn for every object with prefix. If delimiter is set, keys are
+// grouped up to the delimiter and reported with the delimiter as suffix.
+func (s *S3) list(ctx context.Context, prefix, delimiter string, fn func(object)) error {
+	var token string
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			q.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return err
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return errors.E(errors.IO, err)
+		}
+		for _, obj := range res.Contents {
+			fn(obj)
+		}
+		for _, p := range res.CommonPrefixes {
+			fn(object{Key: p.Prefix})
+		}
+		if !res.IsTruncated {
+			return nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// do sends a signed request for key. Responses with an error status are
+// closed and converted to an error.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	u := *s.base
+	u.Path = s.base.Path + "/" + s.cfg.Bucket + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	payloadHash := emptyPayload
+	var length int64
+	if body != nil {
+		// S3 needs the length, thus small or unknown bodies are buffered.
+		var err error
+		if body, length, err = sized(body); err != nil {
+			return nil, err
+		}
+		payloadHash = unsignedPayload
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, errors.E(errors.Invalid, err)
+	}
+	req.ContentLength = length
+	if length == 0 {
+		req.Body = http.NoBody
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	sign(req, payloadHash, s.cfg.AccessKeyID, s.cfg.SecretAccessKey, s.cfg.Region, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.E(errors.IO, err)
+	}
+	if resp.StatusCode >= 300 {
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, responseError(resp.StatusCode, raw)
+	}
+	return resp, nil
+}
+
+// sized returns a reader of body whose length is known.
+func sized(body io.Reader) (io.Reader, int64, error) {
+	if sk, ok := body.(io.Seeker); ok {
+		cur, err := sk.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err := sk.Seek(0, io.SeekEnd)
+			if err == nil {
+				if _, err := sk.Seek(cur, io.SeekStart); err == nil {
+					return io.NopCloser(body), end - cur, nil
+				}
+			}
+		}
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(raw), int64(len(raw)), nil
+}
+
+func responseError(status int, body []byte) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	_ = xml.Unmarshal(body, &e)
+	msg := fmt.Sprintf("%d %s: %s", status, e.Code, e.Message)
+	switch {
+	case status == http.StatusNotFound:
+		return errors.E(errors.NotExist, errors.Str(msg))
+	case status == http.StatusPreconditionFailed:
+		return errors.E(errors.Exist, errors.Str(msg))
+	case status == http.StatusConflict && e.Code == "ConditionalRequestConflict":
+		// a concurrent conditional write is in progress, the retry decides.
+		return errors.E(errors.IO, errors.Str(msg))
+	case status == http.StatusForbidden || status == http.StatusUnauthorized:
+		return errors.E(errors.Permission, errors.Str(msg))
+	case status == http.StatusTooManyRequests || status >= 500 || e.Code == "SlowDown" || e.Code == "InternalError":
+		return errors.E(errors.IO, errors.Str(msg))
+	}
+	return errors.E(errors.Invalid, errors.Str(msg))
+}
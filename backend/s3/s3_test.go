@@ -0,0 +1,346 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/backend/s3"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+const bucket = "home"
+
+// fakeS3 is a minimal S3 stand-in with a single bucket. It pages listings
+// after maxKeys entries to exercise continuation.
+type fakeS3 struct {
+	t       *testing.T
+	maxKeys int
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	// beforePut is called with the key of a PUT before it is applied.
+	beforePut func(key string)
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *s3.S3) {
+	f := &fakeS3{t: t, maxKeys: 2, objects: make(map[string][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	s, err := s3.New(s3.Config{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          bucket,
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+	}, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=id/") {
+		writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+bucket+"/") {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := r.URL.Path[len(bucket)+2:]
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r.URL.Query())
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if r.Method == http.MethodGet {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}
+	case r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") != "":
+		src, err := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		data, ok := f.objects[strings.TrimPrefix(src, "/"+bucket+"/")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.objects[key] = data
+		io.WriteString(w, "<CopyObjectResult></CopyObjectResult>")
+	case r.Method == http.MethodPut:
+		if r.ContentLength < 0 {
+			writeError(w, http.StatusLengthRequired, "MissingContentLength")
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		if f.beforePut != nil {
+			f.beforePut(key)
+		}
+		if _, ok := f.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		f.objects[key] = data
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	type prefixEntry struct{ Prefix string }
+	var res struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		CommonPrefixes        []prefixEntry
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	for k := range f.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				k = k[:len(prefix)+i+1]
+			}
+		}
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if after := q.Get("continuation-token"); after != "" {
+		i := sort.SearchStrings(keys, after)
+		keys = keys[i:]
+	}
+	if len(keys) > f.maxKeys {
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[f.maxKeys]
+		keys = keys[:f.maxKeys]
+	}
+	for _, k := range keys {
+		if data, ok := f.objects[k]; ok && (delimiter == "" || !strings.HasSuffix(k, delimiter) || k == prefix) {
+			res.Contents = append(res.Contents, content{k, len(data), time.Unix(0, 0).UTC().Format(time.RFC3339)})
+		} else {
+			res.CommonPrefixes = append(res.CommonPrefixes, prefixEntry{k})
+		}
+	}
+	xml.NewEncoder(w).Encode(res)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	io.WriteString(w, "<Error><Code>"+code+"</Code><Message>fake</Message></Error>")
+}
+
+func rf(relpath string) backend.RemoteFile {
+	return backend.RemoteFile{HashRelpath: relpath, HashName: relpath[strings.LastIndex(relpath, "/")+1:]}
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	f, s := newFakeS3(t)
+
+	if err := s.CreateFile(ctx, rf("/f"), strings.NewReader("x")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist without root, got %v", err)
+	}
+	if err := s.CreateDir(ctx, rf("/")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateDir(ctx, rf("/d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateDir(ctx, rf("/d")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	for _, name := range []string{"/d/f", "/d/a=b", "/d/c d"} {
+		if err := s.CreateFile(ctx, rf(name), strings.NewReader("one")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.CreateDir(ctx, rf("/d/sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateFile(ctx, rf("/d/f"), strings.NewReader("two")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if err := s.UpdateFile(ctx, rf("/d/f"), strings.NewReader("two")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.ReadFile(ctx, rf("/d/f"), &buf); err != nil || buf.String() != "two" {
+		t.Errorf("want %q, got %q %v", "two", buf.String(), err)
+	}
+	buf.Reset()
+	if err := s.ReadFileFrom(ctx, rf("/d/f"), 1, &buf); err != nil || buf.String() != "wo" {
+		t.Errorf("want %q, got %q %v", "wo", buf.String(), err)
+	}
+	if err := s.RenameFile(ctx, rf("/d/f"), rf("/d/g")); err != nil {
+		t.Fatal(err)
+	}
+
+	// four entries span two pages.
+	dir, err := s.ReadDir(ctx, rf("/d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range dir.Children {
+		got = append(got, c.Relpath+":"+c.Mode.String())
+	}
+	want := []string{"/d/a=b:-rw-------", "/d/c d:-rw-------", "/d/g:-rw-------", "/d/sub:drwx------"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if err := s.DeleteFile(ctx, rf("/d/g")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteFile(ctx, rf("/d/g")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	if err := s.ReadFile(ctx, rf("/d/g"), &buf); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	if err := s.RenameDir(ctx, rf("/d"), rf("/e")); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := s.ReadFile(ctx, rf("/e/a=b"), &buf); err != nil || buf.String() != "one" {
+		t.Errorf("want %q after rename, got %q %v", "one", buf.String(), err)
+	}
+	if _, err := s.ReadDir(ctx, rf("/d")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	if err := s.DeleteDir(ctx, rf("/e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteDir(ctx, rf("/e")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	for k := range f.objects {
+		if k != backend.RemoteFolderName+"/" {
+			t.Errorf("unexpected object %q left", k)
+		}
+	}
+}
+
+// TestCreateExclusive checks that an object created by another client after
+// the existence check is not replaced.
+func TestCreateExclusive(t *testing.T) {
+	ctx := context.Background()
+	f, s := newFakeS3(t)
+	if err := s.CreateDir(ctx, rf("/")); err != nil {
+		t.Fatal(err)
+	}
+	f.beforePut = func(key string) {
+		f.objects[key] = []byte("other")
+		f.beforePut = nil
+	}
+	if err := s.CreateFile(ctx, rf("/lock"), strings.NewReader("mine")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	var buf bytes.Buffer
+	if err := s.ReadFile(ctx, rf("/lock"), &buf); err != nil || buf.String() != "other" {
+		t.Errorf("want %q, got %q %v", "other", buf.String(), err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	_, s := newFakeS3(t)
+	bad, err := s3.New(s3.Config{Endpoint: "http://127.0.0.1:1", Region: "r", Bucket: bucket}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bad.CreateDir(ctx, rf("/")); !errors.Is(errors.IO, err) {
+		t.Errorf("want IO for unreachable endpoint, got %v", err)
+	}
+	if _, err := s3.New(s3.Config{Endpoint: "http://localhost"}, nil); !errors.Is(errors.Invalid, err) {
+		t.Errorf("want Invalid for missing bucket, got %v", err)
+	}
+	if _, err := s.ReadDir(ctx, rf("/")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+}
+
+// TestRemote shares a file between two clients through the fake S3.
+func TestRemote(t *testing.T) {
+	ctx := context.Background()
+	_, s := newFakeS3(t)
+	fs := osx.NewMemMapFs()
+	for _, dp := range []string{"/alice", "/bob"} {
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := []byte("shared via s3")
+	if err := fs.WriteFile("/alice/a.txt", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	key, err := stream.DeriveKeys(stream.HashKey("s3 test key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := remote.New(s, fs, "/alice", key)
+	bob := remote.New(s, fs, "/bob", key)
+
+	if err := alice.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	if err := alice.Upload(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Download(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile("/bob/a.txt")
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("want %q, got %q %v", content, got, err)
+	}
+	if sun, err := bob.LatestSun(ctx); err != nil || sun != 0 {
+		t.Errorf("want sun 0, got %d %v", sun, err)
+	}
+}
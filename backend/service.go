@@ -4,23 +4,25 @@ import (
 	"context"
 	"io"
 
+	"github.com/liamvdv/sharedHome/config"
 	"github.com/liamvdv/sharedHome/vfs"
 )
 
 /*
-	All backends are required to implement a package level function of type 
-	NewBackend and returning a struct adhereing to the service interface.
+	All backends are required to implement a struct adhereing to the service
+	interface and to register a function of type New, see registry.go.
 	The compiler can check that if you include the following expression globally.
 
 	T is your implementation of the Service interface. 
 
 	var (
 		_ backend.Service = (*T)(nil)
-		_ backend.New = New
 	)
 */
 
-type New func() (Service, error)
+// New opens a backend. It reads the backend configuration and credentials
+// that were stored during Setup.
+type New func(env config.Env) (Service, error)
 
 type RemoteFile struct {
 	// Relpath is the encrypted file path including the Name as the last element.
@@ -31,14 +33,27 @@ type RemoteFile struct {
 	Local *vfs.File 
 }
 
+// FileCreator creates h with the content of src. The create must be
+// exclusive: if h exists or another client creates it concurrently, at most
+// one create succeeds and the others return an error of kind errors.Exist.
+// Lock files rely on this.
 type FileCreator interface {
 	CreateFile(ctx context.Context, h RemoteFile, src io.Reader) error
 }
 
+// FileReader writes the content of h to dst. It must return an error of kind
+// errors.NotExist if h does not exist.
 type FileReader interface {
 	ReadFile(ctx context.Context, h RemoteFile, dst io.Writer) error
 }
 
+// FileRangeReader is implemented by services that can read a file from an
+// offset. It writes the content of h after the first off bytes to dst.
+// Interrupted downloads use it to resume after the data they already have.
+type FileRangeReader interface {
+	ReadFileFrom(ctx context.Context, h RemoteFile, off int64, dst io.Writer) error
+}
+
 type FileUpdater interface {
 	UpdateFile(ctx context.Context, h RemoteFile, src io.Reader) error
 }
@@ -55,6 +70,8 @@ type DirCreator interface {
 	CreateDir(ctx context.Context, h RemoteFile) error
 }
 
+// DirReader returns the directory h including its direct children. The last
+// element of each child's Relpath is the remote name of the child.
 type DirReader interface {
 	ReadDir(ctx context.Context, h RemoteFile) (*vfs.File, error)
 }
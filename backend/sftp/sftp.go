@@ -0,0 +1,497 @@
+// Package sftp implements a backend.Service that stores the remote tree on
+// any SSH host over SFTP. Clients authenticate with a private key that is
+// kept in config.BackendConfigFolder, see Auth.
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	errs "errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/vfs"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Name is the value of config.Config.UseBackend that selects this backend.
+const Name = "sftp"
+
+// DefaultKeyFile is the name of the private key in config.BackendConfigFolder.
+const DefaultKeyFile = "sftp-key.pem"
+
+var (
+	_ backend.Service         = (*SFTP)(nil)
+	_ backend.FileRangeReader = (*SFTP)(nil)
+)
+
+func init() {
+	backend.Register(backend.Backend{
+		Name: Name,
+		New: func(env config.Env) (backend.Service, error) {
+			return NewFromConfig(env.Fs)
+		},
+		Schema: []backend.Field{
+			{Name: "Host", Description: "host and optional port, e. g. nas.example.com:22", Required: true},
+			{Name: "User", Description: "user name on the host", Required: true},
+			{Name: "HostKey", Description: "public key of the host, e. g. a line of ssh-keyscan", Required: true},
+			{Name: "Dir", Description: "directory on the host in which the remote folder is created, defaults to the home directory"},
+			{Name: "KeyFile", Description: "private key, relative to the backend configuration folder, defaults to " + DefaultKeyFile},
+		},
+		Auth: Auth,
+	})
+}
+
+// Config is stored with config.StoreBackendConfig.
+type Config struct {
+	Host    string `json:"Host"`
+	User    string `json:"User"`
+	HostKey string `json:"HostKey"`
+	Dir     string `json:"Dir"`
+	KeyFile string `json:"KeyFile"`
+}
+
+// SFTP stores all files below root on the host. The connection is opened on
+// first use and reopened after it was lost.
+type SFTP struct {
+	addr   string
+	config *ssh.ClientConfig
+	root   string
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// New returns an SFTP backend for the host at addr that keeps the remote
+// folder in dir.
+func New(addr string, config *ssh.ClientConfig, dir string) *SFTP {
+	if dir == "" {
+		dir = "."
+	}
+	return &SFTP{
+		addr:   addr,
+		config: config,
+		root:   path.Join(dir, backend.RemoteFolderName),
+	}
+}
+
+// NewFromConfig reads the backend configuration file and the private key and
+// calls New.
+func NewFromConfig(fs osx.Fs) (*SFTP, error) {
+	const op = errors.Op("backend.sftp.NewFromConfig")
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	hostKey, err := parseHostKey(cfg.HostKey)
+	if err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	raw, err := fs.ReadFile(keyFile(cfg))
+	if os.IsNotExist(err) {
+		return nil, errors.E(op, errors.NotExist, errors.Errorf("private key %s does not exist, run init", keyFile(cfg)))
+	}
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	signer, err := ssh.ParsePrivateKey(raw)
+	if err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	addr := cfg.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	return New(addr, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         30 * time.Second,
+	}, cfg.Dir), nil
+}
+
+// Auth creates the private key if it does not exist yet and prints the public
+// key, which must be added to the authorized_keys of the user on the host.
+func Auth(env config.Env) error {
+	const op = errors.Op("backend.sftp.Auth")
+	cfg, err := loadConfig()
+	if err != nil {
+		return errors.E(op, err)
+	}
+	fp := keyFile(cfg)
+	raw, err := env.Fs.ReadFile(fp)
+	if os.IsNotExist(err) {
+		if raw, err = generateKey(); err == nil {
+			err = env.Fs.WriteFile(fp, raw, 0600)
+		}
+	}
+	if err != nil {
+		return errors.E(op, errors.Path(fp), err)
+	}
+	signer, err := ssh.ParsePrivateKey(raw)
+	if err != nil {
+		return errors.E(op, errors.Path(fp), errors.Invalid, err)
+	}
+	fmt.Fprintf(env.Stdout, "Add the following line to ~/.ssh/authorized_keys of %s on %s:\n%s",
+		cfg.User, cfg.Host, ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	return nil
+}
+
+func (s *SFTP) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	const op = errors.Op("backend.sftp.CreateFile")
+	c, err := s.connect(ctx)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	fp := s.abspath(h)
+	if _, err := c.Stat(fp); err == nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+	}
+	// the file is claimed by creating it exclusively and then replaced by the
+	// content, so that only one of concurrent calls succeeds. The empty claim
+	// is removed again if the content cannot replace it.
+	claim := func(tmp, fp string) error {
+		f, err := c.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			return err
+		}
+		err = f.Close()
+		if err == nil {
+			err = c.PosixRename(tmp, fp)
+		}
+		if err != nil {
+			_ = c.Remove(fp)
+		}
+		return err
+	}
+	if err := s.write(c, fp, src, claim); err != nil {
+		if _, sErr := c.Stat(fp); sErr == nil {
+			return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+		}
+		return errors.E(op, errors.Path(h.HashRelpath), s.fail(err), err)
+	}
+	return nil
+}
+
+func (s *SFTP) UpdateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	const op = errors.Op("backend.sftp.UpdateFile")
+	c, err := s.connect(ctx)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if err := s.write(c, s.abspath(h), src, c.PosixRename); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), s.fail(err), err)
+	}
+	return nil
+}
+
+func (s *SFTP) ReadFile(ctx context.Context, h backend.RemoteFile, dst io.Writer) error {
+	return s.readFile(ctx, errors.Op("backend.sftp.ReadFile"), h, 0, dst)
+}
+
+func (s *SFTP) ReadFileFrom(ctx context.Context, h backend.RemoteFile, off int64, dst io.Writer) error {
+	return s.readFile(ctx, errors.Op("backend.sftp.ReadFileFrom"), h, off, dst)
+}
+
+func (s *SFTP) readFile(ctx context.Context, op errors.Op, h backend.RemoteFile, off int64, dst io.Writer) error {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	f, err := c.Open(s.abspath(h))
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), s.fail(err), err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.IO, err)
+	}
+	if _, err := io.Copy(dst, f); err != nil {
+		s.fail(err)
+		return errors.E(op, errors.Path(h.HashRelpath), errors.IO, err)
+	}
+	return nil
+}
+
+func (s *SFTP) DeleteFile(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.sftp.DeleteFile")
+	c, err := s.connect(ctx)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	if err := c.Remove(s.abspath(h)); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), s.fail(err), err)
+	}
+	return nil
+}
+
+func (s *SFTP) RenameFile(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.sftp.RenameFile")
+	c, err := s.connect(ctx)
+	if err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	if err := c.PosixRename(s.abspath(old), s.abspath(new)); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), s.fail(err), err)
+	}
+	return nil
+}
+
+func (s *SFTP) CreateDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.sftp.CreateDir")
+	c, err := s.connect(ctx)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	fp := s.abspath(h)
+	if err := c.Mkdir(fp); err != nil {
+		// servers report an existing directory as a generic failure.
+		if _, sErr := c.Stat(fp); sErr == nil {
+			return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+		}
+		return errors.E(op, errors.Path(h.HashRelpath), s.fail(err), err)
+	}
+	return nil
+}
+
+func (s *SFTP) ReadDir(ctx context.Context, h backend.RemoteFile) (*vfs.File, error) {
+	const op = errors.Op("backend.sftp.ReadDir")
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	fp := s.abspath(h)
+	fi, err := c.Stat(fp)
+	if err != nil {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), s.fail(err), err)
+	}
+	if !fi.IsDir() {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), errors.NotDir)
+	}
+	entries, err := c.ReadDir(fp)
+	if err != nil {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), s.fail(err), err)
+	}
+	dir := &vfs.File{
+		Relpath:  h.HashRelpath,
+		MTime:    fi.ModTime().UnixNano(),
+		Mode:     fi.Mode(),
+		Size:     int64(len(entries)),
+		Children: make([]vfs.File, 0, len(entries)),
+	}
+	for _, e := range entries {
+		dir.Children = append(dir.Children, vfs.File{
+			Relpath: path.Join(h.HashRelpath, e.Name()),
+			MTime:   e.ModTime().UnixNano(),
+			Mode:    e.Mode(),
+			Size:    e.Size(),
+		})
+	}
+	return dir, nil
+}
+
+func (s *SFTP) DeleteDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.sftp.DeleteDir")
+	c, err := s.connect(ctx)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	fp := s.abspath(h)
+	if _, err := c.Stat(fp); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), s.fail(err), err)
+	}
+	if err := removeAll(ctx, c, fp); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), s.fail(err), err)
+	}
+	return nil
+}
+
+func (s *SFTP) RenameDir(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.sftp.RenameDir")
+	c, err := s.connect(ctx)
+	if err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	if err := c.Rename(s.abspath(old), s.abspath(new)); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), s.fail(err), err)
+	}
+	return nil
+}
+
+func (s *SFTP) AddContext(ctx context.Context) {}
+
+// Close closes the connection to the host, if any.
+func (s *SFTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	s.client.Close()
+	err := s.conn.Close()
+	s.conn, s.client = nil, nil
+	return err
+}
+
+// connect returns the client of the current connection or dials the host.
+func (s *SFTP) connect(ctx context.Context) (*sftp.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	conn, err := ssh.Dial("tcp", s.addr, s.config)
+	if err != nil {
+		return nil, errors.E(errors.IO, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.E(errors.IO, err)
+	}
+	s.conn, s.client = conn, client
+	return client, nil
+}
+
+// fail classifies err. Errors that are not reported by the server mean that
+// the connection broke, which is then closed so that the next call redials.
+func (s *SFTP) fail(err error) errors.Kind {
+	switch {
+	case os.IsNotExist(err):
+		return errors.NotExist
+	case os.IsExist(err):
+		return errors.Exist
+	case os.IsPermission(err):
+		return errors.Permission
+	}
+	var status *sftp.StatusError
+	if errs.As(err, &status) {
+		return errors.Other
+	}
+	s.Close()
+	return errors.IO
+}
+
+// write replaces the file fp with the content of src. The content is written
+// to a temporary file first, which is then moved into place with rename.
+func (s *SFTP) write(c *sftp.Client, fp string, src io.Reader, rename func(string, string) error) error {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(fp), ".tmp-"+hex.EncodeToString(suffix))
+	f, err := c.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = rename(tmp, fp)
+	}
+	if err != nil {
+		_ = c.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s *SFTP) abspath(h backend.RemoteFile) string {
+	return path.Join(s.root, h.HashRelpath)
+}
+
+func removeAll(ctx context.Context, c *sftp.Client, fp string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries, err := c.ReadDir(fp)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		child := path.Join(fp, e.Name())
+		if e.IsDir() {
+			err = removeAll(ctx, c, child)
+		} else {
+			err = c.Remove(child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.RemoveDirectory(fp)
+}
+
+func loadConfig() (Config, error) {
+	var cfg Config
+	raw, err := config.LoadBackendConfig(Name)
+	if os.IsNotExist(err) {
+		return cfg, errors.E(errors.NotExist, errors.Errorf("the %s backend is not configured, run init", Name))
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return cfg, errors.E(errors.Invalid, err)
+	}
+	if cfg.Host == "" || cfg.User == "" || cfg.HostKey == "" {
+		return cfg, errors.E(errors.Invalid, "Host, User and HostKey are required")
+	}
+	return cfg, nil
+}
+
+// keyFile returns the path of the private key.
+func keyFile(cfg Config) string {
+	fp := cfg.KeyFile
+	if fp == "" {
+		fp = DefaultKeyFile
+	}
+	if !filepath.IsAbs(fp) {
+		fp = filepath.Join(config.BackendConfigFolder, fp)
+	}
+	return fp
+}
+
+// parseHostKey accepts the authorized_keys and the known_hosts format.
+func parseHostKey(s string) (ssh.PublicKey, error) {
+	if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s)); err == nil {
+		return key, nil
+	}
+	_, _, key, _, _, err := ssh.ParseKnownHosts([]byte(s))
+	return key, err
+}
+
+// generateKey returns a new PEM encoded ed25519 private key.
+func generateKey() ([]byte, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
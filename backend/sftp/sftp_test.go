@@ -0,0 +1,396 @@
+package sftp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/backend/sftp"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// server is an in-process SSH server that only offers the sftp subsystem on
+// the real filesystem.
+type server struct {
+	addr    string
+	hostKey ssh.PublicKey
+
+	mu         sync.Mutex
+	authorized map[string]bool
+	conns      []net.Conn
+	// failRename makes posix-rename requests fail.
+	failRename bool
+}
+
+func newServer(t *testing.T) *server {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &server{addr: l.Addr().String(), hostKey: signer.PublicKey(), authorized: make(map[string]bool)}
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.authorized[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, errors.Str("unknown key")
+		},
+	}
+	cfg.AddHostKey(signer)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn, cfg)
+		}
+	}()
+	return s
+}
+
+func (s *server) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range chReqs {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						if srv, err := pkgsftp.NewServer(&renameBreaker{Channel: ch, s: s}); err == nil {
+							srv.Serve()
+						}
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// renameBreaker renames the posix-rename extension in the requests it reads
+// while failRename is set, so that the server rejects them as unsupported.
+type renameBreaker struct {
+	ssh.Channel
+	s *server
+}
+
+func (b *renameBreaker) Read(p []byte) (int, error) {
+	n, err := b.Channel.Read(p)
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+	if b.s.failRename {
+		copy(p[:n], bytes.ReplaceAll(p[:n], []byte("posix-rename@openssh.com"), []byte("xxxxx-rename@openssh.com")))
+	}
+	return n, err
+}
+
+func (s *server) authorize(key ssh.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorized[string(key.Marshal())] = true
+}
+
+// dropConns breaks all open connections.
+func (s *server) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func newClient(t *testing.T, s *server, dir string) *sftp.SFTP {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.authorize(signer.PublicKey())
+	c := sftp.New(s.addr, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.FixedHostKey(s.hostKey),
+	}, dir)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func rf(relpath string) backend.RemoteFile {
+	return backend.RemoteFile{HashRelpath: relpath, HashName: relpath[strings.LastIndex(relpath, "/")+1:]}
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	c := newClient(t, s, t.TempDir())
+
+	if err := c.CreateFile(ctx, rf("/f"), strings.NewReader("x")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist without root, got %v", err)
+	}
+	if err := c.CreateDir(ctx, rf("/")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDir(ctx, rf("/d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDir(ctx, rf("/d")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if err := c.CreateFile(ctx, rf("/d/f"), strings.NewReader("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateFile(ctx, rf("/d/f"), strings.NewReader("two")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if err := c.UpdateFile(ctx, rf("/d/f"), strings.NewReader("two")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := c.ReadFile(ctx, rf("/d/f"), &buf); err != nil || buf.String() != "two" {
+		t.Errorf("want %q, got %q %v", "two", buf.String(), err)
+	}
+	buf.Reset()
+	if err := c.ReadFileFrom(ctx, rf("/d/f"), 1, &buf); err != nil || buf.String() != "wo" {
+		t.Errorf("want %q, got %q %v", "wo", buf.String(), err)
+	}
+	if err := c.RenameFile(ctx, rf("/d/f"), rf("/d/g")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateDir(ctx, rf("/d/sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateFile(ctx, rf("/d/sub/h"), strings.NewReader("three")); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := c.ReadDir(ctx, rf("/d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.Children) != 2 || dir.Children[0].Relpath != "/d/g" || dir.Children[0].Size != 3 || !dir.Children[1].Mode.IsDir() {
+		t.Errorf("unexpected dir %v", dir.Children)
+	}
+	if _, err := c.ReadDir(ctx, rf("/d/g")); !errors.Is(errors.NotDir, err) {
+		t.Errorf("want NotDir, got %v", err)
+	}
+	if err := c.DeleteFile(ctx, rf("/d/g")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReadFile(ctx, rf("/d/g"), &buf); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	if err := c.RenameDir(ctx, rf("/d"), rf("/e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteDir(ctx, rf("/e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteDir(ctx, rf("/e")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	c := newClient(t, s, t.TempDir())
+	if err := c.CreateDir(ctx, rf("/")); err != nil {
+		t.Fatal(err)
+	}
+	s.dropConns()
+	if _, err := c.ReadDir(ctx, rf("/")); !errors.Is(errors.IO, err) {
+		t.Errorf("want IO for a broken connection, got %v", err)
+	}
+	if _, err := c.ReadDir(ctx, rf("/")); err != nil {
+		t.Errorf("want reconnect, got %v", err)
+	}
+
+	stranger := sftp.New(s.addr, &ssh.ClientConfig{
+		User:            "mallory",
+		HostKeyCallback: ssh.FixedHostKey(s.hostKey),
+	}, "")
+	if err := stranger.CreateDir(ctx, rf("/")); !errors.Is(errors.IO, err) {
+		t.Errorf("want IO for a rejected client, got %v", err)
+	}
+}
+
+// TestAuth generates the client key with Auth and shares a file between two
+// clients through the server.
+func TestAuth(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	fs := osx.NewMemMapFs()
+	config.InitVars(fs, "/config")
+	env := config.Env{Fs: fs, Stdin: strings.NewReader(""), Stdout: &bytes.Buffer{}}
+	if _, err := sftp.NewFromConfig(fs); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist without configuration, got %v", err)
+	}
+	dir := t.TempDir()
+	raw, err := json.Marshal(sftp.Config{
+		Host:    s.addr,
+		User:    "alice",
+		HostKey: string(ssh.MarshalAuthorizedKey(s.hostKey)),
+		Dir:     dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StoreBackendConfig(sftp.Name, raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sftp.NewFromConfig(fs); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist without key, got %v", err)
+	}
+	if err := sftp.Auth(env); err != nil {
+		t.Fatal(err)
+	}
+	out := env.Stdout.(*bytes.Buffer).String()
+	line := out[strings.Index(out, "\n")+1:]
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		t.Fatalf("no public key in %q: %v", out, err)
+	}
+	if _, err := fs.Stat(filepath.Join(config.BackendConfigFolder, sftp.DefaultKeyFile)); err != nil {
+		t.Fatal(err)
+	}
+	s.authorize(pub)
+
+	content := []byte("shared via sftp")
+	for _, dp := range []string{"/alice", "/bob"} {
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.WriteFile("/alice/a.txt", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	key, err := stream.DeriveKeys(stream.HashKey("sftp test key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients []*remote.Remote
+	for _, root := range []string{"/alice", "/bob"} {
+		srv, err := backend.Open(env, sftp.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, remote.New(srv, fs, root, key))
+	}
+	alice, bob := clients[0], clients[1]
+	if err := alice.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	if err := alice.Upload(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Download(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile("/bob/a.txt")
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("want %q, got %q %v", content, got, err)
+	}
+}
+
+// TestCreateExclusive checks that only one of concurrent creates succeeds.
+func TestCreateExclusive(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	dir := t.TempDir()
+	if err := newClient(t, s, dir).CreateDir(ctx, rf("/")); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error)
+	for i := 0; i < 4; i++ {
+		c := newClient(t, s, dir)
+		go func() {
+			errc <- c.CreateFile(ctx, rf("/lock"), strings.NewReader("holder"))
+		}()
+	}
+	var created int
+	for i := 0; i < 4; i++ {
+		switch err := <-errc; {
+		case err == nil:
+			created++
+		case !errors.Is(errors.Exist, err):
+			t.Errorf("want Exist, got %v", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("want one create to succeed, got %d", created)
+	}
+}
+
+// TestCreateFailedRename checks that a create whose rename fails leaves
+// neither the file nor its temporary file behind.
+func TestCreateFailedRename(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	dir := t.TempDir()
+	c := newClient(t, s, dir)
+	if err := c.CreateDir(ctx, rf("/")); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.failRename = true
+	s.mu.Unlock()
+	if err := c.CreateFile(ctx, rf("/lock"), strings.NewReader("holder")); err == nil || errors.Is(errors.Exist, err) {
+		t.Errorf("want the rename error, got %v", err)
+	}
+	if d, err := c.ReadDir(ctx, rf("/")); err != nil || len(d.Children) != 0 {
+		t.Errorf("want no files left, got %v %v", d, err)
+	}
+	s.mu.Lock()
+	s.failRename = false
+	s.mu.Unlock()
+	if err := c.CreateFile(ctx, rf("/lock"), strings.NewReader("holder")); err != nil {
+		t.Errorf("create after the failure: %v", err)
+	}
+}
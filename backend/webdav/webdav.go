@@ -0,0 +1,384 @@
+// Package webdav implements a backend.Service for WebDAV servers, e. g.
+// Nextcloud or ownCloud.
+//
+// The hashed paths map directly to collection paths below the
+// backend.RemoteFolderName collection on the server.
+package webdav
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+// Name is the value of config.Config.UseBackend that selects this backend.
+const Name = "webdav"
+
+var (
+	_ backend.Service         = (*WebDAV)(nil)
+	_ backend.FileRangeReader = (*WebDAV)(nil)
+)
+
+func init() {
+	backend.Register(backend.Backend{
+		Name: Name,
+		New: func(env config.Env) (backend.Service, error) {
+			return NewFromConfig()
+		},
+		Schema: []backend.Field{
+			{Name: "URL", Description: "WebDAV URL, e. g. https://cloud.example.com/remote.php/dav/files/<user>", Required: true},
+			{Name: "Username", Description: "user name"},
+			{Name: "Password", Description: "password, preferably an app password"},
+		},
+	})
+}
+
+// Config is stored with config.StoreBackendConfig.
+type Config struct {
+	URL      string `json:"URL"`
+	Username string `json:"Username"`
+	Password string `json:"Password"`
+}
+
+// WebDAV stores all files below the collection root.
+type WebDAV struct {
+	cfg    Config
+	root   *url.URL
+	client *http.Client
+}
+
+// New returns a WebDAV backend. If client is nil, http.DefaultClient is used.
+func New(cfg Config, client *http.Client) (*WebDAV, error) {
+	const op = errors.Op("backend.webdav.New")
+	if cfg.URL == "" {
+		return nil, errors.E(op, errors.Invalid, "URL is required")
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("URL %q must be http or https", cfg.URL))
+	}
+	u.Path = path.Join("/", u.Path, backend.RemoteFolderName)
+	u.RawPath = ""
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &WebDAV{cfg: cfg, root: u, client: client}, nil
+}
+
+// NewFromConfig reads the backend configuration file and calls New.
+func NewFromConfig() (*WebDAV, error) {
+	const op = errors.Op("backend.webdav.NewFromConfig")
+	raw, err := config.LoadBackendConfig(Name)
+	if os.IsNotExist(err) {
+		return nil, errors.E(op, errors.NotExist, errors.Errorf("the %s backend is not configured, run init", Name))
+	}
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	return New(cfg, nil)
+}
+
+// CreateFile creates h with If-None-Match: *, which the server must answer
+// with 412 Precondition Failed if h exists. Servers that ignore the header,
+// e. g. golang.org/x/net/webdav, would replace h, so h is looked up first.
+// On such servers, concurrent creates of h may still both succeed.
+func (w *WebDAV) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	const op = errors.Op("backend.webdav.CreateFile")
+	if _, err := w.propfind(ctx, h.HashRelpath, "0"); err == nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.Exist)
+	} else if !errors.Is(errors.NotExist, err) {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	header := http.Header{"If-None-Match": {"*"}}
+	if err := w.send(ctx, http.MethodPut, w.url(h.HashRelpath, false), header, src); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	return nil
+}
+
+func (w *WebDAV) UpdateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	const op = errors.Op("backend.webdav.UpdateFile")
+	if err := w.send(ctx, http.MethodPut, w.url(h.HashRelpath, false), nil, src); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	return nil
+}
+
+func (w *WebDAV) ReadFile(ctx context.Context, h backend.RemoteFile, dst io.Writer) error {
+	return w.readFile(ctx, errors.Op("backend.webdav.ReadFile"), h, 0, dst)
+}
+
+func (w *WebDAV) ReadFileFrom(ctx context.Context, h backend.RemoteFile, off int64, dst io.Writer) error {
+	return w.readFile(ctx, errors.Op("backend.webdav.ReadFileFrom"), h, off, dst)
+}
+
+func (w *WebDAV) readFile(ctx context.Context, op errors.Op, h backend.RemoteFile, off int64, dst io.Writer) error {
+	var header http.Header
+	if off > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", off)}}
+	}
+	resp, err := w.do(ctx, http.MethodGet, w.url(h.HashRelpath, false), header, nil)
+	if err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	defer resp.Body.Close()
+	// a server that ignores the range sends the whole file.
+	if off > 0 && resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return errors.E(op, errors.Path(h.HashRelpath), errors.IO, err)
+		}
+	}
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), errors.IO, err)
+	}
+	return nil
+}
+
+func (w *WebDAV) DeleteFile(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.webdav.DeleteFile")
+	if err := w.send(ctx, "DELETE", w.url(h.HashRelpath, false), nil, nil); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	return nil
+}
+
+func (w *WebDAV) RenameFile(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.webdav.RenameFile")
+	if err := w.move(ctx, old.HashRelpath, new.HashRelpath, false); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	return nil
+}
+
+func (w *WebDAV) CreateDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.webdav.CreateDir")
+	if err := w.send(ctx, "MKCOL", w.url(h.HashRelpath, true), nil, nil); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	return nil
+}
+
+func (w *WebDAV) ReadDir(ctx context.Context, h backend.RemoteFile) (*vfs.File, error) {
+	const op = errors.Op("backend.webdav.ReadDir")
+	entries, err := w.propfind(ctx, h.HashRelpath, "1")
+	if err != nil {
+		return nil, errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	self := path.Join(w.root.Path, h.HashRelpath)
+	dir := &vfs.File{Relpath: h.HashRelpath, Children: []vfs.File{}}
+	for _, e := range entries {
+		p, err := url.PathUnescape(hrefPath(e.Href))
+		if err != nil {
+			return nil, errors.E(op, errors.Path(h.HashRelpath), errors.Invalid, err)
+		}
+		f := e.file()
+		if path.Clean(p) == self {
+			if !f.Mode.IsDir() {
+				return nil, errors.E(op, errors.Path(h.HashRelpath), errors.NotDir)
+			}
+			dir.MTime, dir.Mode = f.MTime, f.Mode
+			continue
+		}
+		f.Relpath = path.Join(h.HashRelpath, path.Base(p))
+		dir.Children = append(dir.Children, f)
+	}
+	dir.Size = int64(len(dir.Children))
+	return dir, nil
+}
+
+func (w *WebDAV) DeleteDir(ctx context.Context, h backend.RemoteFile) error {
+	const op = errors.Op("backend.webdav.DeleteDir")
+	// DELETE of a collection removes its members as well.
+	if err := w.send(ctx, "DELETE", w.url(h.HashRelpath, true), nil, nil); err != nil {
+		return errors.E(op, errors.Path(h.HashRelpath), err)
+	}
+	return nil
+}
+
+func (w *WebDAV) RenameDir(ctx context.Context, old, new backend.RemoteFile) error {
+	const op = errors.Op("backend.webdav.RenameDir")
+	if err := w.move(ctx, old.HashRelpath, new.HashRelpath, true); err != nil {
+		return errors.E(op, errors.Path(old.HashRelpath), err)
+	}
+	return nil
+}
+
+func (w *WebDAV) AddContext(ctx context.Context) {}
+
+// url returns the URL of relpath. Collections get a trailing slash, which
+// some servers require.
+func (w *WebDAV) url(relpath string, collection bool) string {
+	u := *w.root
+	u.Path = path.Join(w.root.Path, relpath)
+	if collection {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+// move renames the resource old to new. Files replace an existing new,
+// collections do not.
+func (w *WebDAV) move(ctx context.Context, old, new string, collection bool) error {
+	overwrite := "T"
+	if collection {
+		overwrite = "F"
+	}
+	header := http.Header{
+		"Destination": {w.url(new, collection)},
+		"Overwrite":   {overwrite},
+	}
+	return w.send(ctx, "MOVE", w.url(old, collection), header, nil)
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop>
+<D:resourcetype/><D:getcontentlength/><D:getlastmodified/>
+</D:prop></D:propfind>`
+
+type response struct {
+	Href     string `xml:"DAV: href"`
+	Propstat []struct {
+		Status string `xml:"DAV: status"`
+		Prop   struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"DAV: collection"`
+			} `xml:"DAV: resourcetype"`
+			ContentLength string `xml:"DAV: getcontentlength"`
+			LastModified  string `xml:"DAV: getlastmodified"`
+		} `xml:"DAV: prop"`
+	} `xml:"DAV: propstat"`
+}
+
+// file converts the successful properties of r.
+func (r *response) file() vfs.File {
+	f := vfs.File{Mode: 0600}
+	for _, ps := range r.Propstat {
+		if !strings.Contains(ps.Status, " 200 ") {
+			continue
+		}
+		if ps.Prop.ResourceType.Collection != nil {
+			f.Mode = os.ModeDir | 0700
+		}
+		if n, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64); err == nil {
+			f.Size = n
+		}
+		if t, err := http.ParseTime(ps.Prop.LastModified); err == nil {
+			f.MTime = t.UnixNano()
+		}
+	}
+	return f
+}
+
+// propfind returns the properties of relpath and, with depth "1", of its
+// members.
+func (w *WebDAV) propfind(ctx context.Context, relpath, depth string) ([]response, error) {
+	header := http.Header{
+		"Depth":        {depth},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, err := w.do(ctx, "PROPFIND", w.url(relpath, false), header, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var ms struct {
+		Responses []response `xml:"DAV: response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, errors.E(errors.IO, err)
+	}
+	return ms.Responses, nil
+}
+
+// hrefPath returns the path of href, which may be an absolute URL.
+func hrefPath(href string) string {
+	if u, err := url.Parse(href); err == nil && u.Scheme != "" {
+		return u.EscapedPath()
+	}
+	return href
+}
+
+func (w *WebDAV) send(ctx context.Context, method, u string, header http.Header, body io.Reader) error {
+	resp, err := w.do(ctx, method, u, header, body)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// do sends an authenticated request. Responses with an error status are
+// closed and converted to an error.
+func (w *WebDAV) do(ctx context.Context, method, u string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, errors.E(errors.Invalid, err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if w.cfg.Username != "" || w.cfg.Password != "" {
+		req.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.E(errors.IO, err)
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, statusError(method, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// statusError classifies the status code of a failed request. RFC 4918
+// requires 409 Conflict for MKCOL and PUT if the parent collection is missing
+// and 405 Method Not Allowed for MKCOL on an existing resource. Other methods
+// use 409 for conflicts that are not about existence.
+func statusError(method string, status int) error {
+	msg := errors.Str(fmt.Sprintf("%s: %d %s", method, status, http.StatusText(status)))
+	switch {
+	case method == "MKCOL" && status == http.StatusMethodNotAllowed:
+		return errors.E(errors.Exist, msg)
+	case (method == "MKCOL" || method == http.MethodPut) && status == http.StatusConflict:
+		return errors.E(errors.NotExist, errors.Errorf("parent collection does not exist: %s", msg))
+	}
+	switch status {
+	case http.StatusNotFound:
+		return errors.E(errors.NotExist, msg)
+	case http.StatusPreconditionFailed:
+		return errors.E(errors.Exist, msg)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errors.E(errors.Permission, msg)
+	case http.StatusTooManyRequests, http.StatusRequestTimeout, 423, 507:
+		// 423 Locked and 507 Insufficient Storage may resolve later.
+		return errors.E(errors.IO, msg)
+	}
+	if status >= 500 {
+		return errors.E(errors.IO, msg)
+	}
+	return errors.E(errors.Invalid, msg)
+}
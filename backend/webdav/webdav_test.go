@@ -0,0 +1,215 @@
+package webdav_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/backend/webdav"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
+	xwebdav "golang.org/x/net/webdav"
+)
+
+// newServer serves an in-memory WebDAV tree below /dav that requires the
+// credentials alice:secret.
+func newServer(t *testing.T) *httptest.Server {
+	h := &xwebdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: xwebdav.NewMemFS(),
+		LockSystem: xwebdav.NewMemLS(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newWebDAV(t *testing.T, srv *httptest.Server, password string) *webdav.WebDAV {
+	w, err := webdav.New(webdav.Config{URL: srv.URL + "/dav", Username: "alice", Password: password}, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func rf(relpath string) backend.RemoteFile {
+	return backend.RemoteFile{HashRelpath: relpath, HashName: relpath[strings.LastIndex(relpath, "/")+1:]}
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	w := newWebDAV(t, newServer(t), "secret")
+
+	if err := w.CreateFile(ctx, rf("/f"), strings.NewReader("x")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist without root, got %v", err)
+	}
+	if err := w.CreateDir(ctx, rf("/")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CreateDir(ctx, rf("/d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CreateDir(ctx, rf("/d")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	for _, name := range []string{"/d/f", "/d/a=b", "/d/c d"} {
+		if err := w.CreateFile(ctx, rf(name), strings.NewReader("one")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.CreateDir(ctx, rf("/d/sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CreateFile(ctx, rf("/d/f"), strings.NewReader("two")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if err := w.UpdateFile(ctx, rf("/d/f"), strings.NewReader("two")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := w.ReadFile(ctx, rf("/d/f"), &buf); err != nil || buf.String() != "two" {
+		t.Errorf("want %q, got %q %v", "two", buf.String(), err)
+	}
+	buf.Reset()
+	if err := w.ReadFileFrom(ctx, rf("/d/f"), 1, &buf); err != nil || buf.String() != "wo" {
+		t.Errorf("want %q, got %q %v", "wo", buf.String(), err)
+	}
+	if err := w.RenameFile(ctx, rf("/d/f"), rf("/d/g")); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := w.ReadDir(ctx, rf("/d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, c := range dir.Children {
+		got[c.Relpath] = c.Mode.String()
+	}
+	want := map[string]string{"/d/a=b": "-rw-------", "/d/c d": "-rw-------", "/d/g": "-rw-------", "/d/sub": "drwx------"}
+	if len(got) != len(want) || dir.Size != int64(len(want)) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: want %s, got %q", k, v, got[k])
+		}
+	}
+	if _, err := w.ReadDir(ctx, rf("/d/g")); !errors.Is(errors.NotDir, err) {
+		t.Errorf("want NotDir, got %v", err)
+	}
+
+	if err := w.DeleteFile(ctx, rf("/d/g")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.DeleteFile(ctx, rf("/d/g")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	if err := w.ReadFile(ctx, rf("/d/g"), &buf); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	if err := w.RenameDir(ctx, rf("/d"), rf("/e")); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := w.ReadFile(ctx, rf("/e/a=b"), &buf); err != nil || buf.String() != "one" {
+		t.Errorf("want %q after rename, got %q %v", "one", buf.String(), err)
+	}
+	if _, err := w.ReadDir(ctx, rf("/d")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	if err := w.DeleteDir(ctx, rf("/e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.DeleteDir(ctx, rf("/e")); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+}
+
+// TestCreateExclusive checks that a create does not replace an existing file,
+// although the x/net handler ignores If-None-Match.
+func TestCreateExclusive(t *testing.T) {
+	ctx := context.Background()
+	w := newWebDAV(t, newServer(t), "secret")
+	if err := w.CreateDir(ctx, rf("/")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CreateFile(ctx, rf("/lock-0.bin"), strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CreateFile(ctx, rf("/lock-0.bin"), strings.NewReader("second")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	var buf bytes.Buffer
+	if err := w.ReadFile(ctx, rf("/lock-0.bin"), &buf); err != nil || buf.String() != "first" {
+		t.Errorf("want %q, got %q %v", "first", buf.String(), err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t)
+	if err := newWebDAV(t, srv, "wrong").CreateDir(ctx, rf("/")); !errors.Is(errors.Permission, err) {
+		t.Errorf("want Permission for wrong password, got %v", err)
+	}
+	if _, err := webdav.New(webdav.Config{URL: "ftp://example.com"}, nil); !errors.Is(errors.Invalid, err) {
+		t.Errorf("want Invalid for ftp URL, got %v", err)
+	}
+	srv.Close()
+	if err := newWebDAV(t, srv, "secret").CreateDir(ctx, rf("/")); !errors.Is(errors.IO, err) {
+		t.Errorf("want IO for closed server, got %v", err)
+	}
+}
+
+// TestRemote shares a file between two clients through the WebDAV server.
+func TestRemote(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t)
+	fs := osx.NewMemMapFs()
+	for _, dp := range []string{"/alice", "/bob"} {
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := []byte("shared via webdav")
+	if err := fs.WriteFile("/alice/a.txt", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	key, err := stream.DeriveKeys(stream.HashKey("webdav test key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := remote.New(newWebDAV(t, srv, "secret"), fs, "/alice", key)
+	bob := remote.New(newWebDAV(t, srv, "secret"), fs, "/bob", key)
+
+	if err := alice.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	if err := alice.Upload(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Download(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile("/bob/a.txt")
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("want %q, got %q %v", content, got, err)
+	}
+	if sun, err := bob.LatestSun(ctx); err != nil || sun != 0 {
+		t.Errorf("want sun 0, got %d %v", sun, err)
+	}
+}
@@ -1,8 +1,10 @@
 package config
 
 import (
-	"path/filepath"
+	"fmt"
 	"os"
+	"path/filepath"
+
 	"github.com/liamvdv/sharedHome/osx"
 )
 
@@ -19,17 +21,17 @@ var (
 type loadFunc func(string) ([]byte, error)
 type storeFunc func(string, []byte) error
 
-// we need this setup to inject a fs.
+// we need this setup to inject a fs. It is called by InitVars.
 func initBackendFuncs(fs osx.Fs) {
 	mkLoadFunc := func(template string) loadFunc {
 		return func(backend string) ([]byte, error) {
-			fp := filepath.Join(template, backend)
+			fp := filepath.Join(BackendConfigFolder, fmt.Sprintf(template, backend))
 			return fs.ReadFile(fp)
 		}
 	}
 	mkStoreFunc := func(template string, perm os.FileMode) storeFunc {
 		return func(backend string, raw []byte) error {
-			fp := filepath.Join(template, backend)
+			fp := filepath.Join(BackendConfigFolder, fmt.Sprintf(template, backend))
 			return fs.WriteFile(fp, raw, perm)
 		}
 	}
@@ -3,7 +3,6 @@ package config
 import (
 	_ "embed"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -11,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 
 	"github.com/liamvdv/sharedHome/errors"
@@ -19,11 +19,6 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-// TESTING checks whether the code is run in a test.
-// It cannot detect manual tests with executables.
-// TODO(liamvdv): remove testing wheels (|| true)
-var TESTING bool = (flag.Lookup("test.v") != nil || true)
-
 // NOTE(liamvdv): Config.RootFilepath must not be synchronized, since different plattforms might have other paths.
 type Config struct {
 	RootFilepath    string   `json:"RootFilepath" yaml:"RootFilepath"`
@@ -31,14 +26,28 @@ type Config struct {
 	IgnoreFilenames []string `json:"IgnoreFilenames" yaml:",flow"` // put default ignores here
 }
 
-var SupportedBackends = []string{
-	"drive",
+// NewConfig returns a Config with the default IgnoreFilenames.
+func NewConfig(root, backend string) *Config {
+	return &Config{
+		RootFilepath:    root,
+		UseBackend:      backend,
+		IgnoreFilenames: append([]string(nil), globalNotShared...),
+	}
 }
 
-func init() {
-	if TESTING {
-		SupportedBackends = append(SupportedBackends, "mock")
+// SupportedBackends lists the names of all backends. It is filled by
+// backend.Register, config cannot import the backend package.
+var SupportedBackends []string
+
+// RegisterBackend adds name to SupportedBackends. Use backend.Register.
+func RegisterBackend(name string) {
+	for _, b := range SupportedBackends {
+		if b == name {
+			return
+		}
 	}
+	SupportedBackends = append(SupportedBackends, name)
+	sort.Strings(SupportedBackends)
 }
 
 // LoadConfigFile must be called after InitVars. It reads the config file and
@@ -56,7 +65,7 @@ func LoadConfigFile(env Env) (*Config, error) {
 	for ; len(errs) > 0; errs = validConfigFile(env.Fs, config) {
 		escape, err := promptConfigFile(env, config, errs)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
 		if escape {
 			return nil, errors.E("Terminating on user request. Could not read valid config file.")
@@ -131,36 +140,41 @@ Would you like to correct it now? (y/n)`, strings.Join(errs, "\n\t"))
 	if len(c.IgnoreFilenames) == 0 {
 		c.IgnoreFilenames = globalNotShared
 	}
+	return false, editConfig(env, c)
+}
 
+// editConfig lets the user edit c in a text editor.
+func editConfig(env Env, c *Config) error {
 	// Use yaml since it is easier for non-tech people to work with.
 	raw, err := yaml.Marshal(c)
 	if err != nil {
-		return false, err
+		return err
 	}
 	tmpPath := filepath.Join(TempCacheFolder, "input.yaml")
 	if err := env.Fs.WriteFile(tmpPath, raw, 0600); err != nil {
-		return false, err
+		return err
 	}
 	defer env.Fs.Remove(tmpPath)
 
-	// If we are testing, we don't want to use openEditor(). To test different
-	// versions of the configuration file, a filepath stirng will be written to
-	// Stdin. That filepath is a existing file testing the promptConfigFile function.
-	if TESTING {
-		if _, err := fmt.Fscan(env.Stdin, &tmpPath); err != nil {
-			panic(err)
-		}
-	} else {
-		if err := openEditor(env, tmpPath); err != nil {
-			return false, err
-		}
+	edit := env.Editor
+	if edit == nil {
+		edit = openEditor
+	}
+	if err := edit(env, tmpPath); err != nil {
+		return err
 	}
 
 	raw, err = env.Fs.ReadFile(tmpPath)
 	if err != nil {
-		return false, err
+		return err
 	}
-	return false, yaml.Unmarshal(raw, c)
+	return yaml.Unmarshal(raw, c)
+}
+
+// Confirm asks the user a yes/no question and returns true if the user agreed.
+func Confirm(env Env, question string) bool {
+	fmt.Fprintf(env.Stdout, "%s (y/n) ", question)
+	return ok(env.Stdin)
 }
 
 func ok(from io.Reader) bool {
@@ -197,7 +211,7 @@ func openEditor(env Env, fp string) error {
 		}
 		editor = append(linuxShell, linuxEditor+" "+fp)
 	default:
-		panic("unsupported platform")
+		return errors.E(errors.Invalid, errors.Errorf("no editor known for %s", runtime.GOOS))
 	}
 
 	cmd := exec.Command(editor[0], editor[1:]...)
@@ -6,12 +6,32 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/liamvdv/sharedHome/backend/mock"
 	"github.com/liamvdv/sharedHome/config"
 	"github.com/liamvdv/sharedHome/osx"
 	"github.com/liamvdv/sharedHome/testutil"
 	"gopkg.in/yaml.v2"
 )
 
+// the tests below use the "mock" backend.
+func init() {
+	mock.Register()
+}
+
+// editFromStdin is an Editor that replaces the edited file with the file
+// whose path is read from Stdin.
+func editFromStdin(env config.Env, fp string) error {
+	var src string
+	if _, err := fmt.Fscan(env.Stdin, &src); err != nil {
+		return err
+	}
+	raw, err := env.Fs.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return env.Fs.WriteFile(fp, raw, 0600)
+}
+
 func TestLoadAndStoreConfigFile(t *testing.T) {
 	defer testutil.RemoveAllTestFiles(t)
 	fs := osx.NewMemMapFs()
@@ -28,6 +48,7 @@ func TestLoadAndStoreConfigFile(t *testing.T) {
 		Stdin:  stdin,
 		Stdout: stdout,
 		Stderr: stderr,
+		Editor: editFromStdin,
 	}
 
 	config.InitVars(fs, configDir)
@@ -54,7 +75,7 @@ func TestLoadAndStoreConfigFile(t *testing.T) {
 	}
 
 	fmt.Fprintln(stdin, "y")  // Want to change now? y
-	fmt.Fprintln(stdin, path) // TESTING special case wants the path.
+	fmt.Fprintln(stdin, path) // the editor wants the path.
 
 	c, err := config.LoadConfigFile(env)
 	if err != nil {
@@ -89,3 +110,93 @@ func mkValidYamlInputFile(fs osx.Fs, testDir string, cfg *config.Config) (path s
 	}
 	return
 }
+
+func TestGetSetValidate(t *testing.T) {
+	defer testutil.RemoveAllTestFiles(t)
+	fs := osx.NewMemMapFs()
+	testDir := testutil.TestDir(fs)
+	config.InitVars(fs, filepath.Join(testDir, ".config"))
+	defer config.Delete(fs, config.D_ConfigFolder)
+
+	c, err := config.ReadConfigFile(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(fs, c); err == nil {
+		t.Error("empty config must be invalid")
+	}
+
+	if err := c.Set("rootfilepath", testDir); err != nil {
+		t.Error(err)
+	}
+	if err := c.Set("UseBackend", "MOCK"); err != nil {
+		t.Error(err)
+	}
+	if err := c.Set("IgnoreFilenames", "a, b", "c"); err != nil {
+		t.Error(err)
+	}
+	if err := c.Set("UseBackend", "mock", "drive"); err == nil {
+		t.Error("UseBackend must take a single value")
+	}
+	if err := c.Set("Unknown", "x"); err == nil {
+		t.Error("unknown key must fail")
+	}
+	if err := config.Validate(fs, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.StoreConfigFile(fs, c); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = config.ReadConfigFile(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"RootFilepath":    testDir,
+		"usebackend":      "mock",
+		"IgnoreFilenames": "a,b,c",
+	} {
+		if got, err := c.Get(key); err != nil || got != want {
+			t.Errorf("%s: want %q, got %q %v", key, want, got, err)
+		}
+	}
+}
+
+func TestEditConfigFile(t *testing.T) {
+	defer testutil.RemoveAllTestFiles(t)
+	fs := osx.NewMemMapFs()
+	testDir := testutil.TestDir(fs)
+	config.InitVars(fs, filepath.Join(testDir, ".config"))
+	defer config.Delete(fs, config.D_ConfigFolder)
+
+	stdin := &bytes.Buffer{}
+	env := config.Env{Fs: fs, Stdin: stdin, Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}, Editor: editFromStdin}
+
+	invalid, err := mkValidYamlInputFile(fs, testDir, &config.Config{RootFilepath: "/does/not/exist", UseBackend: "mock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := mkValidYamlInputFile(fs, testDir, &config.Config{RootFilepath: testDir, UseBackend: "mock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(stdin, invalid) // the editor wants the path.
+	fmt.Fprintln(stdin, "y")     // Want to correct it now? y
+	fmt.Fprintln(stdin, valid)
+	if err := config.EditConfigFile(env); err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.ReadConfigFile(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RootFilepath != testDir {
+		t.Errorf("edited config not stored, got %+v", c)
+	}
+
+	// the editor fails without input.
+	if err := config.EditConfigFile(env); err == nil {
+		t.Error("want an error of the editor")
+	}
+}
@@ -21,6 +21,15 @@ const (
 	// LockIndexFileTemplate = lock-{sun}.bin
 	// lock is used to prevent other clients form accessing the index file.
 	LockIndexFileTemplate = "lock-%d.bin"
+
+	// RemoteKeyFile is the name of the password protected master key in the
+	// remote root folder.
+	RemoteKeyFile = "key.json"
+
+	// PartialFileSuffix ends the names of the hidden files that downloads
+	// are written to before they replace the synchronised file. Such files
+	// are never synchronised, even if a crash leaves them behind.
+	PartialFileSuffix = ".sharedhome-part"
 )
 
 var (
@@ -37,11 +46,22 @@ var (
 	// TempCacheFolder = CONFIG_DIR/sharedHome/temp
 	TempCacheFolder string
 
+	// UploadCacheFolder = CONFIG_DIR/sharedHome/uploads
+	// Stores the encrypted content of unfinished uploads. Unlike
+	// TempCacheFolder, it survives restarts, so that an upload interrupted
+	// in an earlier run is resumed with the same bytes.
+	UploadCacheFolder string
+
 	// ConfigFile = CONFIG_DIR/sharedHome/configuration.json
 	ConfigFile string
 
 	// LogFolder = CONFIG_DIR/sharedHome/log
 	LogFolder string
+
+	// KeyFile = CONFIG_DIR/sharedHome/key
+	// Stores the key used to encrypt all remote data, protected with the
+	// password of the share. It is not created by InitVars.
+	KeyFile string
 )
 
 // InitVars ensures that all named paths and folders exist, else it panics.
@@ -75,10 +95,16 @@ func InitVars(fs osx.Fs, configDirpath string) {
 	if err := existOrCreate(fs, TempCacheFolder, true); err != nil {
 		log.Panic(err)
 	}
+	UploadCacheFolder = filepath.Join(ConfigFolder, "uploads")
+	if err := existOrCreate(fs, UploadCacheFolder, true); err != nil {
+		log.Panic(err)
+	}
 	LogFolder = filepath.Join(ConfigFolder, "log")
 	if err := existOrCreate(fs, LogFolder, true); err != nil {
 		log.Panic(err)
 	}
+	KeyFile = filepath.Join(ConfigFolder, "key")
+	initBackendFuncs(fs)
 }
 
 // userConfigDir is a drop in replacement for os.UserConfigDir that takes care of
@@ -143,6 +169,7 @@ const (
 	D_BackendConfigFolder
 	D_IndexCacheFolder
 	D_LogFolder
+	D_UploadCacheFolder
 	nTargets
 )
 
@@ -154,6 +181,7 @@ var deleteTargetMapping = []*string{
 	D_BackendConfigFolder: &BackendConfigFolder,
 	D_IndexCacheFolder:    &IndexCacheFolder,
 	D_LogFolder:           &LogFolder,
+	D_UploadCacheFolder:   &UploadCacheFolder,
 }
 
 // TODO(liamvdv): Or just rewrite as general Delete(targets ...string) error,
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+)
+
+// The functions in this file back the config command. Unlike LoadConfigFile
+// they never prompt, so that they can be used by scripts.
+
+// Keys are the names of the Config fields that can be read and written.
+var Keys = []string{"RootFilepath", "UseBackend", "IgnoreFilenames"}
+
+// ReadConfigFile reads the config file without validating it. An empty config
+// file results in a Config without any values.
+func ReadConfigFile(fs osx.Fs) (*Config, error) {
+	const op = errors.Op("config.ReadConfigFile")
+	c, err := readConfigFile(fs)
+	if err == uninitializedConfigFile {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, errors.E(op, errors.Path(ConfigFile), err)
+	}
+	return c, nil
+}
+
+// Validate returns an error of kind errors.Invalid that lists all problems
+// of c. It returns nil if c is valid.
+func Validate(fs osx.Fs, c *Config) error {
+	if errs := validConfigFile(fs, c); len(errs) > 0 {
+		return errors.E(errors.Invalid, strings.Join(errs, " "))
+	}
+	return nil
+}
+
+// Get returns the value of the field key of c. Lists are joined by commas.
+// The key is case insensitive.
+func (c *Config) Get(key string) (string, error) {
+	switch strings.ToLower(key) {
+	case "rootfilepath":
+		return c.RootFilepath, nil
+	case "usebackend":
+		return c.UseBackend, nil
+	case "ignorefilenames":
+		return strings.Join(c.IgnoreFilenames, ","), nil
+	}
+	return "", unknownKey(key)
+}
+
+// Set sets the field key of c. Lists accept multiple values, each of which
+// may also be a comma separated list. The key is case insensitive.
+func (c *Config) Set(key string, values ...string) error {
+	lower := strings.ToLower(key)
+	if lower != "ignorefilenames" && len(values) != 1 {
+		return errors.E(errors.Invalid, errors.Errorf("%s takes exactly one value", key))
+	}
+	switch lower {
+	case "rootfilepath":
+		c.RootFilepath = values[0]
+	case "usebackend":
+		c.UseBackend = values[0]
+	case "ignorefilenames":
+		var names []string
+		for _, v := range values {
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+		c.IgnoreFilenames = names
+	default:
+		return unknownKey(key)
+	}
+	return nil
+}
+
+// EditConfigFile lets the user edit the config file in a text editor until it
+// is valid and stores it afterwards.
+func EditConfigFile(env Env) error {
+	const op = errors.Op("config.EditConfigFile")
+	c, err := ReadConfigFile(env.Fs)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if err := editConfig(env, c); err != nil {
+		return errors.E(op, err)
+	}
+	for errs := validConfigFile(env.Fs, c); len(errs) > 0; errs = validConfigFile(env.Fs, c) {
+		escape, err := promptConfigFile(env, c, errs)
+		if err != nil {
+			return errors.E(op, err)
+		}
+		if escape {
+			return errors.E(op, errors.Invalid, "configuration is invalid, not saved")
+		}
+	}
+	if err := StoreConfigFile(env.Fs, c); err != nil {
+		return errors.E(op, err)
+	}
+	return nil
+}
+
+func unknownKey(key string) error {
+	return errors.E(errors.Invalid, errors.Errorf("unknown key %q, known are: %s", key, strings.Join(Keys, ", ")))
+}
@@ -13,6 +13,9 @@ type Env struct {
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
+	// Editor lets the user edit the file fp and returns once the user is
+	// done. If it is nil, the editor of the platform is opened.
+	Editor func(env Env, fp string) error
 	// ExitCode int ?
 }
 
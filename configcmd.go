@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+)
+
+const configUsage = `usage: sharedHome config get [key]
+       sharedHome config set <key> <value>...
+       sharedHome config edit
+       sharedHome config validate`
+
+// Config reads and changes the config file without prompting, see configUsage.
+func Config(env config.Env, args []string) error {
+	const op = errors.Op("main.Config")
+	if len(args) == 0 {
+		fmt.Fprintln(env.Stderr, configUsage)
+		return errors.E(op, errors.Invalid, "missing config subcommand")
+	}
+	if args[0] == "edit" {
+		if err := config.EditConfigFile(env); err != nil {
+			return errors.E(op, err)
+		}
+		return nil
+	}
+
+	cfg, err := config.ReadConfigFile(env.Fs)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "get" && len(args) <= 1:
+		keys := config.Keys
+		if len(args) == 1 {
+			keys = args
+		}
+		for _, key := range keys {
+			v, err := cfg.Get(key)
+			if err != nil {
+				return errors.E(op, err)
+			}
+			if len(args) == 1 {
+				fmt.Fprintln(env.Stdout, v)
+			} else {
+				fmt.Fprintf(env.Stdout, "%s=%s\n", key, v)
+			}
+		}
+	case cmd == "set" && len(args) >= 2:
+		if err := cfg.Set(args[0], args[1:]...); err != nil {
+			return errors.E(op, err)
+		}
+		if err := config.Validate(env.Fs, cfg); err != nil {
+			return errors.E(op, errors.Invalid, errors.Errorf("not saved: %v", err))
+		}
+		if err := config.StoreConfigFile(env.Fs, cfg); err != nil {
+			return errors.E(op, err)
+		}
+	case cmd == "validate" && len(args) == 0:
+		if err := config.Validate(env.Fs, cfg); err != nil {
+			return errors.E(op, err)
+		}
+		fmt.Fprintln(env.Stdout, "The configuration is valid.")
+	default:
+		fmt.Fprintln(env.Stderr, configUsage)
+		return errors.E(op, errors.Invalid, errors.Errorf("invalid config subcommand %q", cmd))
+	}
+	return nil
+}
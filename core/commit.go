@@ -0,0 +1,138 @@
+package core
+
+import (
+	"sort"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+/*
+	Tasks may fail or may not be executed at all if the synchronisation is
+	interrupted. We therefore only apply the tasks that were committed with
+	Sync.Commit to the new indexes:
+	- Remote returns the remote index including all committed changes. It should
+	  be uploaded if RemoteChanged reports true.
+	- Base returns the new base index. It is the new remote index, but paths of
+	  uncommitted tasks keep their previous base version. That way, the next
+	  synchronisation makes the same decision for them again.
+*/
+
+// Commit records that t was executed successfully. It must only be called
+// after Compare has emitted t. Tasks must be committed in the order in which
+// they were emitted for paths that depend on each other, as done by Executor.
+func (s *Sync) Commit(t Task) error {
+	const op = errors.Op("core.Sync.Commit")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	relpath := t.Relpath()
+	if s.pending[relpath] == 0 {
+		return errors.E(op, errors.Path(relpath), errors.Invalid, "task was not emitted or already committed")
+	}
+	if err := s.initNext(); err != nil {
+		return errors.E(op, err)
+	}
+
+	switch t := t.(type) {
+	case Upload:
+		if err := s.next.Put(*t.File); err != nil {
+			return errors.E(op, err)
+		}
+		s.remoteChanged = true
+	case Delete:
+		if t.Remote {
+			if err := s.next.Remove(relpath); err != nil {
+				return errors.E(op, err)
+			}
+			s.remoteChanged = true
+		}
+	case Download, MetadataChangeLocal:
+		// the remote index already reflects these.
+	default:
+		return errors.E(op, errors.Invalid, errors.Errorf("unknown task %T", t))
+	}
+
+	if s.pending[relpath]--; s.pending[relpath] == 0 {
+		delete(s.pending, relpath)
+	}
+	return nil
+}
+
+// Remote returns the remote index with all committed changes applied.
+// The returned index must not be modified.
+func (s *Sync) Remote() (*vfs.FileIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.initNext(); err != nil {
+		return nil, err
+	}
+	return s.next, nil
+}
+
+// RemoteChanged reports whether a committed task changed the remote index.
+func (s *Sync) RemoteChanged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remoteChanged
+}
+
+// Base returns the base index for the next synchronisation.
+func (s *Sync) Base() (*vfs.FileIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.initNext(); err != nil {
+		return nil, err
+	}
+	base, err := s.next.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	relpaths := make([]string, 0, len(s.pending))
+	for relpath := range s.pending {
+		relpaths = append(relpaths, relpath)
+	}
+	sort.Strings(relpaths) // parents first
+
+	for _, relpath := range relpaths {
+		if err := base.Remove(relpath); err != nil && !errors.Is(errors.NotExist, err) {
+			return nil, err
+		}
+		if s.base == nil {
+			continue
+		}
+		old, err := s.base.Get(relpath)
+		if err != nil || !present(old) {
+			continue
+		}
+		putTree(base, old)
+	}
+	return base, nil
+}
+
+// initNext must be called with s.mu held.
+func (s *Sync) initNext() error {
+	if s.next != nil {
+		return nil
+	}
+	next, err := s.remote.Clone()
+	if err != nil {
+		return err
+	}
+	s.next = next
+	return nil
+}
+
+// putTree puts f and all its present children into index. Failures are
+// ignored, since the parent may not exist anymore.
+func putTree(index *vfs.FileIndex, f *vfs.File) {
+	if err := index.Put(*f); err != nil {
+		return
+	}
+	for n := range f.Children {
+		if present(&f.Children[n]) {
+			putTree(index, &f.Children[n])
+		}
+	}
+}
@@ -1,98 +1,322 @@
 package core
 
 import (
-	"path"
+	"sort"
+	"sync"
 
+	"github.com/liamvdv/sharedHome/errors"
 	"github.com/liamvdv/sharedHome/vfs"
 )
 
-// core should later implement the concurrent index tranversal and comparsion,
-// as well as the calls into the different libraries  to fulfill the tasks.
+/*
+	Sync implements a three-way comparison between the local index, the remote
+	index and the base index. The base index is the state both sides agreed on
+	after the last successful synchronisation. Without it, we cannot tell whether
+	a file that only exists locally was created locally or deleted remotely.
+
+	For every path we look at the local (l), remote (r) and base (b) version:
+
+	l  r  b
+	-  -  *  nothing to do
+	x  -  -  created locally                  -> Upload
+	x  -  x  deleted remotely                 -> Delete local, Upload if l changed since b
+	-  x  -  created remotely                 -> Download
+	-  x  x  deleted locally                  -> Delete remote, Download if r changed since b
+	x  x  *  present on both sides            -> the side that changed since b wins.
+	                                             If both changed, the younger MTime wins.
+
+	Tasks are emitted in pre-order, i. e. a directory is always emitted before
+	its children. Task executors rely on that. The only exception are local
+	deletes: the children of a directory are deleted first and the directory
+	is only removed if it is empty then, so that files which are not
+	synchronised, e. g. ignored ones, survive.
+*/
+
+// When I speak of downloading a file I mean that real files should be downloaded
+// and directories should be created locally.
 
 type Sync struct {
-	local   vfs.FileIndex
-	remote  vfs.FileIndex
-	changed map[string]struct {
-		target *vfs.File
-		update vfs.File
+	local  *vfs.FileIndex
+	remote *vfs.FileIndex
+	base   *vfs.FileIndex
+
+	// see commit.go
+	mu            sync.Mutex
+	pending       map[string]int
+	next          *vfs.FileIndex
+	remoteChanged bool
+}
+
+// New returns a Sync for the three indexes. base may be nil if the client has
+// never synchronised before. The indexes are not modified.
+func New(local, remote, base *vfs.FileIndex) *Sync {
+	return &Sync{
+		local:   local,
+		remote:  remote,
+		base:    base,
+		pending: make(map[string]int),
 	}
-	indexUpdateRequired bool
 }
 
-type Task interface {
-	IsNetworkBound() bool
+// Compare walks the local, remote and base index and sends all tasks required
+// to reconcile them to tasks. It closes tasks when it returns.
+func (s *Sync) Compare(tasks chan<- Task) error {
+	const op = errors.Op("core.Sync.Compare")
+	defer close(tasks)
+
+	local := getDir(s.local, "/")
+	if local == nil {
+		return errors.E(op, errors.Invalid, "local index has no root directory")
+	}
+	remote := getDir(s.remote, "/")
+	if remote == nil {
+		return errors.E(op, errors.Invalid, "remote index has no root directory")
+	}
+	// The roots always exist on both sides, only compare their children.
+	s.compareChildren(local, remote, getDir(s.base, "/"), tasks)
+	return nil
 }
 
-type Delete struct {}
+// compareDir compares the three versions of the same path. At least one of
+// local, remote and base should be non-nil.
+func (s *Sync) compareDir(local, remote, base *vfs.File, tasks chan<- Task) {
+	if local != nil && local.State == vfs.Ignored {
+		// never touch ignored files, not even if the remote has a version of it.
+		return
+	}
+	if !present(local) {
+		local = nil
+	}
+	if !present(remote) {
+		remote = nil
+	}
+	if !present(base) {
+		base = nil
+	}
 
-type Download struct{}
+	switch {
+	case local == nil && remote == nil:
+		return
 
-type Upload struct{}
+	case remote == nil:
+		if base == nil {
+			// created locally
+			s.upload(local, nil, nil, tasks)
+			return
+		}
+		if !changedSince(local, base) {
+			// deleted remotely and not touched locally since.
+			s.deleteLocal(local, tasks)
+			return
+		}
+		// deleted remotely, but modified locally. Keep the local changes.
+		if local.Mode.IsDir() && base.Mode.IsDir() {
+			s.upload(local, nil, base, tasks)
+			return
+		}
+		s.upload(local, nil, nil, tasks)
 
-type MetadataChangeLocal struct{}
+	case local == nil:
+		if base == nil {
+			// created remotely
+			s.download(remote, nil, nil, tasks)
+			return
+		}
+		if !changedSince(remote, base) {
+			// deleted locally and not touched remotely since.
+			s.emit(tasks, Delete{File: remote, Remote: true})
+			return
+		}
+		// deleted locally, but modified remotely. Keep the remote changes.
+		if remote.Mode.IsDir() && base.Mode.IsDir() {
+			s.download(remote, nil, base, tasks)
+			return
+		}
+		s.download(remote, nil, nil, tasks)
 
-// When I speak of downloading a file I mean that real files should be downloaded
-// and directories should be created locally.
+	case local.Mode.IsDir() != remote.Mode.IsDir():
+		// One side replaced a file with a directory or vice versa.
+		if localWins(local, remote, base) {
+			s.emit(tasks, Delete{File: remote, Remote: true})
+			s.upload(local, nil, nil, tasks)
+		} else {
+			s.deleteLocal(local, tasks)
+			s.download(remote, nil, nil, tasks)
+		}
 
-// should limit number of CompareDirs with semaphore pattern (chan buff size is max active CompareDir.)
-// One of local or remote must be non-nil.
-func (s *Sync) compareDir(local, remote *vfs.File, task chan<- Task) {
+	case local.Mode.IsDir():
+		if local.Mode != remote.Mode {
+			if base != nil && local.Mode == base.Mode {
+				s.emit(tasks, MetadataChangeLocal{File: remote})
+			} else {
+				// the mode is part of the remote index, thus needs an upload.
+				s.emit(tasks, Upload{File: local, Remote: remote})
+			}
+		}
+		s.compareChildren(local, remote, base, tasks)
 
-	if local == nil {
-		if remote.State == vfs.Ignored || remote.State == vfs.Deleted {
+	default:
+		if sameContent(local, remote) {
+			if local.Mode == remote.Mode {
+				return
+			}
+			if base != nil && local.Mode == base.Mode {
+				s.emit(tasks, MetadataChangeLocal{File: remote})
+				return
+			}
+			// the mode is part of the remote index, thus needs an upload.
+			s.emit(tasks, Upload{File: local, Remote: remote})
 			return
 		}
-		// either download file or file was deleted locally.
-		rdp := path.Dir(remote.Relpath)
-		lpar, err := s.local.GetDir(rdp)
-		if err != nil {
-			panic(err) // what to do?
-		}
-		switch {
-		// can compare parent to child since child must have child.MTime >= par.MTime because child.MTime = child.CTime when created.
-		case lpar.MTime > remote.MTime:
-			// file was deleted locally because local dir changes more current.
-			// not 100% sure since other changes may have also triggered that.....
-			// change state of File and place in index. and mark that index upload is required
-
-		case lpar.MTime < remote.MTime:
-			// file needs to be downloaded; 100% sure
-			// recursively download!
-		case lpar.MTime == remote.MTime:
-			// don't know how this is possible
-			panic("invalid state")
+		if localWins(local, remote, base) {
+			s.emit(tasks, Upload{File: local, Remote: remote})
+		} else {
+			s.emit(tasks, Download{File: remote, Local: local})
 		}
-		return
 	}
+}
 
-	if remote == nil {
-		if local.State == vfs.Ignored { // || local.State == vfs.Deleted not possible since it wouldn't be in the index then.
-			// store this change to the index and mark that index upload is required.
-			return
+// emit records t as pending until it is committed and sends it.
+func (s *Sync) emit(tasks chan<- Task, t Task) {
+	s.mu.Lock()
+	s.pending[t.Relpath()]++
+	s.mu.Unlock()
+	tasks <- t
+}
+
+// compareChildren calls compareDir for the union of children names of local,
+// remote and base. Any of them may be nil.
+func (s *Sync) compareChildren(local, remote, base *vfs.File, tasks chan<- Task) {
+	lc, rc, bc := children(local), children(remote), children(base)
+
+	names := make([]string, 0, len(lc)+len(rc))
+	for _, m := range [...]map[string]*vfs.File{lc, rc, bc} {
+		for name := range m {
+			names = append(names, name)
 		}
-		// either upload dir recursively or dir was deleted remotely.
-		ldp := path.Dir(local.Relpath)
-		rpar, err := s.remote.GetDir(ldp)
-		if err != nil {
-			panic(err) // what to do?
-		}
-		switch {
-		case local.MTime > rpar.MTime:
-			// file was created locally because local dir changes are younger.
-			// 100% sure
-			// file needs to be uploaded -> recursively!
-		case local.MTime < rpar.MTime:
-			// file was deleted remotely, not 100% sure since other changes might have happend in dir.
-		case local.MTime == rpar.MTime:
-			// don't know how this is possible
-			panic("invalid state")
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
 		}
-		return
+		s.compareDir(lc[name], rc[name], bc[name], tasks)
+	}
+}
+
+// upload emits an Upload task for local. If local is a directory, it
+// recursively continues with its children. base may be used to detect
+// children that were deleted remotely.
+func (s *Sync) upload(local, remote, base *vfs.File, tasks chan<- Task) {
+	s.emit(tasks, Upload{File: local, Remote: remote})
+	if local.Mode.IsDir() {
+		s.compareChildren(local, nil, base, tasks)
+	}
+}
+
+// download emits a Download task for remote. If remote is a directory, it
+// recursively continues with its children. base may be used to detect
+// children that were deleted locally.
+func (s *Sync) download(remote, local, base *vfs.File, tasks chan<- Task) {
+	s.emit(tasks, Download{File: remote, Local: local})
+	if remote.Mode.IsDir() {
+		s.compareChildren(nil, remote, base, tasks)
+	}
+}
+
+// deleteLocal emits a Delete task for local. If local is a directory, its
+// present children are deleted before it, see the exception above.
+func (s *Sync) deleteLocal(local *vfs.File, tasks chan<- Task) {
+	if local.Mode.IsDir() {
+		for n := range local.Children {
+			if child := &local.Children[n]; present(child) {
+				s.deleteLocal(child, tasks)
+			}
+		}
+	}
+	s.emit(tasks, Delete{File: local})
+}
+
+// localWins decides which version of a path to keep if both exist and differ.
+// The side which changed since the last synchronisation wins. If both changed,
+// the younger modification time wins, ties are resolved in favour of local.
+func localWins(local, remote, base *vfs.File) bool {
+	lchanged := base == nil || changedSince(local, base)
+	rchanged := base == nil || changedSince(remote, base)
+	switch {
+	case lchanged && !rchanged:
+		return true
+	case rchanged && !lchanged:
+		return false
 	}
+	return local.MTime >= remote.MTime
+}
+
+// changedSince returns true if f differs from base. For directories the whole
+// subtree is compared, since the MTime of a directory changes with its children.
+func changedSince(f, base *vfs.File) bool {
+	if f.Mode.IsDir() != base.Mode.IsDir() {
+		return true
+	}
+	if !f.Mode.IsDir() {
+		return !f.StrongEquals(base)
+	}
+	if f.Mode != base.Mode {
+		return true
+	}
+	fc, bc := children(f), children(base)
+	var n int
+	for name, child := range fc {
+		if !present(child) {
+			continue
+		}
+		n++
+		bchild, ok := bc[name]
+		if !ok || !present(bchild) || changedSince(child, bchild) {
+			return true
+		}
+	}
+	for _, bchild := range bc {
+		if present(bchild) {
+			n--
+		}
+	}
+	return n != 0
+}
+
+// sameContent compares the attributes which indicate a content change.
+func sameContent(a, b *vfs.File) bool {
+	return a.MTime == b.MTime && a.Size == b.Size
+}
+
+// present returns true if f exists and takes part in the synchronisation.
+func present(f *vfs.File) bool {
+	return f != nil && f.State != vfs.Deleted && f.State != vfs.Ignored
+}
 
-	// compare remote and local dirs
-	// ...
+// children maps the base names of all children of dir to the child, including
+// ignored ones. It returns nil for nil or non-directory files.
+func children(dir *vfs.File) map[string]*vfs.File {
+	if dir == nil || !dir.Mode.IsDir() {
+		return nil
+	}
+	m := make(map[string]*vfs.File, len(dir.Children))
+	for n := range dir.Children {
+		child := &dir.Children[n]
+		m[child.Base()] = child
+	}
+	return m
+}
 
-	// compare children -> lexcially ordered children would help a lot.
-	// ....
+// getDir returns nil if the index is nil or does not contain the dir.
+func getDir(index *vfs.FileIndex, relpath string) *vfs.File {
+	if index == nil {
+		return nil
+	}
+	dir, err := index.GetDir(relpath)
+	if err != nil {
+		return nil
+	}
+	return dir
 }
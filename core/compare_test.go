@@ -0,0 +1,248 @@
+package core_test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/core"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+func file(relpath string, mtime int64) vfs.File {
+	return vfs.File{Relpath: relpath, MTime: mtime, Mode: 0644, Size: 9}
+}
+
+// dir accepts children with names relative to the dir, see rooted.
+func dir(name string, children ...vfs.File) vfs.File {
+	if children == nil {
+		children = []vfs.File{}
+	}
+	return vfs.File{Relpath: name, Mode: os.ModeDir | 0755, Children: children}
+}
+
+// rooted makes the relative names of f and its children absolute.
+func rooted(parent string, f vfs.File) vfs.File {
+	f.Relpath = path.Join(parent, f.Relpath)
+	if f.Children != nil {
+		cs := make([]vfs.File, len(f.Children))
+		for i, c := range f.Children {
+			cs[i] = rooted(f.Relpath, c)
+		}
+		f.Children = cs
+	}
+	return f
+}
+
+// chmod sets the permissions of f, keeping its type.
+func chmod(f vfs.File, perm os.FileMode) vfs.File {
+	f.Mode = f.Mode&^os.ModePerm | perm
+	return f
+}
+
+func ignored(f vfs.File) vfs.File {
+	f.State = vfs.Ignored
+	return f
+}
+
+func index(root vfs.File) *vfs.FileIndex {
+	root = rooted("/", root)
+	return vfs.NewFromMemory(&root)
+}
+
+func compare(t *testing.T, local, remote, base *vfs.FileIndex) []string {
+	tasks := make(chan core.Task)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- core.New(local, remote, base).Compare(tasks)
+	}()
+	var got []string
+	for task := range tasks {
+		got = append(got, fmt.Sprint(task))
+	}
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+	return got
+}
+
+func TestCompare(t *testing.T) {
+	type test struct {
+		name                string
+		local, remote, base vfs.File
+		// nil base means first synchronisation.
+		noBase bool
+		want   []string
+	}
+	cases := []test{
+		{
+			name:   "unchanged",
+			local:  dir("/", file("a", 1)),
+			remote: dir("/", file("a", 1)),
+			base:   dir("/", file("a", 1)),
+			want:   nil,
+		},
+		{
+			name:   "created locally",
+			local:  dir("/", file("a", 1)),
+			remote: dir("/"),
+			base:   dir("/"),
+			want:   []string{"upload /a"},
+		},
+		{
+			name:   "deleted remotely",
+			local:  dir("/", file("a", 1)),
+			remote: dir("/"),
+			base:   dir("/", file("a", 1)),
+			want:   []string{"delete local /a"},
+		},
+		{
+			name:   "deleted remotely but modified locally",
+			local:  dir("/", file("a", 2)),
+			remote: dir("/"),
+			base:   dir("/", file("a", 1)),
+			want:   []string{"upload /a"},
+		},
+		{
+			name:   "created remotely",
+			local:  dir("/"),
+			remote: dir("/", file("a", 1)),
+			base:   dir("/"),
+			want:   []string{"download /a"},
+		},
+		{
+			name:   "deleted locally",
+			local:  dir("/"),
+			remote: dir("/", file("a", 1)),
+			base:   dir("/", file("a", 1)),
+			want:   []string{"delete remote /a"},
+		},
+		{
+			name:   "modified remotely",
+			local:  dir("/", file("a", 1)),
+			remote: dir("/", file("a", 2)),
+			base:   dir("/", file("a", 1)),
+			want:   []string{"download /a"},
+		},
+		{
+			name:   "modified locally",
+			local:  dir("/", file("a", 2)),
+			remote: dir("/", file("a", 1)),
+			base:   dir("/", file("a", 1)),
+			want:   []string{"upload /a"},
+		},
+		{
+			name:   "modified on both sides",
+			local:  dir("/", file("a", 2), file("b", 3)),
+			remote: dir("/", file("a", 3), file("b", 2)),
+			base:   dir("/", file("a", 1), file("b", 1)),
+			want:   []string{"download /a", "upload /b"},
+		},
+		{
+			name:   "first synchronisation",
+			local:  dir("/", file("a", 1), file("b", 2)),
+			remote: dir("/", file("b", 1), file("c", 1)),
+			noBase: true,
+			want:   []string{"upload /a", "upload /b", "download /c"},
+		},
+		{
+			name:   "ignored",
+			local:  dir("/", ignored(file("a", 1)), ignored(file("b", 1))),
+			remote: dir("/", file("b", 2)),
+			base:   dir("/"),
+			want:   nil,
+		},
+		{
+			name:   "new directory is emitted before its children",
+			local:  dir("/", dir("d", file("x", 1), dir("e", file("y", 1)))),
+			remote: dir("/"),
+			base:   dir("/"),
+			want:   []string{"upload /d", "upload /d/e", "upload /d/e/y", "upload /d/x"},
+		},
+		{
+			name:   "deleted directory",
+			local:  dir("/", dir("d", file("x", 1))),
+			remote: dir("/"),
+			base:   dir("/", dir("d", file("x", 1))),
+			want:   []string{"delete local /d/x", "delete local /d"},
+		},
+		{
+			name:   "deleted directory with ignored child",
+			local:  dir("/", dir("d", file("x", 1), ignored(file("y", 1)), dir("e", file("z", 1)))),
+			remote: dir("/"),
+			base:   dir("/", dir("d", file("x", 1), dir("e", file("z", 1)))),
+			want:   []string{"delete local /d/x", "delete local /d/e/z", "delete local /d/e", "delete local /d"},
+		},
+		{
+			name:   "deleted directory but child created locally",
+			local:  dir("/", dir("d", file("x", 1), file("y", 1))),
+			remote: dir("/"),
+			base:   dir("/", dir("d", file("x", 1))),
+			want:   []string{"upload /d", "delete local /d/x", "upload /d/y"},
+		},
+		{
+			name:   "file replaced with directory remotely",
+			local:  dir("/", file("a", 1)),
+			remote: dir("/", dir("a", file("x", 2))),
+			base:   dir("/", file("a", 1)),
+			want:   []string{"delete local /a", "download /a", "download /a/x"},
+		},
+		{
+			name:  "mode changed remotely",
+			local: dir("/", file("a", 1)),
+			remote: func() vfs.File {
+				d := dir("/", file("a", 1))
+				d.Children[0].Mode = 0600
+				return d
+			}(),
+			base: dir("/", file("a", 1)),
+			want: []string{"change metadata /a"},
+		},
+		{
+			name:   "directory mode changed locally",
+			local:  dir("/", chmod(dir("d", file("x", 1)), 0700)),
+			remote: dir("/", dir("d", file("x", 1))),
+			base:   dir("/", dir("d", file("x", 1))),
+			want:   []string{"upload /d"},
+		},
+		{
+			name:   "directory mode changed remotely",
+			local:  dir("/", dir("d", file("x", 1))),
+			remote: dir("/", chmod(dir("d", file("x", 1)), 0700)),
+			base:   dir("/", dir("d", file("x", 1))),
+			want:   []string{"change metadata /d"},
+		},
+		{
+			name:   "directory deleted remotely after a local mode change",
+			local:  dir("/", chmod(dir("d", file("x", 1)), 0700)),
+			remote: dir("/"),
+			base:   dir("/", dir("d", file("x", 1))),
+			want:   []string{"upload /d", "delete local /d/x"},
+		},
+	}
+
+	for _, c := range cases {
+		var base *vfs.FileIndex
+		if !c.noBase {
+			base = index(c.base)
+		}
+		got := compare(t, index(c.local), index(c.remote), base)
+		if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+			t.Errorf("%s:\nwant: %q\ngot:  %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestCompareWithoutRoot(t *testing.T) {
+	local := &vfs.FileIndex{Files: map[string]*vfs.File{}}
+	tasks := make(chan core.Task)
+	go func() {
+		for range tasks {
+		}
+	}()
+	if err := core.New(local, local, nil).Compare(tasks); err == nil {
+		t.Error("comparing an index without root must fail")
+	}
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/liamvdv/sharedHome/errors"
+)
+
+/*
+Usage:
+	tasks := make(chan core.Task)
+	go s.Compare(tasks)
+	x := core.Executor{NetworkWorkers: 4, DiskWorkers: 2, Handle: handle}
+	for res := range x.Run(ctx, tasks) {
+		if res.Err == nil {
+			s.Commit(res.Task)
+		}
+	}
+*/
+
+// Handler executes a single task.
+type Handler func(ctx context.Context, t Task) error
+
+// Result reports the outcome of a single task. Err is nil if the task succeeded.
+type Result struct {
+	Task Task
+	Err  error
+}
+
+var (
+	// ErrParentFailed is reported for tasks that were not executed because a
+	// task on a parent path failed before.
+	ErrParentFailed = errors.E("task on parent path failed")
+)
+
+// Executor drains a task channel and executes the tasks concurrently.
+// Network bound tasks are executed by a pool of NetworkWorkers goroutines,
+// all other tasks by a pool of DiskWorkers goroutines.
+//
+// Tasks must be sent in pre-order as done by Sync.Compare. A task is not
+// started before all earlier tasks on the same path or a parent path have
+// finished, and it is skipped if one of those failed.
+type Executor struct {
+	NetworkWorkers int
+	DiskWorkers    int
+	Handle         Handler
+
+	mu       sync.Mutex
+	done     *sync.Cond
+	inflight map[string]int
+	failed   []string
+}
+
+// Run consumes tasks until it is closed and returns a channel that receives
+// exactly one Result per consumed task. The results channel is closed after
+// the last result. If ctx is cancelled, the remaining tasks are still consumed,
+// but not executed and reported with the context error.
+// The results must be consumed, else the executor blocks.
+func (x *Executor) Run(ctx context.Context, tasks <-chan Task) <-chan Result {
+	x.done = sync.NewCond(&x.mu)
+	x.inflight = make(map[string]int)
+	x.failed = nil
+
+	results := make(chan Result)
+	network := make(chan Task)
+	disk := make(chan Task)
+
+	var wg sync.WaitGroup
+	startPool := func(n int, in <-chan Task) {
+		if n < 1 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for t := range in {
+					x.execute(ctx, t, results)
+				}
+			}()
+		}
+	}
+	startPool(x.NetworkWorkers, network)
+	startPool(x.DiskWorkers, disk)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(network)
+		defer close(disk)
+		for t := range tasks {
+			if err := x.acquire(ctx, t.Relpath()); err != nil {
+				results <- Result{Task: t, Err: err}
+				continue
+			}
+			if t.IsNetworkBound() {
+				network <- t
+			} else {
+				disk <- t
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+func (x *Executor) execute(ctx context.Context, t Task, results chan<- Result) {
+	err := ctx.Err()
+	if err == nil {
+		err = x.Handle(ctx, t)
+	}
+	// Report before releasing the path, so that the results of tasks on
+	// parent paths are always received first.
+	results <- Result{Task: t, Err: err}
+	x.release(t.Relpath(), err != nil)
+}
+
+// acquire blocks until no task on a parent path or relpath itself is running.
+// It returns an error if the task must not be executed.
+func (x *Executor) acquire(ctx context.Context, relpath string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for x.conflicts(relpath) && ctx.Err() == nil {
+		x.done.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, fp := range x.failed {
+		if related(fp, relpath) {
+			return errors.E(errors.Path(relpath), ErrParentFailed)
+		}
+	}
+	x.inflight[relpath]++
+	return nil
+}
+
+func (x *Executor) release(relpath string, failed bool) {
+	x.mu.Lock()
+	if x.inflight[relpath]--; x.inflight[relpath] == 0 {
+		delete(x.inflight, relpath)
+	}
+	if failed {
+		x.failed = append(x.failed, relpath)
+	}
+	x.mu.Unlock()
+	x.done.Broadcast()
+}
+
+// conflicts must be called with x.mu held.
+func (x *Executor) conflicts(relpath string) bool {
+	for fp := range x.inflight {
+		if related(fp, relpath) || related(relpath, fp) {
+			return true
+		}
+	}
+	return false
+}
+
+// related returns true if child is parent or lies within parent.
+func related(parent, child string) bool {
+	return parent == child || parent == "/" || strings.HasPrefix(child, parent+"/")
+}
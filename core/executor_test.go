@@ -0,0 +1,175 @@
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liamvdv/sharedHome/core"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+func run(ctx context.Context, s *core.Sync, x *core.Executor) map[string]error {
+	tasks := make(chan core.Task)
+	go s.Compare(tasks)
+	got := make(map[string]error)
+	for res := range x.Run(ctx, tasks) {
+		got[fmt.Sprint(res.Task)] = res.Err
+		if res.Err == nil {
+			if err := s.Commit(res.Task); err != nil {
+				got["commit "+fmt.Sprint(res.Task)] = err
+			}
+		}
+	}
+	return got
+}
+
+func TestExecutorPartialFailure(t *testing.T) {
+	local := index(dir("/", dir("d", file("x", 1), dir("e", file("y", 1))), file("z", 1)))
+	remote := index(dir("/", file("r", 1)))
+	s := core.New(local, remote, index(dir("/")))
+
+	x := core.Executor{
+		NetworkWorkers: 2,
+		DiskWorkers:    1,
+		Handle: func(ctx context.Context, t core.Task) error {
+			if t.Relpath() == "/d/e" {
+				return errors.E(errors.IO, "network down")
+			}
+			return nil
+		},
+	}
+	got := run(context.Background(), s, &x)
+
+	want := map[string]bool{
+		"upload /d":     true,
+		"upload /d/x":   true,
+		"upload /d/e":   false,
+		"upload /d/e/y": false,
+		"upload /z":     true,
+		"download /r":   true,
+	}
+	if len(got) != len(want) {
+		t.Errorf("want %d results, got %v", len(want), got)
+	}
+	for task, ok := range want {
+		err, found := got[task]
+		if !found {
+			t.Errorf("no result for %q", task)
+		} else if ok != (err == nil) {
+			t.Errorf("%q: unexpected error %v", task, err)
+		}
+	}
+
+	next, err := s.Remote()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.RemoteChanged() {
+		t.Error("remote index must have changed")
+	}
+	base, err := s.Base()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range []*vfs.FileIndex{next, base} {
+		for _, relpath := range []string{"/d", "/d/x", "/z", "/r"} {
+			if _, err := idx.Get(relpath); err != nil {
+				t.Errorf("committed %s missing: %v", relpath, err)
+			}
+		}
+		for _, relpath := range []string{"/d/e", "/d/e/y"} {
+			if _, err := idx.Get(relpath); err == nil {
+				t.Errorf("failed %s must not be in index", relpath)
+			}
+		}
+	}
+}
+
+func TestExecutorBaseKeepsFailedDeletes(t *testing.T) {
+	local := index(dir("/"))
+	remote := index(dir("/", file("a", 1)))
+	base := index(dir("/", file("a", 1)))
+	s := core.New(local, remote, base)
+
+	x := core.Executor{Handle: func(ctx context.Context, t core.Task) error {
+		return errors.E(errors.IO, "network down")
+	}}
+	if got := run(context.Background(), s, &x); got["delete remote /a"] == nil {
+		t.Fatalf("want failed delete, got %v", got)
+	}
+	if s.RemoteChanged() {
+		t.Error("remote index must not change if all tasks failed")
+	}
+	nextBase, err := s.Base()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nextBase.Get("/a"); err != nil {
+		t.Error("failed delete must keep base version, else it is downloaded again next time")
+	}
+}
+
+func TestExecutorCancel(t *testing.T) {
+	local := index(dir("/", file("a", 1), file("b", 1)))
+	s := core.New(local, index(dir("/")), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	x := core.Executor{Handle: func(ctx context.Context, task core.Task) error {
+		t.Errorf("%s executed after cancellation", task)
+		return nil
+	}}
+	got := run(ctx, s, &x)
+	if len(got) != 2 {
+		t.Errorf("want a result for every task, got %v", got)
+	}
+	for task, err := range got {
+		if err != context.Canceled {
+			t.Errorf("%s: want %v, got %v", task, context.Canceled, err)
+		}
+	}
+}
+
+func TestExecutorPools(t *testing.T) {
+	const (
+		nFiles  = 20
+		workers = 3
+	)
+	var children []vfs.File
+	for i := 0; i < nFiles; i++ {
+		children = append(children, file(fmt.Sprintf("f%d", i), 1))
+	}
+	s := core.New(index(dir("/", children...)), index(dir("/")), nil)
+
+	var (
+		mu             sync.Mutex
+		active, maxAct int
+	)
+	x := core.Executor{
+		NetworkWorkers: workers,
+		DiskWorkers:    1,
+		Handle: func(ctx context.Context, t core.Task) error {
+			mu.Lock()
+			if active++; active > maxAct {
+				maxAct = active
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return nil
+		},
+	}
+	got := run(context.Background(), s, &x)
+	if len(got) != nFiles {
+		t.Errorf("want %d results, got %d", nFiles, len(got))
+	}
+	if maxAct > workers {
+		t.Errorf("%d tasks ran concurrently, only %d network workers permitted", maxAct, workers)
+	}
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+// Transferer moves files between the local filesystem and the remote.
+// It is implemented by remote.Remote.
+type Transferer interface {
+	Upload(ctx context.Context, f *vfs.File, replace bool) error
+	Download(ctx context.Context, f *vfs.File) error
+	Delete(ctx context.Context, f *vfs.File) error
+}
+
+// NewHandler returns a Handler that executes tasks for the local directory
+// root on fs. Remote operations are delegated to tr.
+func NewHandler(fs osx.Fs, root string, tr Transferer) Handler {
+	return func(ctx context.Context, t Task) error {
+		const op = errors.Op("core.Handler")
+		abspath := filepath.Join(root, filepath.FromSlash(t.Relpath()))
+
+		var err error
+		switch t := t.(type) {
+		case Upload:
+			err = tr.Upload(ctx, t.File, t.Remote != nil)
+		case Download:
+			err = tr.Download(ctx, t.File)
+		case Delete:
+			switch {
+			case t.Remote:
+				err = tr.Delete(ctx, t.File)
+			case t.File.Mode.IsDir():
+				err = removeEmptyDir(fs, abspath)
+			default:
+				err = fs.Remove(abspath)
+			}
+		case MetadataChangeLocal:
+			if err = fs.Chmod(abspath, t.File.Mode.Perm()); err == nil && !t.File.Mode.IsDir() {
+				err = fs.Chtimes(abspath, time.Now(), time.Unix(0, t.File.MTime))
+			}
+		default:
+			err = errors.E(errors.Invalid, errors.Errorf("unknown task %T", t))
+		}
+		if err != nil {
+			return errors.E(op, errors.Path(t.Relpath()), err)
+		}
+		return nil
+	}
+}
+
+// removeEmptyDir removes the directory fp if it is empty. A directory that
+// still holds files which are not synchronised, e. g. ignored ones, is kept.
+func removeEmptyDir(fs osx.Fs, fp string) error {
+	entries, err := fs.ReadDir(fp)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+	return fs.Remove(fp)
+}
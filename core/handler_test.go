@@ -0,0 +1,49 @@
+package core_test
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/core"
+	"github.com/liamvdv/sharedHome/osx"
+)
+
+// TestDeleteKeepsIgnored checks that deleting a directory locally removes the
+// synchronised files only.
+func TestDeleteKeepsIgnored(t *testing.T) {
+	fs := osx.NewMemMapFs()
+	for _, fp := range []string{"/root/d/x", "/root/d/ignored", "/root/e/f/y"} {
+		if err := fs.MkdirAll(path.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.WriteFile(fp, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	local := index(dir("/",
+		dir("d", file("x", 1), ignored(file("ignored", 1))),
+		dir("e", dir("f", file("y", 1)))))
+	base := index(dir("/", dir("d", file("x", 1)), dir("e", dir("f", file("y", 1)))))
+	remote := index(dir("/"))
+
+	tasks := make(chan core.Task)
+	go core.New(local, remote, base).Compare(tasks)
+	handle := core.NewHandler(fs, "/root", nil)
+	for task := range tasks {
+		if err := handle(context.Background(), task); err != nil {
+			t.Errorf("%s: %v", task, err)
+		}
+	}
+
+	for fp, want := range map[string]bool{
+		"/root/d":         true,
+		"/root/d/ignored": true,
+		"/root/d/x":       false,
+		"/root/e":         false,
+	} {
+		if _, err := fs.Stat(fp); (err == nil) != want {
+			t.Errorf("%s: want exists %v, got %v", fp, want, err)
+		}
+	}
+}
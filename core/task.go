@@ -0,0 +1,86 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+// Task is a single operation required to synchronise local and remote.
+type Task interface {
+	IsNetworkBound() bool
+	// Relpath returns the path the task operates on.
+	Relpath() string
+}
+
+var (
+	_ Task = Delete{}
+	_ Task = Download{}
+	_ Task = Upload{}
+	_ Task = MetadataChangeLocal{}
+)
+
+// Delete deletes File locally or, if Remote is set, on the remote. Remote
+// directories are deleted recursively. Local directories are only removed if
+// they are empty, their children are deleted by separate tasks before.
+type Delete struct {
+	File   *vfs.File
+	Remote bool
+}
+
+func (t Delete) IsNetworkBound() bool { return t.Remote }
+
+func (t Delete) Relpath() string { return t.File.Relpath }
+
+func (t Delete) String() string {
+	if t.Remote {
+		return fmt.Sprintf("delete remote %s", t.File.Relpath)
+	}
+	return fmt.Sprintf("delete local %s", t.File.Relpath)
+}
+
+// Download downloads the remote File. Directories are only created locally,
+// their children are downloaded by separate tasks. Local is the local version
+// which will be replaced, it is nil if there is none.
+type Download struct {
+	File  *vfs.File
+	Local *vfs.File
+}
+
+func (t Download) IsNetworkBound() bool { return !t.File.Mode.IsDir() }
+
+func (t Download) Relpath() string { return t.File.Relpath }
+
+func (t Download) String() string {
+	return fmt.Sprintf("download %s", t.File.Relpath)
+}
+
+// Upload uploads the local File. Directories are only created remotely, their
+// children are uploaded by separate tasks. Remote is the remote version which
+// will be replaced, it is nil if there is none.
+type Upload struct {
+	File   *vfs.File
+	Remote *vfs.File
+}
+
+func (t Upload) IsNetworkBound() bool { return true }
+
+func (t Upload) Relpath() string { return t.File.Relpath }
+
+func (t Upload) String() string {
+	return fmt.Sprintf("upload %s", t.File.Relpath)
+}
+
+// MetadataChangeLocal applies the mode and modification time of the remote
+// File to the local file without transferring its content.
+type MetadataChangeLocal struct {
+	File *vfs.File
+}
+
+func (t MetadataChangeLocal) IsNetworkBound() bool { return false }
+
+func (t MetadataChangeLocal) Relpath() string { return t.File.Relpath }
+
+func (t MetadataChangeLocal) String() string {
+	return fmt.Sprintf("change metadata %s", t.File.Relpath)
+}
@@ -5,9 +5,12 @@ go 1.16
 require (
 	cloud.google.com/go v0.82.0 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
+	github.com/pkg/sftp v1.13.4
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
 	golang.org/x/net v0.0.0-20210521195947-fe42d452be8f
 	golang.org/x/oauth2 v0.0.0-20210514164344-f6687ab2804c
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 	google.golang.org/api v0.47.0
 	google.golang.org/genproto v0.0.0-20210524142926-3e3a6030be83 // indirect
 	google.golang.org/grpc v1.38.0 // indirect
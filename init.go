@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/util"
+)
+
+// Init bootstraps a new encrypted share or, with -join, joins an existing one.
+// Without -root and -backend, the configuration is prompted for. So are
+// the options of the backend that are not given with -opt.
+// The key of the share is protected with a password and stored locally and
+// on the remote, so that other machines join with the password.
+func Init(env config.Env, args []string) error {
+	const op = errors.Op("main.Init")
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	flags.SetOutput(env.Stderr)
+	var (
+		root        = flags.String("root", "", "local directory to share")
+		backendName = flags.String("backend", "", "storage backend, one of: "+strings.Join(config.SupportedBackends, ", "))
+		join        = flags.Bool("join", false, "join the share that exists on the remote")
+		keyArg      = flags.String("key", "", "key of a share created before keys were protected with a password, prompted for if empty")
+		opts        = make(options)
+	)
+	flags.Var(opts, "opt", "backend option as key=value, may be repeated")
+	if err := flags.Parse(args); err != nil {
+		return errors.E(op, errors.Invalid, err)
+	}
+	if util.Exists(env.Fs, config.KeyFile) {
+		return errors.E(op, errors.Exist, "this machine is already initialised, remove the key file to start over")
+	}
+
+	if *root != "" || *backendName != "" {
+		if err := mergeConfig(env.Fs, *root, *backendName); err != nil {
+			return errors.E(op, err)
+		}
+	}
+	cfg, err := config.LoadConfigFile(env)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := backend.Setup(env, cfg.UseBackend, opts); err != nil {
+		return errors.E(op, err)
+	}
+
+	ctx := context.Background()
+	srv, err := backend.Open(env, cfg.UseBackend)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if *join {
+		raw, err := remote.New(srv, env.Fs, cfg.RootFilepath, nil).FetchKeyFile(ctx)
+		var secret stream.Secret
+		switch {
+		case err == nil:
+			password, err := readPassword(env, "Password of the share: ")
+			if err != nil {
+				return errors.E(op, err)
+			}
+			if secret, err = stream.UnwrapKey(raw, password); err != nil {
+				return errors.E(op, err)
+			}
+		case err == remote.ErrNoKeyFile:
+			// the share was created before keys were protected with a
+			// password, the key file is added below. Its names stay
+			// unkeyed.
+			if secret.Key, err = readShareKey(env, *keyArg); err != nil {
+				return errors.E(op, err)
+			}
+			raw = nil
+		default:
+			return errors.E(op, err)
+		}
+
+		// fetching the index verifies that the key matches the share.
+		r, err := openRemote(env, cfg, srv, secret)
+		if err != nil {
+			return errors.E(op, err)
+		}
+		sun, err := r.LatestSun(ctx)
+		if err != nil {
+			return errors.E(op, err)
+		}
+		if _, err := r.FetchIndex(ctx, sun); err != nil {
+			return errors.E(op, errors.Errorf("cannot read the remote index, is the key correct? %v", err))
+		}
+		if raw == nil {
+			fmt.Fprintln(env.Stdout, "The share has no password yet, choose one for all machines.")
+			if raw, err = wrapKey(env, secret); err != nil {
+				return errors.E(op, err)
+			}
+			if err := r.StoreKeyFile(ctx, raw); errors.Is(errors.Exist, err) {
+				return errors.E(op, errors.Exist, "another machine set the password of the share in the meantime, run init -join again")
+			} else if err != nil {
+				return errors.E(op, err)
+			}
+		}
+		if err := storeKey(env.Fs, raw); err != nil {
+			return errors.E(op, err)
+		}
+		fmt.Fprintln(env.Stdout, "Joined the share. Run sync to download it.")
+		return nil
+	}
+
+	key, err := generateKey()
+	if err != nil {
+		return errors.E(op, err)
+	}
+	secret := stream.Secret{Key: key, KeyedNames: true}
+	raw, err := wrapKey(env, secret)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	r, err := openRemote(env, cfg, srv, secret)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if err := createShare(ctx, r, raw); err != nil {
+		return errors.E(op, err)
+	}
+	if err := storeKey(env.Fs, raw); err != nil {
+		return errors.E(op, errors.Errorf("the share was created on the remote, but the key cannot be stored on this machine, run init -join with the password: %v", err))
+	}
+	fmt.Fprintln(env.Stdout, `Created a new share. Other machines join it with "sharedHome init -join"
+and the password. Keep the password safe, nobody can recover your files without it.`)
+	return nil
+}
+
+// createShare uploads the key file raw and the first index to the remote of
+// r. The key file comes first, so that an interrupted init never leaves a
+// share that cannot be joined. Since the key file is created exclusively, of
+// machines that create a share at the same time only one gets past it. The
+// errors tell in which state the remote was left.
+func createShare(ctx context.Context, r *remote.Remote, raw []byte) error {
+	errShared := errors.E(errors.Exist, "the remote already contains a share, use -join to join it")
+	if _, err := r.LatestSun(ctx); err == nil {
+		return errShared
+	} else if !errors.Is(errors.NotExist, err) {
+		return err
+	}
+	if err := r.StoreKeyFile(ctx, raw); errors.Is(errors.Exist, err) {
+		// another machine created the share in the meantime.
+		return errShared
+	} else if err != nil {
+		return errors.Errorf("cannot upload the key file, the remote holds no share, run init again: %v", err)
+	}
+	if err := r.Init(ctx); err != nil {
+		// an index of another machine cannot be read with our key file.
+		if rErr := r.RemoveKeyFile(ctx); rErr != nil {
+			return errors.Errorf("cannot create the remote index: %v; the key file stays on the remote (%v), remove it and run init again", err, rErr)
+		}
+		if errors.Is(errors.Exist, err) {
+			return errShared
+		}
+		return errors.Errorf("cannot create the remote index, the key file was removed again, the remote holds no share: %v", err)
+	}
+	return nil
+}
+
+// mergeConfig sets the non-empty root and backendName in the config file and
+// keeps its other values. An empty config file gets the defaults of
+// config.NewConfig.
+func mergeConfig(fs osx.Fs, root, backendName string) error {
+	c, err := config.ReadConfigFile(fs)
+	if err != nil {
+		return err
+	}
+	if c.RootFilepath == "" && c.UseBackend == "" && c.IgnoreFilenames == nil {
+		c = config.NewConfig("", "")
+	}
+	if root != "" {
+		c.RootFilepath = root
+	}
+	if backendName != "" {
+		c.UseBackend = backendName
+	}
+	return config.StoreConfigFile(fs, c)
+}
+
+// wrapKey asks for a new password and returns the key file of s.
+func wrapKey(env config.Env, s stream.Secret) ([]byte, error) {
+	password, err := newPassword(env)
+	if err != nil {
+		return nil, err
+	}
+	return stream.WrapKey(s, password)
+}
+
+// readShareKey decodes the key encoded, which is asked for if it is empty.
+func readShareKey(env config.Env, encoded string) ([]byte, error) {
+	if encoded == "" {
+		fmt.Fprint(env.Stdout, "Key of the share: ")
+		var err error
+		encoded, err = readLine(env.Stdin)
+		if err != nil && encoded == "" {
+			return nil, err
+		}
+	}
+	return decodeKey(strings.TrimSpace(encoded))
+}
+
+// options is a flag.Value collecting key=value pairs.
+type options map[string]string
+
+func (o options) String() string {
+	pairs := make([]string, 0, len(o))
+	for k, v := range o {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (o options) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i < 1 {
+		return errors.Errorf("option %q is not of the form key=value", s)
+	}
+	o[s[:i]] = s[i+1:]
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/backend/local"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/testutil"
+)
+
+// failService fails to create the files whose name starts with prefix.
+type failService struct {
+	backend.Service
+	prefix string
+}
+
+func (f *failService) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	if strings.HasPrefix(h.HashName, f.prefix) {
+		return errors.E(errors.Permission, "create failed")
+	}
+	return f.Service.CreateFile(ctx, h, src)
+}
+
+// TestCreateShare checks that a failed init leaves a remote that can be
+// initialised again.
+func TestCreateShare(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	if err := fs.MkdirAll("/backend", 0700); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := local.New(fs, "/backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte("wrapped key")
+
+	failing := remote.New(&failService{Service: srv, prefix: "0"}, fs, "/", testKeys)
+	if err := createShare(ctx, failing, raw); err == nil || !strings.Contains(err.Error(), "key file was removed") {
+		t.Fatalf("want the removed key file reported, got %v", err)
+	}
+	r := remote.New(srv, fs, "/", testKeys)
+	if _, err := r.FetchKeyFile(ctx); err != remote.ErrNoKeyFile {
+		t.Errorf("want no key file, got %v", err)
+	}
+
+	if err := createShare(ctx, r, raw); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.FetchKeyFile(ctx); err != nil || string(got) != string(raw) {
+		t.Errorf("want %q, got %q %v", raw, got, err)
+	}
+	if sun, err := r.LatestSun(ctx); err != nil || sun != 0 {
+		t.Errorf("want sun 0, got %d %v", sun, err)
+	}
+	if err := createShare(ctx, r, []byte("other key")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if got, _ := r.FetchKeyFile(ctx); string(got) != string(raw) {
+		t.Errorf("key file of the share replaced by %q", got)
+	}
+
+	// of machines creating a share at the same time only one succeeds and
+	// its key file is kept.
+	if err := fs.MkdirAll("/concurrent", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if srv, err = local.New(fs, "/concurrent"); err != nil {
+		t.Fatal(err)
+	}
+	const n = 8
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = createShare(ctx, remote.New(srv, fs, "/", testKeys), []byte(fmt.Sprintf("key %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && winner == -1:
+			winner = i
+		case err == nil:
+			t.Errorf("both %d and %d created the share", winner, i)
+		case !errors.Is(errors.Exist, err):
+			t.Errorf("%d: want Exist, got %v", i, err)
+		}
+	}
+	if winner == -1 {
+		t.Fatal("no share created")
+	}
+	r = remote.New(srv, fs, "/", testKeys)
+	if got, err := r.FetchKeyFile(ctx); err != nil || string(got) != fmt.Sprintf("key %d", winner) {
+		t.Errorf("want the key file of %d, got %q %v", winner, got, err)
+	}
+	if sun, err := r.LatestSun(ctx); err != nil || sun != 0 {
+		t.Errorf("want sun 0, got %d %v", sun, err)
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	defer testutil.RemoveAllTestFiles(t)
+	fs := osx.NewMemMapFs()
+	config.InitVars(fs, filepath.Join(testutil.TestDir(fs), ".config"))
+	defer config.Delete(fs, config.D_ConfigFolder)
+
+	// an empty config file gets the defaults.
+	if err := mergeConfig(fs, "/home/a", ""); err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.ReadConfigFile(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := config.NewConfig("/home/a", ""); !reflect.DeepEqual(c, want) {
+		t.Errorf("want %+v, got %+v", want, c)
+	}
+
+	c.IgnoreFilenames = []string{"node_modules"}
+	if err := config.StoreConfigFile(fs, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeConfig(fs, "", "local"); err != nil {
+		t.Fatal(err)
+	}
+	c, err = config.ReadConfigFile(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &config.Config{RootFilepath: "/home/a", UseBackend: "local", IgnoreFilenames: []string{"node_modules"}}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("want %+v, got %+v", want, c)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/stream"
+	"golang.org/x/term"
+)
+
+// keySize selects AES-256.
+const keySize = stream.KEY_SIZE
+
+// passwordEnv is the environment variable that provides the password of the
+// share if it is set, e. g. for unattended synchronisation.
+const passwordEnv = "SHAREDHOME_PASSWORD"
+
+// generateKey returns a new random key.
+func generateKey() ([]byte, error) {
+	return stream.NewKey()
+}
+
+// loadKey reads the key file written by init and unlocks it with the
+// password. Machines that joined before keys were protected with a password
+// store the plain key.
+func loadKey(env config.Env) (stream.Secret, error) {
+	const op = errors.Op("main.loadKey")
+	raw, err := env.Fs.ReadFile(config.KeyFile)
+	if err != nil {
+		return stream.Secret{}, errors.E(op, errors.NotExist, "no key found, run init first")
+	}
+	if len(raw) == keySize {
+		return stream.Secret{Key: raw}, nil
+	}
+	password, err := readPassword(env, "Password of the share: ")
+	if err != nil {
+		return stream.Secret{}, errors.E(op, err)
+	}
+	secret, err := stream.UnwrapKey(raw, password)
+	if err != nil {
+		return stream.Secret{}, errors.E(op, err)
+	}
+	return secret, nil
+}
+
+// openRemote returns the remote of the share with the secret s.
+func openRemote(env config.Env, cfg *config.Config, srv backend.Service, s stream.Secret) (*remote.Remote, error) {
+	keys, err := stream.DeriveKeys(s.Key)
+	if err != nil {
+		return nil, err
+	}
+	r := remote.New(srv, env.Fs, cfg.RootFilepath, keys)
+	r.SetKeyedNames(s.KeyedNames)
+	return r, nil
+}
+
+// storeKey writes the key file raw, see stream.WrapKey.
+func storeKey(fs osx.Fs, raw []byte) error {
+	return fs.WriteFile(config.KeyFile, raw, 0600)
+}
+
+// decodeKey decodes the printable form of the key, which init printed before
+// keys were protected with a password.
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != keySize {
+		return nil, errors.E(errors.Invalid, "malformed key")
+	}
+	return key, nil
+}
+
+// readPassword returns the value of passwordEnv or else asks for the
+// password. The input is not echoed if it comes from a terminal.
+func readPassword(env config.Env, prompt string) (string, error) {
+	if password := os.Getenv(passwordEnv); password != "" {
+		return password, nil
+	}
+	fmt.Fprint(env.Stdout, prompt)
+	var (
+		password string
+		err      error
+	)
+	if f, ok := env.Stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		var raw []byte
+		raw, err = term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(env.Stdout)
+		password = string(raw)
+	} else {
+		password, err = readLine(env.Stdin)
+	}
+	if password = strings.TrimRight(password, "\r\n"); password == "" {
+		if err == nil || err == io.EOF {
+			err = errors.Str("no password given")
+		}
+		return "", errors.E(errors.Invalid, err)
+	}
+	return password, nil
+}
+
+// newPassword asks for the password of a new key file twice.
+func newPassword(env config.Env) (string, error) {
+	if password := os.Getenv(passwordEnv); password != "" {
+		return password, nil
+	}
+	password, err := readPassword(env, "New password of the share: ")
+	if err != nil {
+		return "", err
+	}
+	again, err := readPassword(env, "Repeat the password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != again {
+		return "", errors.E(errors.Invalid, "the passwords do not match")
+	}
+	return password, nil
+}
+
+// readLine reads r up to the next newline. Unlike a bufio.Reader, it does not
+// read ahead, so that r can be read from again.
+func readLine(r io.Reader) (string, error) {
+	var (
+		line []byte
+		b    = make([]byte, 1)
+	)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
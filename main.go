@@ -1,11 +1,18 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"os"
 
 	"github.com/liamvdv/sharedHome/config"
 	"github.com/liamvdv/sharedHome/osx"
+
+	// register the backends, see backend.Register.
+	_ "github.com/liamvdv/sharedHome/backend/drive"
+	_ "github.com/liamvdv/sharedHome/backend/local"
+	_ "github.com/liamvdv/sharedHome/backend/s3"
+	_ "github.com/liamvdv/sharedHome/backend/sftp"
+	_ "github.com/liamvdv/sharedHome/backend/webdav"
 )
 
 func main() {
@@ -15,33 +22,59 @@ func main() {
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
 	}
-	config.InitVars(env.Fs, "")
+	// os.Exit does not run deferred functions, thus run cleans up first.
+	os.Exit(run(env, "", os.Args[1:]))
+}
+
+// run executes the command args and returns the exit code. The config
+// folder is created in configDir, see config.InitVars.
+func run(env config.Env, configDir string, args []string) int {
+	config.InitVars(env.Fs, configDir)
 	defer config.Delete(env.Fs, config.D_TempCacheFolder)
 
-	cfg, err := config.LoadConfigFile(env)
-	if err != nil {
-		log.Panic(err)
+	if len(args) < 1 {
+		fmt.Fprintln(env.Stderr, "usage: sharedHome <sync|init|config|show|unlock> [arguments]")
+		return 2
 	}
 
 	// start signal module -> should panic so that all cleanup functions can run
 	// recover here in main for clean exit.
 
-	if len(os.Args) < 2 {
-		log.Println("min 2 args")
-	}
-	switch os.Args[1] {
-	case "sync":
-		Sync(env, cfg)
+	var err error
+	switch args[0] {
 	case "init":
+		// init creates the config file itself.
+		err = Init(env, args[1:])
+	case "sync":
+		err = withConfig(env, func(cfg *config.Config) error {
+			return Sync(env, cfg)
+		})
 	case "config":
+		err = Config(env, args[1:])
 	case "show":
+		err = withConfig(env, func(cfg *config.Config) error {
+			return Show(env, cfg, args[1:])
+		})
 	case "unlock":
+		err = withConfig(env, func(cfg *config.Config) error {
+			return Unlock(env, cfg, args[1:])
+		})
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(env.Stderr, err)
+		return 1
 	}
+	return 0
 }
 
-func Sync(env config.Env, cfg *config.Config) {
-	// 1. build local index
-	// 1. get remote index -> mutex, ... defer index.Upload()
-
-	// 2. use core packge to look at both indexes and then make the needed changes.
+// withConfig loads the config file, prompting the user if it's invalid, and
+// passes it to cmd.
+func withConfig(env config.Env, cmd func(cfg *config.Config) error) error {
+	cfg, err := config.LoadConfigFile(env)
+	if err != nil {
+		return err
+	}
+	return cmd(cfg)
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/util"
+)
+
+// machine runs commands with its own config folder, like another computer
+// sharing fs.
+type machine struct {
+	t         *testing.T
+	fs        osx.Fs
+	configDir string
+}
+
+// run runs the command args with stdin as input. It fails t if the exit code
+// is not want and returns the output of the command.
+func (m *machine) run(want int, stdin string, args ...string) string {
+	m.t.Helper()
+	var out bytes.Buffer
+	env := config.Env{Fs: m.fs, Stdin: strings.NewReader(stdin), Stdout: &out, Stderr: &out}
+	if code := run(env, m.configDir, args); code != want {
+		m.t.Fatalf("%v: want exit code %d, got %d:\n%s", args, want, code, out.String())
+	}
+	return out.String()
+}
+
+func TestRunErrors(t *testing.T) {
+	m := &machine{t: t, fs: osx.NewMemMapFs(), configDir: "/alice/.config"}
+	if out := m.run(1, "", "frobnicate"); !strings.Contains(out, `unknown command "frobnicate"`) {
+		t.Errorf("want the error printed, got %q", out)
+	}
+	m.run(2, "")
+	if out := m.run(1, "", "init", "-undefined"); !strings.Contains(out, "-undefined") {
+		t.Errorf("want the flag error printed, got %q", out)
+	}
+	// the temporary files are removed after an error, too.
+	if util.Exists(m.fs, config.TempCacheFolder) {
+		t.Errorf("%s not removed", config.TempCacheFolder)
+	}
+}
+
+// TestSync shares a directory between two machines through the local
+// backend.
+func TestSync(t *testing.T) {
+	fs := osx.NewMemMapFs()
+	for _, dp := range []string{"/backend", "/alice/home/docs", "/bob/home"} {
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.WriteFile("/alice/home/docs/a.txt", []byte("from alice"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// left behind by a download that crashed.
+	part := "/docs/.a.txt.123" + config.PartialFileSuffix
+	if err := fs.WriteFile("/alice/home"+part, []byte("from al"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	alice := &machine{t: t, fs: fs, configDir: "/alice/.config"}
+	bob := &machine{t: t, fs: fs, configDir: "/bob/.config"}
+
+	alice.run(0, "secret\nsecret\n", "init", "-root", "/alice/home", "-backend", "local", "-opt", "Dirpath=/backend")
+	bob.run(1, "wrong\n", "init", "-join", "-root", "/bob/home", "-backend", "local", "-opt", "Dirpath=/backend")
+	bob.run(0, "secret\n", "init", "-join", "-root", "/bob/home", "-backend", "local", "-opt", "Dirpath=/backend")
+
+	alice.run(0, "secret\n", "sync")
+	// bob has not synchronised yet, thus has no cached index.
+	if out := bob.run(0, "secret\n", "show", "-remote"); !strings.Contains(out, "/docs/a.txt") {
+		t.Errorf("want the remote index listed, got %q", out)
+	}
+	bob.run(1, "", "show", "-base")
+	bob.run(0, "secret\n", "sync")
+	if out := bob.run(0, "", "show", "-base"); !strings.Contains(out, "/docs/a.txt") {
+		t.Errorf("want the cached index listed, got %q", out)
+	}
+	if got, err := fs.ReadFile("/bob/home/docs/a.txt"); err != nil || string(got) != "from alice" {
+		t.Fatalf("want %q, got %q %v", "from alice", got, err)
+	}
+	if util.Exists(fs, "/bob/home"+part) {
+		t.Error("partial download synchronised")
+	}
+
+	if err := fs.WriteFile("/bob/home/b.txt", []byte("from bob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/bob/home/docs/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	bob.run(0, "secret\n", "sync")
+	alice.run(0, "secret\n", "sync")
+	if got, err := fs.ReadFile("/alice/home/b.txt"); err != nil || string(got) != "from bob" {
+		t.Errorf("want %q, got %q %v", "from bob", got, err)
+	}
+	if util.Exists(fs, "/alice/home/docs/a.txt") {
+		t.Error("deleted file not deleted on the other machine")
+	}
+	if out := alice.run(0, "secret\n", "sync"); !strings.Contains(out, "0 tasks done, 0 failed.") {
+		t.Errorf("want nothing to do, got %q", out)
+	}
+}
@@ -0,0 +1,145 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+/*
+	The remote root folder contains the encrypted file tree with hashed names
+	and the encrypted index files, named after config.IndexFileTemplate. Every
+	successful synchronisation that changes the remote uploads a new index with
+	the next sequential update number (sun). The index with the highest sun is
+	the current one. A client must hold the lock of the current sun, named after
+	config.LockIndexFileTemplate, while it synchronises, see lock.go.
+*/
+
+// rootDir is the remote root folder.
+var rootDir = backend.RemoteFile{
+	HashRelpath: "/",
+	Local:       &vfs.File{Relpath: "/", Mode: os.ModeDir | 0700},
+}
+
+// ErrNoIndex is returned if the remote has not been initialised.
+var ErrNoIndex = errors.E(errors.NotExist, "remote has no index, run init first")
+
+// ErrInitialised is returned by Init if the remote already has an index.
+var ErrInitialised = errors.E(errors.Exist, "remote already contains a sharedHome index")
+
+// Init creates the remote root folder and uploads an empty index with the
+// sequential update number 0. It returns ErrInitialised if the remote already
+// has an index.
+func (r *Remote) Init(ctx context.Context) error {
+	const op = errors.Op("remote.Init")
+	if err := r.createDir(ctx, rootDir); err != nil && !errors.Is(errors.Exist, err) {
+		return errors.E(op, err)
+	}
+	_, err := r.LatestSun(ctx)
+	if err == nil {
+		return errors.E(op, ErrInitialised)
+	}
+	if err != ErrNoIndex {
+		return errors.E(op, err)
+	}
+	empty := vfs.NewFromMemory(&vfs.File{
+		Relpath:  "/",
+		Mode:     os.ModeDir | 0700,
+		Children: []vfs.File{},
+	})
+	if err := r.StoreIndex(ctx, empty, 0); err != nil {
+		return errors.E(op, err)
+	}
+	return nil
+}
+
+// LatestSun returns the highest sequential update number of all remote index
+// files. It returns ErrNoIndex if there is no index file.
+func (r *Remote) LatestSun(ctx context.Context) (int, error) {
+	const op = errors.Op("remote.LatestSun")
+	names, err := r.rootNames(ctx)
+	if err != nil {
+		return 0, errors.E(op, err)
+	}
+	sun := -1
+	for _, name := range names {
+		if n, ok := parseSun(name, config.IndexFileTemplate); ok && n > sun {
+			sun = n
+		}
+	}
+	if sun < 0 {
+		return 0, ErrNoIndex
+	}
+	return sun, nil
+}
+
+// FetchIndex downloads, verifies and decodes the index with the sequential
+// update number sun.
+func (r *Remote) FetchIndex(ctx context.Context, sun int) (*vfs.FileIndex, error) {
+	const op = errors.Op("remote.FetchIndex")
+	h := plainFile(fmt.Sprintf(config.IndexFileTemplate, sun))
+	raw, err := r.getBytes(ctx, h)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	// the identity binds the index to its sun.
+	plain, err := decrypt(raw, r.keys, h.Local.Relpath)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	index, err := vfs.Load(bytes.NewReader(plain))
+	if err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	return index, nil
+}
+
+// StoreIndex encrypts and uploads the index as the index with the sequential
+// update number sun. It fails with an error of kind errors.Exist if the
+// remote has an index with this sun already, it never replaces an index.
+func (r *Remote) StoreIndex(ctx context.Context, index *vfs.FileIndex, sun int) error {
+	const op = errors.Op("remote.StoreIndex")
+	var buf bytes.Buffer
+	if err := index.Store(&buf); err != nil {
+		return errors.E(op, err)
+	}
+	h := plainFile(fmt.Sprintf(config.IndexFileTemplate, sun))
+	enc, err := encrypt(buf.Bytes(), r.keys, h.Local.Relpath)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if err := r.create(ctx, h, enc); err != nil {
+		return errors.E(op, err)
+	}
+	return nil
+}
+
+// rootNames returns the names of all files in the remote root folder.
+func (r *Remote) rootNames(ctx context.Context) ([]string, error) {
+	root, err := r.readDir(ctx, rootDir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(root.Children))
+	for _, child := range root.Children {
+		names = append(names, path.Base(child.Relpath))
+	}
+	return names, nil
+}
+
+// parseSun returns the sequential update number of name, if name matches the
+// template exactly.
+func parseSun(name, template string) (int, bool) {
+	var n int
+	if _, err := fmt.Sscanf(name, template, &n); err != nil {
+		return 0, false
+	}
+	return n, name == fmt.Sprintf(template, n)
+}
@@ -0,0 +1,56 @@
+package remote
+
+import (
+	"context"
+
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+)
+
+/*
+	The remote root folder contains the key file of the share, named
+	config.RemoteKeyFile. It is the master key wrapped with a password, see
+	stream.WrapKey, and allows other machines to join with the password alone.
+	Neither function needs the key of the Remote.
+*/
+
+// ErrNoKeyFile is returned by FetchKeyFile if the share has no key file,
+// e. g. because it was created before keys were protected with a password.
+var ErrNoKeyFile = errors.E(errors.NotExist, "remote has no key file")
+
+// FetchKeyFile downloads the key file of the share.
+func (r *Remote) FetchKeyFile(ctx context.Context) ([]byte, error) {
+	const op = errors.Op("remote.FetchKeyFile")
+	raw, err := r.getBytes(ctx, plainFile(config.RemoteKeyFile))
+	if errors.Is(errors.NotExist, err) {
+		return nil, ErrNoKeyFile
+	}
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	return raw, nil
+}
+
+// StoreKeyFile uploads the key file of the share. It never replaces a key
+// file: if the share has one, e. g. because another machine initialised it
+// at the same time, it fails with errors.Exist. It creates the remote root
+// folder if necessary.
+func (r *Remote) StoreKeyFile(ctx context.Context, raw []byte) error {
+	const op = errors.Op("remote.StoreKeyFile")
+	if err := r.createDir(ctx, rootDir); err != nil && !errors.Is(errors.Exist, err) {
+		return errors.E(op, err)
+	}
+	if err := r.create(ctx, plainFile(config.RemoteKeyFile), raw); err != nil {
+		return errors.E(op, err)
+	}
+	return nil
+}
+
+// RemoveKeyFile deletes the key file of the share.
+func (r *Remote) RemoveKeyFile(ctx context.Context) error {
+	const op = errors.Op("remote.RemoveKeyFile")
+	if err := r.deleteFile(ctx, plainFile(config.RemoteKeyFile)); err != nil {
+		return errors.E(op, err)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+)
+
+/*
+	A lock is a file named after config.LockIndexFileTemplate for the current
+	sequential update number. It stores the encrypted LockInfo of its holder.
+	Locks expire, so that a crashed client does not block all others forever.
+	Long running holders must Refresh their lock before it expires.
+
+	The lock file is created with the exclusive create of backend.FileCreator.
+	Since some backends see their own writes late, we read it back and compare
+	the random token to detect a concurrent holder.
+
+	Breaking a stale lock is not atomic: backends cannot delete a file only if
+	it is unchanged. We re-read the lock and compare its token right before
+	the delete, but if another client breaks and re-creates the lock in
+	between, we delete its fresh lock and both may hold it. The window spans
+	a single request and only opens once a holder let its lock expire.
+*/
+
+// LockTTL is the default time until a lock expires if it is not refreshed.
+const LockTTL = 10 * time.Minute
+
+// LockInfo describes the holder of a lock.
+type LockInfo struct {
+	Sun      int
+	Holder   string
+	Host     string
+	PID      int
+	Acquired time.Time
+	Expires  time.Time
+	// Token identifies a single acquisition.
+	Token string
+}
+
+// Stale returns true if the lock has expired at now.
+func (l *LockInfo) Stale(now time.Time) bool {
+	return now.After(l.Expires)
+}
+
+func (l *LockInfo) String() string {
+	return fmt.Sprintf("lock of index %d held by %s@%s (pid %d) since %s, expires %s",
+		l.Sun, l.Holder, l.Host, l.PID, l.Acquired.Format(time.RFC3339), l.Expires.Format(time.RFC3339))
+}
+
+// Lock is an acquired remote lock.
+type Lock struct {
+	r   *Remote
+	ttl time.Duration
+
+	mu   sync.Mutex
+	info LockInfo
+}
+
+// AcquireLock acquires the lock for sun that expires after ttl. Stale locks
+// are broken. If another client holds a fresh lock, it fails with
+// an error of kind errors.Exist. Mutual exclusion relies on the exclusive
+// create of backend.FileCreator.
+func (r *Remote) AcquireLock(ctx context.Context, sun int, ttl time.Duration) (*Lock, error) {
+	const op = errors.Op("remote.AcquireLock")
+	held, err := r.ReadLock(ctx, sun)
+	switch {
+	case err == nil && !held.Stale(time.Now()):
+		return nil, errors.E(op, errors.Exist, errors.Errorf("remote is locked: %s", held))
+	case err == nil:
+		if err := r.breakStaleLock(ctx, held); err != nil {
+			return nil, errors.E(op, err)
+		}
+	case !errors.Is(errors.NotExist, err):
+		// we cannot tell whether an unreadable lock is stale.
+		return nil, errors.E(op, err)
+	}
+
+	info, err := newLockInfo(sun, ttl)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	if err := r.writeLock(ctx, info, false); errors.Is(errors.Exist, err) {
+		return nil, errors.E(op, errors.Exist, "remote is locked by another client")
+	} else if err != nil {
+		return nil, errors.E(op, err)
+	}
+	// a backend that does not see its own writes at once may still show the
+	// lock of a broken holder.
+	got, err := r.ReadLock(ctx, sun)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	if got.Token != info.Token {
+		return nil, errors.E(op, errors.Exist, errors.Errorf("remote is locked: %s", got))
+	}
+	return &Lock{r: r, ttl: ttl, info: *info}, nil
+}
+
+// ReadLock returns the current lock for sun. It fails with errors.NotExist if
+// there is none.
+func (r *Remote) ReadLock(ctx context.Context, sun int) (*LockInfo, error) {
+	const op = errors.Op("remote.ReadLock")
+	h := plainFile(lockName(sun))
+	raw, err := r.getBytes(ctx, h)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	plain, err := decrypt(raw, r.keys, h.Local.Relpath)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	var info LockInfo
+	if err := json.Unmarshal(plain, &info); err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	return &info, nil
+}
+
+// Locks returns the sequential update numbers of all lock files in ascending
+// order.
+func (r *Remote) Locks(ctx context.Context) ([]int, error) {
+	const op = errors.Op("remote.Locks")
+	names, err := r.rootNames(ctx)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	var suns []int
+	for _, name := range names {
+		if n, ok := parseSun(name, config.LockIndexFileTemplate); ok {
+			suns = append(suns, n)
+		}
+	}
+	sort.Ints(suns)
+	return suns, nil
+}
+
+// BreakLock removes the lock for sun regardless of its holder.
+func (r *Remote) BreakLock(ctx context.Context, sun int) error {
+	const op = errors.Op("remote.BreakLock")
+	if err := r.deleteFile(ctx, plainFile(lockName(sun))); err != nil {
+		return errors.E(op, err)
+	}
+	return nil
+}
+
+// breakStaleLock removes the stale lock held unless another client replaced
+// it since it was read, in which case it fails with errors.Exist.
+func (r *Remote) breakStaleLock(ctx context.Context, held *LockInfo) error {
+	got, err := r.ReadLock(ctx, held.Sun)
+	if errors.Is(errors.NotExist, err) {
+		// another client broke it already.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if got.Token != held.Token {
+		return errors.E(errors.Exist, errors.Errorf("remote is locked: %s", got))
+	}
+	if err := r.BreakLock(ctx, held.Sun); err != nil && !errors.Is(errors.NotExist, err) {
+		return err
+	}
+	return nil
+}
+
+// Info returns a copy of the current lock information.
+func (l *Lock) Info() LockInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.info
+}
+
+// Refresh extends the expiry of the lock by its ttl. It fails if the lock was
+// broken by another client in the meantime.
+func (l *Lock) Refresh(ctx context.Context) error {
+	const op = errors.Op("remote.Lock.Refresh")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	got, err := l.r.ReadLock(ctx, l.info.Sun)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if got.Token != l.info.Token {
+		return errors.E(op, errors.Permission, "lock was taken over by another client")
+	}
+	info := l.info
+	info.Expires = time.Now().Add(l.ttl)
+	if err := l.r.writeLock(ctx, &info, true); err != nil {
+		return errors.E(op, err)
+	}
+	l.info = info
+	return nil
+}
+
+// Release removes the lock if it is still held by us.
+func (l *Lock) Release(ctx context.Context) error {
+	const op = errors.Op("remote.Lock.Release")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	got, err := l.r.ReadLock(ctx, l.info.Sun)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if got.Token != l.info.Token {
+		return errors.E(op, errors.Permission, "lock was taken over by another client")
+	}
+	if err := l.r.BreakLock(ctx, l.info.Sun); err != nil {
+		return errors.E(op, err)
+	}
+	return nil
+}
+
+// writeLock writes info to its lock file. If replace is false, the lock file
+// must not exist, i. e. it fails with errors.Exist if another client holds
+// the lock.
+func (r *Remote) writeLock(ctx context.Context, info *LockInfo, replace bool) error {
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	h := plainFile(lockName(info.Sun))
+	enc, err := encrypt(raw, r.keys, h.Local.Relpath)
+	if err != nil {
+		return err
+	}
+	if !replace {
+		return r.create(ctx, h, enc)
+	}
+	return r.put(ctx, h, bytes.NewReader(enc), true)
+}
+
+func newLockInfo(sun int, ttl time.Duration) (*LockInfo, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	holder := "unknown"
+	if u, err := user.Current(); err == nil {
+		holder = u.Username
+	}
+	now := time.Now()
+	return &LockInfo{
+		Sun:      sun,
+		Holder:   holder,
+		Host:     host,
+		PID:      os.Getpid(),
+		Acquired: now,
+		Expires:  now.Add(ttl),
+		Token:    base64.RawURLEncoding.EncodeToString(token),
+	}, nil
+}
+
+func lockName(sun int) string {
+	return fmt.Sprintf(config.LockIndexFileTemplate, sun)
+}
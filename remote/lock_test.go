@@ -0,0 +1,122 @@
+package remote
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+)
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	srv := newMemService()
+	a := New(srv, osx.NewMemMapFs(), "/", testKey)
+	b := New(srv, osx.NewMemMapFs(), "/", testKey)
+
+	lock, err := a.AcquireLock(ctx, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AcquireLock(ctx, 3, time.Minute); !errors.Is(errors.Exist, err) {
+		t.Errorf("second lock must fail with errors.Exist, got %v", err)
+	}
+	info, err := b.ReadLock(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Token != lock.Info().Token || info.Sun != 3 || info.Host == "" || info.PID == 0 {
+		t.Errorf("unexpected lock info %+v", info)
+	}
+
+	before := lock.Info().Expires
+	if err := lock.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !lock.Info().Expires.After(before) {
+		t.Error("refresh must extend expiry")
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ReadLock(ctx, 3); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want released lock to be gone, got %v", err)
+	}
+	if _, err := b.AcquireLock(ctx, 3, time.Minute); err != nil {
+		t.Errorf("lock after release: %v", err)
+	}
+}
+
+func TestLockStale(t *testing.T) {
+	ctx := context.Background()
+	srv := newMemService()
+	a := New(srv, osx.NewMemMapFs(), "/", testKey)
+	b := New(srv, osx.NewMemMapFs(), "/", testKey)
+
+	stale, err := a.AcquireLock(ctx, 0, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := b.AcquireLock(ctx, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("stale lock must be broken: %v", err)
+	}
+	if err := stale.Refresh(ctx); !errors.Is(errors.Permission, err) {
+		t.Errorf("refresh of broken lock must fail with errors.Permission, got %v", err)
+	}
+	if err := stale.Release(ctx); err == nil {
+		t.Error("release of broken lock must not remove the new lock")
+	}
+	if err := fresh.Release(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestLockStaleRace checks that a client does not break a lock that another
+// client acquired after the stale lock was read.
+func TestLockStaleRace(t *testing.T) {
+	ctx := context.Background()
+	srv := newMemService()
+	a := New(srv, osx.NewMemMapFs(), "/", testKey)
+	b := New(srv, osx.NewMemMapFs(), "/", testKey)
+	c := New(srv, osx.NewMemMapFs(), "/", testKey)
+
+	if _, err := a.AcquireLock(ctx, 0, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	held, err := b.ReadLock(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := c.AcquireLock(ctx, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.breakStaleLock(ctx, held); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if got, err := b.ReadLock(ctx, 0); err != nil || got.Token != fresh.Info().Token {
+		t.Errorf("fresh lock broken: %+v %v", got, err)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	ctx := context.Background()
+	r := New(newMemService(), osx.NewMemMapFs(), "/", testKey)
+	for _, sun := range []int{4, 1} {
+		if _, err := r.AcquireLock(ctx, sun, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	suns, err := r.Locks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suns) != 2 || suns[0] != 1 || suns[1] != 4 {
+		t.Errorf("want locks [1 4], got %v", suns)
+	}
+}
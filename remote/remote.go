@@ -1,66 +1,428 @@
 package remote
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/retry"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
 )
 
-// need some channel to say that DownloadFailed.
-
-func Download(ctx context.Context, service backend.FileCreator, f backend.RemoteFile) {
-	
-}
-
-// func DownloadFile(ctx context.Context, enc *stream.Encryptor, remote backend.FileReader, h *fs.FileHeader, relpath string) {
-// 	hashFp := enc.HashFilepath(relpath)
-// 	rh := backend.RemoteFileHeader{
-// 		Relpath: hashFp,
-// 		Name: filepath.Base(hashFp),
-// 	}
-// 	dlpath := filepath.Join(config.Home, relpath[:len(relpath)-len(h.Name)], "~" + h.Name)
-// 	f, err := os.OpenFile(dlpath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
-// 	if err != nil {
-// 		if errs.Is(err, os.ErrExist) {
-// 			// cannot know if user uses tht prefix, thus cannot just overwrite.
-// 			log.Printf("Cannot download file %s to %q, because it would overwrite existing file %q.", h.Name, dlpath)
-// 			return
-// 		}
-// 		log.Printf("Unexpected error occured while opening file %q: %v\n", dlpath, err)
-// 		// state.FailedDownload(h) TODO(liamvdv): log this to state file. User should be informed
-// 		return
-// 	}
-// 	var success bool
-// 	defer func(fp string) {
-// 		if !success {
-// 			if err := os.Remove(dlpath); err != nil {
-// 				log.Printf("Cannot remove failed download fragment %q: %v\n", dlpath, err)
-// 			}
-// 			return
-// 		}
-// 	}(dlpath)
-
-// 	// TODO(liamvdv): Also wrap with compression.
-
-// 	dst, err := stream.NewStreamDecryptor(f, stream.DynamicStreamHeader, enc.Key())
-
-// 	err = retry.Do(3, retry.ExponentialBackoff, func() error {
-// 		if err := f.Seek(0, io.SeekStart); err != nil {
-// 			return retry.Stop
-// 		}
-// 		return remote.ReadFile(ctx, h, dst)
-// 	})
-
-// 	if err != nil {
-// 		log.Println("unable to download ...")
-// 		return
-// 	}
-// 	// ....
-// 	if err := os.Rename(dlpath, h.abspath); err != nil {
-// 		log.Println("Failed to replace file with complete download fragment.")
-// 		return
-// 	}
-// 	success = true
-// 	return
-
-// }
+// Remote is a common wrapper around a backend.Service. Everything that is sent
+// to the backend is encrypted, everything received is decrypted and verified.
+type Remote struct {
+	srv backend.Service
+	fs  osx.Fs
+	// root is the local root directory, i. e. config.Config.RootFilepath.
+	root  string
+	keys  *stream.Keys
+	retry retry.Policy
+	// keyedNames selects Keys.HashPath over the unkeyed stream.HashPath.
+	keyedNames bool
+}
+
+func New(srv backend.Service, fs osx.Fs, root string, keys *stream.Keys) *Remote {
+	return &Remote{
+		srv:   srv,
+		fs:    fs,
+		root:  root,
+		keys:  keys,
+		retry: retry.DefaultPolicy,
+	}
+}
+
+// SetKeyedNames selects if file names are hashed with the name key, see
+// stream.Secret. It must be called before any file is accessed.
+func (r *Remote) SetKeyedNames(keyed bool) {
+	r.keyedNames = keyed
+}
+
+// SetRetryPolicy replaces retry.DefaultPolicy for all backend calls.
+func (r *Remote) SetRetryPolicy(p retry.Policy) {
+	r.retry = p
+}
+
+// Upload uploads the local file f. Directories are only created, not their
+// children. If replace is set, the remote already has a version of f.
+// Files and directories that the remote index does not know, but that were
+// left behind by a failed upload, are replaced.
+func (r *Remote) Upload(ctx context.Context, f *vfs.File, replace bool) error {
+	const op = errors.Op("remote.Upload")
+	h := r.remoteFile(f)
+
+	if f.Mode.IsDir() {
+		if replace {
+			return nil
+		}
+		if err := r.createDir(ctx, h); err != nil && !errors.Is(errors.Exist, err) {
+			return errors.E(op, errors.Path(f.Relpath), err)
+		}
+		return nil
+	}
+
+	src, err := r.fs.Open(r.abspath(f))
+	if err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	defer src.Close()
+
+	tmp, err := r.encrypted(f, src)
+	if err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	err = r.put(ctx, h, tmp, replace)
+	if !replace && errors.Is(errors.Exist, err) {
+		err = r.put(ctx, h, tmp, true)
+	}
+	if err != nil {
+		// the next attempt sends the same bytes, so that the backend can
+		// resume the upload.
+		if retry.Temporary(err) || ctx.Err() != nil {
+			_ = tmp.Close()
+		} else {
+			r.removeTemp(tmp)
+		}
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	r.removeTemp(tmp)
+	return nil
+}
+
+// encrypted returns the encrypted content of the local file src for upload.
+// Encrypting into a file first allows to repeat a failed transfer without
+// encrypting again, see stream/alternativeProposal.txt. The file is kept in
+// config.UploadCacheFolder until the upload succeeded and reused as long as
+// the local file is unchanged, even by a later run. Since encryption is
+// randomised, that is what lets backends resume the upload.
+func (r *Remote) encrypted(f *vfs.File, src osx.File) (osx.File, error) {
+	fi, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+	prefix, name := r.uploadName(f.Relpath, fi)
+	fp := filepath.Join(config.UploadCacheFolder, name)
+	if cached, err := r.fs.Open(fp); err == nil {
+		return cached, nil
+	}
+	// encrypted older versions of the file are obsolete.
+	if entries, err := r.fs.ReadDir(config.UploadCacheFolder); err == nil {
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), prefix) {
+				_ = r.fs.Remove(filepath.Join(config.UploadCacheFolder, e.Name()))
+			}
+		}
+	}
+
+	tmp, err := r.fs.CreateTemp(config.UploadCacheFolder, name+".*.part")
+	if err != nil {
+		return nil, err
+	}
+	if err := encryptTo(tmp, src, r.keys, f.Relpath); err != nil {
+		r.removeTemp(tmp)
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		r.removeTemp(tmp)
+		return nil, err
+	}
+	if err := r.fs.Rename(tmp.Name(), fp); err != nil {
+		r.removeTemp(tmp)
+		return nil, err
+	}
+	return r.fs.Open(fp)
+}
+
+// uploadName returns the name of the encrypted file for the version fi of the
+// local file relpath and the prefix shared by all its versions.
+func (r *Remote) uploadName(relpath string, fi os.FileInfo) (prefix, name string) {
+	m := hmac.New(sha256.New, r.keys.Name)
+	fmt.Fprintf(m, "%s\x00%d %d %s", relpath, fi.ModTime().UnixNano(), fi.Size(), fi.Mode())
+	prefix = r.uploadPrefix(relpath)
+	return prefix, fmt.Sprintf("%s%x", prefix, m.Sum(nil)[:8])
+}
+
+// uploadPrefix returns the prefix of the encrypted files of relpath. It is
+// keyed, so that the cache does not reveal which files are uploaded.
+func (r *Remote) uploadPrefix(relpath string) string {
+	m := hmac.New(sha256.New, r.keys.Name)
+	m.Write([]byte(relpath))
+	return fmt.Sprintf("upload-%x-", m.Sum(nil)[:8])
+}
+
+// PruneUploads removes the encrypted files kept in config.UploadCacheFolder
+// for files that are not in the local index, e. g. because they were deleted
+// before their upload succeeded.
+func (r *Remote) PruneUploads(index *vfs.FileIndex) error {
+	const op = errors.Op("remote.PruneUploads")
+	entries, err := r.fs.ReadDir(config.UploadCacheFolder)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.E(op, err)
+	}
+	keep := make(map[string]bool)
+	index.Mu.RLock()
+	for _, dir := range index.Files {
+		for _, c := range dir.Children {
+			if !c.Mode.IsDir() {
+				keep[r.uploadPrefix(c.Relpath)] = true
+			}
+		}
+	}
+	index.Mu.RUnlock()
+	n := len(r.uploadPrefix(""))
+	for _, e := range entries {
+		if len(e.Name()) >= n && keep[e.Name()[:n]] {
+			continue
+		}
+		if err := r.fs.Remove(filepath.Join(config.UploadCacheFolder, e.Name())); err != nil {
+			return errors.E(op, err)
+		}
+	}
+	return nil
+}
+
+// Download downloads the remote file f and applies its mode and modification
+// time. Directories are only created, not their children.
+// Files are downloaded to a temporary file, then verified and decrypted next
+// to their destination and renamed into place. Thus the local
+// file is either replaced completely or not at all.
+func (r *Remote) Download(ctx context.Context, f *vfs.File) error {
+	const op = errors.Op("remote.Download")
+	fp := r.abspath(f)
+
+	if f.Mode.IsDir() {
+		if err := r.fs.MkdirAll(fp, f.Mode.Perm()); err != nil {
+			return errors.E(op, errors.Path(f.Relpath), err)
+		}
+		return r.applyMetadata(op, fp, f)
+	}
+
+	enc, err := r.fs.CreateTemp(config.TempCacheFolder, "download-*")
+	if err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	defer r.removeTemp(enc)
+	if err := r.get(ctx, r.remoteFile(f), enc, f.Relpath); err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+
+	// The partial file must be in the same directory to be renamed atomically.
+	// It is not synchronised, see config.PartialFileSuffix.
+	dir, name := filepath.Split(fp)
+	part, err := r.fs.CreateTemp(dir, "."+name+".*"+config.PartialFileSuffix)
+	if err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			r.removeTemp(part)
+		}
+	}()
+	if err := decryptTo(part, enc, r.keys, f.Relpath); err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	if err := part.Close(); err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	if err := r.applyMetadata(op, part.Name(), f); err != nil {
+		return err
+	}
+	if err := r.fs.Rename(part.Name(), fp); err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	renamed = true
+	return nil
+}
+
+// Delete deletes the remote file f. Directories are deleted recursively.
+func (r *Remote) Delete(ctx context.Context, f *vfs.File) error {
+	const op = errors.Op("remote.Delete")
+	var err error
+	if f.Mode.IsDir() {
+		err = r.deleteDir(ctx, r.remoteFile(f))
+	} else {
+		err = r.deleteFile(ctx, r.remoteFile(f))
+	}
+	if err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	return nil
+}
+
+// applyMetadata sets mode and modification time of f to the file at fp.
+func (r *Remote) applyMetadata(op errors.Op, fp string, f *vfs.File) error {
+	if err := r.fs.Chmod(fp, f.Mode.Perm()); err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	if err := r.fs.Chtimes(fp, time.Now(), time.Unix(0, f.MTime)); err != nil {
+		return errors.E(op, errors.Path(f.Relpath), err)
+	}
+	return nil
+}
+
+// removeTemp closes and removes the temporary file f.
+func (r *Remote) removeTemp(f osx.File) {
+	_ = f.Close()
+	if err := r.fs.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+		log.Printf("cannot remove temporary file %q: %v\n", f.Name(), err)
+	}
+}
+
+func (r *Remote) abspath(f *vfs.File) string {
+	return filepath.Join(r.root, filepath.FromSlash(f.Relpath))
+}
+
+// remoteFile returns the backend representation of f with hashed names.
+func (r *Remote) remoteFile(f *vfs.File) backend.RemoteFile {
+	hp := stream.HashPath(f.Relpath)
+	if r.keyedNames {
+		hp = r.keys.HashPath(f.Relpath)
+	}
+	return backend.RemoteFile{
+		HashRelpath: hp,
+		HashName:    path.Base(hp),
+		Local:       f,
+	}
+}
+
+// plainFile returns the backend representation of an unhashed file in the
+// remote root folder, e. g. the index files.
+func plainFile(name string) backend.RemoteFile {
+	return backend.RemoteFile{
+		HashRelpath: "/" + name,
+		HashName:    name,
+		Local: &vfs.File{
+			Relpath: "/" + name,
+			MTime:   time.Now().UnixNano(),
+			Mode:    0600,
+		},
+	}
+}
+
+// encryptTo writes the compressed and encrypted form of src to dst, see
+// stream.NewCompressedEncryption. identity is the plaintext path of the file,
+// its extension and the first bytes of src select the compression.
+func encryptTo(dst io.Writer, src io.Reader, keys *stream.Keys, identity string) error {
+	br := bufio.NewReaderSize(src, stream.SNIFF_SIZE)
+	head, err := br.Peek(stream.SNIFF_SIZE)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	algorithm := stream.ChooseCompression(identity, head)
+	enc, err := stream.NewCompressedEncryption(br, keys, identity, algorithm)
+	if err != nil {
+		return err
+	}
+	if _, err := enc.Header().WriteTo(dst); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, enc)
+	return err
+}
+
+// decryptTo decrypts the data produced by encryptTo that is read from src.
+// Only authentic content is written to dst, but if decryption fails, dst may
+// hold the authentic content before the failure.
+func decryptTo(dst io.Writer, src io.ReadSeeker, keys *stream.Keys, identity string) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h, err := stream.ReadHeader(src)
+	if err != nil {
+		return errors.E(errors.Invalid, err)
+	}
+	if !stream.Chunked(*h) {
+		return decryptMacTo(dst, src, keys, *h)
+	}
+	var dec io.Reader
+	dec, err = stream.NewChunkDecryption(keys, src, *h, identity, 0)
+	if err != nil {
+		return err
+	}
+	if h.Version == stream.VERSION_4 {
+		if dec, err = stream.NewDecompression(dec); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(dst, dec)
+	return err
+}
+
+// decryptMacTo decrypts files of the versions that are not chunked, which
+// have a footer with the MAC of the whole content. Nothing is written to dst
+// unless the MAC is valid.
+func decryptMacTo(dst io.Writer, src io.ReadSeeker, keys *stream.Keys, h stream.EncryptionHeader) error {
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < int64(stream.HEADER_SIZE+stream.MAC_SIZE) {
+		return errors.E(errors.Invalid, "encrypted data is truncated")
+	}
+	bodySize := size - int64(stream.HEADER_SIZE+stream.MAC_SIZE)
+
+	mac := make([]byte, stream.MAC_SIZE)
+	if _, err := src.Seek(-int64(stream.MAC_SIZE), io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(src, mac); err != nil {
+		return err
+	}
+	if _, err := src.Seek(int64(stream.HEADER_SIZE), io.SeekStart); err != nil {
+		return err
+	}
+	ok, err := stream.VerifyMac(keys, h, io.LimitReader(src, bodySize), mac)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.E(errors.Invalid, "message authentication failed")
+	}
+
+	if _, err := src.Seek(int64(stream.HEADER_SIZE), io.SeekStart); err != nil {
+		return err
+	}
+	dec, err := stream.NewDecryption(keys, io.LimitReader(src, bodySize), h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, dec)
+	return err
+}
+
+// encrypt returns the encrypted form of the small plaintext data.
+func encrypt(data []byte, keys *stream.Keys, identity string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encryptTo(&buf, bytes.NewReader(data), keys, identity); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decrypt verifies and decrypts the small data produced by encrypt.
+func decrypt(data []byte, keys *stream.Keys, identity string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := decryptTo(&buf, bytes.NewReader(data), keys, identity); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,407 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+// memService is a minimal backend.Service keeping files in a map.
+type memService struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+var _ backend.Service = (*memService)(nil)
+
+func newMemService() *memService {
+	return &memService{files: make(map[string][]byte), dirs: map[string]bool{"/": true}}
+}
+
+func (m *memService) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	raw, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[h.HashRelpath]; ok {
+		return errors.E(errors.Exist, errors.Path(h.HashRelpath))
+	}
+	m.files[h.HashRelpath] = raw
+	return nil
+}
+
+func (m *memService) UpdateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	raw, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[h.HashRelpath] = raw
+	return nil
+}
+
+func (m *memService) ReadFile(ctx context.Context, h backend.RemoteFile, dst io.Writer) error {
+	m.mu.Lock()
+	raw, ok := m.files[h.HashRelpath]
+	m.mu.Unlock()
+	if !ok {
+		return errors.E(errors.NotExist, errors.Path(h.HashRelpath))
+	}
+	_, err := dst.Write(raw)
+	return err
+}
+
+func (m *memService) DeleteFile(ctx context.Context, h backend.RemoteFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, h.HashRelpath)
+	return nil
+}
+
+func (m *memService) RenameFile(ctx context.Context, old, new backend.RemoteFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[new.HashRelpath] = m.files[old.HashRelpath]
+	delete(m.files, old.HashRelpath)
+	return nil
+}
+
+func (m *memService) CreateDir(ctx context.Context, h backend.RemoteFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dirs[h.HashRelpath] = true
+	return nil
+}
+
+func (m *memService) ReadDir(ctx context.Context, h backend.RemoteFile) (*vfs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir := &vfs.File{Relpath: h.HashRelpath, Mode: os.ModeDir | 0700}
+	var names []string
+	for fp := range m.files {
+		if path.Dir(fp) == h.HashRelpath {
+			names = append(names, fp)
+		}
+	}
+	sort.Strings(names)
+	for _, fp := range names {
+		dir.Children = append(dir.Children, vfs.File{Relpath: fp, Size: int64(len(m.files[fp]))})
+	}
+	return dir, nil
+}
+
+func (m *memService) DeleteDir(ctx context.Context, h backend.RemoteFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for fp := range m.files {
+		if strings.HasPrefix(fp, h.HashRelpath+"/") {
+			delete(m.files, fp)
+		}
+	}
+	delete(m.dirs, h.HashRelpath)
+	return nil
+}
+
+func (m *memService) RenameDir(ctx context.Context, old, new backend.RemoteFile) error {
+	return errors.E(errors.Invalid, "not implemented")
+}
+
+func (m *memService) AddContext(ctx context.Context) {}
+
+var testKey, _ = stream.DeriveKeys(bytes.Repeat([]byte("k"), stream.KEY_SIZE))
+
+func TestUploadDownload(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	srv := newMemService()
+	content := []byte("this should be encrypted remotely")
+	mtime := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := fs.MkdirAll("/src/docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/src/docs/a.txt", content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	up := New(srv, fs, "/src", testKey)
+	dir := &vfs.File{Relpath: "/docs", Mode: os.ModeDir | 0755, MTime: mtime.UnixNano()}
+	f := &vfs.File{Relpath: "/docs/a.txt", Mode: 0640, MTime: mtime.UnixNano(), Size: int64(len(content))}
+
+	if err := up.Upload(ctx, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Upload(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	for fp, raw := range srv.files {
+		if strings.Contains(fp, "a.txt") || bytes.Contains(raw, content) {
+			t.Errorf("remote %s leaks plaintext", fp)
+		}
+	}
+
+	down := New(srv, fs, "/dst", testKey)
+	if err := down.Download(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := down.Download(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile("/dst/docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("want %q, got %q", content, got)
+	}
+	fi, err := fs.Stat("/dst/docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) || fi.Mode().Perm() != 0640 {
+		t.Errorf("metadata not applied: %s %s", fi.ModTime(), fi.Mode())
+	}
+
+	// tampering must be detected.
+	for fp, raw := range srv.files {
+		raw[len(raw)/2] ^= 0xff
+		srv.files[fp] = raw
+	}
+	if err := down.Download(ctx, f); err == nil {
+		t.Error("tampered file must not be accepted")
+	}
+	// the local file must be untouched and no partial download left behind.
+	if got, err := fs.ReadFile("/dst/docs/a.txt"); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("failed download changed local file: %q %v", got, err)
+	}
+	entries, err := fs.ReadDir("/dst/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("want only a.txt in /dst/docs, got %d entries", len(entries))
+	}
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	r := New(newMemService(), osx.NewMemMapFs(), "/", testKey)
+
+	if _, err := r.LatestSun(ctx); err != ErrNoIndex {
+		t.Errorf("want ErrNoIndex, got %v", err)
+	}
+	index := vfs.NewFromMemory(&vfs.File{Relpath: "/", Mode: os.ModeDir | 0755, Children: []vfs.File{
+		{Relpath: "/a.txt", Mode: 0644, Size: 3},
+	}})
+	for _, sun := range []int{0, 1, 10, 2} {
+		if err := r.StoreIndex(ctx, index, sun); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sun, err := r.LatestSun(ctx)
+	if err != nil || sun != 10 {
+		t.Errorf("want sun 10, got %d %v", sun, err)
+	}
+	got, err := r.FetchIndex(ctx, sun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := index.Equals(got); len(diffs) != 0 {
+		t.Error(strings.Join(diffs, "\n"))
+	}
+	if err := r.StoreIndex(ctx, index, sun); !errors.Is(errors.Exist, err) {
+		t.Errorf("an index must not be replaced, got %v", err)
+	}
+}
+
+func TestInit(t *testing.T) {
+	ctx := context.Background()
+	r := New(newMemService(), osx.NewMemMapFs(), "/", testKey)
+	if err := r.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sun, err := r.LatestSun(ctx)
+	if err != nil || sun != 0 {
+		t.Fatalf("want sun 0 after init, got %d %v", sun, err)
+	}
+	index, err := r.FetchIndex(ctx, sun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root, err := index.GetDir("/"); err != nil || len(root.Children) != 0 {
+		t.Errorf("want empty index, got %v %v", root, err)
+	}
+	if err := r.Init(ctx); !errors.Is(errors.Exist, err) {
+		t.Errorf("second init must fail with errors.Exist, got %v", err)
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	ctx := context.Background()
+	srv := newMemService()
+	// the key file is read before the key is known.
+	r := New(srv, osx.NewMemMapFs(), "/", nil)
+	if _, err := r.FetchKeyFile(ctx); err != ErrNoKeyFile {
+		t.Fatalf("want ErrNoKeyFile, got %v", err)
+	}
+	if err := r.StoreKeyFile(ctx, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	// a key file is never replaced.
+	if err := r.StoreKeyFile(ctx, []byte("second")); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if got, err := r.FetchKeyFile(ctx); err != nil || string(got) != "first" {
+		t.Errorf("want %q, got %q %v", "first", got, err)
+	}
+	// the key file is no index.
+	if _, err := r.LatestSun(ctx); err != ErrNoIndex {
+		t.Errorf("want ErrNoIndex, got %v", err)
+	}
+}
+
+func TestKeyedNames(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	srv := newMemService()
+	if err := fs.MkdirAll("/src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/src/a.txt", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	up := New(srv, fs, "/src", testKey)
+	up.SetKeyedNames(true)
+	if err := up.Upload(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.files[testKey.HashPath("/a.txt")]; !ok {
+		t.Errorf("want the keyed name, got %v", srv.files)
+	}
+	if _, ok := srv.files[stream.HashPath("/a.txt")]; ok {
+		t.Error("file stored under the unkeyed name")
+	}
+
+	// a client using the unkeyed names does not find the file.
+	down := New(srv, fs, "/dst", testKey)
+	if err := down.Download(ctx, f); !errors.Is(errors.NotExist, err) {
+		t.Errorf("want NotExist, got %v", err)
+	}
+	down.SetKeyedNames(true)
+	if err := down.Download(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSwappedFiles checks that authentic content stored under the name of
+// another file is rejected.
+func TestSwappedFiles(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	srv := newMemService()
+	if err := fs.MkdirAll("/src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	r := New(srv, fs, "/src", testKey)
+	a := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	b := &vfs.File{Relpath: "/b.txt", Mode: 0644}
+	for _, f := range []*vfs.File{a, b} {
+		if err := fs.WriteFile("/src"+f.Relpath, []byte(f.Relpath), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Upload(ctx, f, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ha, hb := r.remoteFile(a).HashRelpath, r.remoteFile(b).HashRelpath
+	srv.files[ha], srv.files[hb] = srv.files[hb], srv.files[ha]
+	if err := r.Download(ctx, a); err == nil {
+		t.Error("swapped file must not be accepted")
+	}
+
+	index := vfs.NewFromMemory(&vfs.File{Relpath: "/", Mode: os.ModeDir | 0755})
+	if err := r.StoreIndex(ctx, index, 1); err != nil {
+		t.Fatal(err)
+	}
+	h1, h2 := plainFile(fmt.Sprintf(config.IndexFileTemplate, 1)), plainFile(fmt.Sprintf(config.IndexFileTemplate, 2))
+	srv.files[h2.HashRelpath] = srv.files[h1.HashRelpath]
+	if _, err := r.FetchIndex(ctx, 2); err == nil {
+		t.Error("index stored under another sun must not be accepted")
+	}
+}
+
+// TestDownloadUnchunked checks that files uploaded before the chunked format
+// are still downloaded.
+func TestDownloadUnchunked(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	srv := newMemService()
+	r := New(srv, fs, "/", testKey)
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+
+	enc, err := stream.NewEncryption(strings.NewReader("old content"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	enc.Header().WriteTo(&buf)
+	if _, err := io.Copy(&buf, enc); err != nil {
+		t.Fatal(err)
+	}
+	enc.Footer().WriteTo(&buf)
+	srv.files[r.remoteFile(f).HashRelpath] = buf.Bytes()
+
+	if err := r.Download(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile("/a.txt"); err != nil || string(got) != "old content" {
+		t.Errorf("want %q, got %q %v", "old content", got, err)
+	}
+}
+
+func TestUploadCompressed(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	srv := newMemService()
+	content := bytes.Repeat([]byte("compressible text\n"), 1000)
+	if err := fs.MkdirAll("/src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/src/a.txt", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	up := New(srv, fs, "/src", testKey)
+	if err := up.Upload(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	if raw := srv.files[up.remoteFile(f).HashRelpath]; len(raw) >= len(content)/10 {
+		t.Errorf("want compressed upload, got %d of %d bytes", len(raw), len(content))
+	}
+	down := New(srv, fs, "/dst", testKey)
+	if err := down.Download(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile("/dst/a.txt"); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("downloaded content differs: %v", err)
+	}
+}
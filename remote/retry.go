@@ -0,0 +1,151 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+// The methods in this file wrap the backend.Service calls, so that transient
+// failures are retried with r.retry. An attempt may fail after the backend
+// has applied it, thus Exist and NotExist errors of a repeated attempt are
+// treated as success where that is safe.
+
+func (r *Remote) createDir(ctx context.Context, h backend.RemoteFile) error {
+	var attempt int
+	return r.retry.Do(ctx, func() error {
+		attempt++
+		err := r.srv.CreateDir(ctx, h)
+		if attempt > 1 && errors.Is(errors.Exist, err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// put uploads src to h. If replace is false, h must not exist yet, unless it
+// was created by a failed attempt. Since a repeated attempt replaces h if it
+// exists, put must not be used for files that another client may create,
+// e. g. locks, use create instead.
+func (r *Remote) put(ctx context.Context, h backend.RemoteFile, src io.ReadSeeker, replace bool) error {
+	var attempt int
+	return r.retry.Do(ctx, func() error {
+		attempt++
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if replace {
+			return r.srv.UpdateFile(ctx, h, src)
+		}
+		err := r.srv.CreateFile(ctx, h, src)
+		if attempt > 1 && errors.Is(errors.Exist, err) {
+			replace = true
+			if _, err := src.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			return r.srv.UpdateFile(ctx, h, src)
+		}
+		return err
+	})
+}
+
+// create uploads the small file data to h, which must not exist. Unlike put,
+// it never replaces a file: if a repeated attempt finds h, h is only accepted
+// if it holds data, i. e. was created by a failed attempt. Since encryption is
+// randomised, the content of another client never equals data.
+func (r *Remote) create(ctx context.Context, h backend.RemoteFile, data []byte) error {
+	var attempt int
+	return r.retry.Do(ctx, func() error {
+		attempt++
+		err := r.srv.CreateFile(ctx, h, bytes.NewReader(data))
+		if attempt == 1 || !errors.Is(errors.Exist, err) {
+			return err
+		}
+		got, rErr := r.getBytes(ctx, h)
+		if rErr != nil {
+			return rErr
+		}
+		if !bytes.Equal(got, data) {
+			return err
+		}
+		return nil
+	})
+}
+
+// get downloads h, the encrypted file of identity, to dst. If the service is
+// a backend.FileRangeReader, a repeated attempt keeps the authentic chunks
+// that dst already holds and resumes after them, see stream.VerifiedSize.
+// Otherwise dst is truncated before every attempt.
+func (r *Remote) get(ctx context.Context, h backend.RemoteFile, dst osx.File, identity string) error {
+	rr, ranged := r.srv.(backend.FileRangeReader)
+	return r.retry.Do(ctx, func() error {
+		var off int64
+		if ranged {
+			size, err := dst.Seek(0, io.SeekEnd)
+			if err != nil {
+				return err
+			}
+			off = stream.VerifiedSize(r.keys, dst, size, identity)
+		}
+		if err := dst.Truncate(off); err != nil {
+			return err
+		}
+		if _, err := dst.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		if off > 0 {
+			return rr.ReadFileFrom(ctx, h, off, dst)
+		}
+		return r.srv.ReadFile(ctx, h, dst)
+	})
+}
+
+// getBytes downloads the small file h into memory.
+func (r *Remote) getBytes(ctx context.Context, h backend.RemoteFile) ([]byte, error) {
+	var buf bytes.Buffer
+	err := r.retry.Do(ctx, func() error {
+		buf.Reset()
+		return r.srv.ReadFile(ctx, h, &buf)
+	})
+	return buf.Bytes(), err
+}
+
+func (r *Remote) readDir(ctx context.Context, h backend.RemoteFile) (*vfs.File, error) {
+	var dir *vfs.File
+	err := r.retry.Do(ctx, func() error {
+		var err error
+		dir, err = r.srv.ReadDir(ctx, h)
+		return err
+	})
+	return dir, err
+}
+
+func (r *Remote) deleteFile(ctx context.Context, h backend.RemoteFile) error {
+	var attempt int
+	return r.retry.Do(ctx, func() error {
+		attempt++
+		err := r.srv.DeleteFile(ctx, h)
+		if attempt > 1 && errors.Is(errors.NotExist, err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (r *Remote) deleteDir(ctx context.Context, h backend.RemoteFile) error {
+	var attempt int
+	return r.retry.Do(ctx, func() error {
+		attempt++
+		err := r.srv.DeleteDir(ctx, h)
+		if attempt > 1 && errors.Is(errors.NotExist, err) {
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,343 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/retry"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+// flakyService fails every other call with errors.IO. Failing writes are
+// applied before the error is returned, like a lost response would.
+type flakyService struct {
+	*memService
+	calls int
+}
+
+func (f *flakyService) fail() bool {
+	f.calls++
+	return f.calls%2 == 1
+}
+
+var errFlaky = errors.E(errors.IO, "connection reset")
+
+func (f *flakyService) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	if f.fail() {
+		if err := f.memService.CreateFile(ctx, h, src); err != nil {
+			return err
+		}
+		return errFlaky
+	}
+	return f.memService.CreateFile(ctx, h, src)
+}
+
+func (f *flakyService) ReadFile(ctx context.Context, h backend.RemoteFile, dst io.Writer) error {
+	if f.fail() {
+		// a partial response must not end up in dst.
+		dst.Write([]byte("garbage"))
+		return errFlaky
+	}
+	return f.memService.ReadFile(ctx, h, dst)
+}
+
+func (f *flakyService) ReadDir(ctx context.Context, h backend.RemoteFile) (*vfs.File, error) {
+	if f.fail() {
+		return nil, errFlaky
+	}
+	return f.memService.ReadDir(ctx, h)
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	content := []byte("content")
+	if err := fs.MkdirAll("/src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/src/a.txt", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &flakyService{memService: newMemService()}
+	r := New(srv, fs, "/src", testKey)
+	r.retry = retry.Policy{Attempts: 2, Backoff: func(int) time.Duration { return 0 }}
+
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	if err := r.Upload(ctx, f, false); err != nil {
+		t.Fatalf("upload must be retried: %v", err)
+	}
+	if err := r.Init(ctx); err != nil {
+		t.Fatalf("init must be retried: %v", err)
+	}
+	if err := fs.WriteFile("/src/a.txt", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Download(ctx, f); err != nil {
+		t.Fatalf("download must be retried: %v", err)
+	}
+	if got, _ := fs.ReadFile("/src/a.txt"); !bytes.Equal(got, content) {
+		t.Errorf("want %q, got %q", content, got)
+	}
+
+	r.retry.Attempts = 1
+	srv.calls = 0
+	if _, err := r.LatestSun(ctx); !errors.Is(errors.IO, err) {
+		t.Errorf("want IO error without retries, got %v", err)
+	}
+}
+
+// TestUploadKeepsEncrypted checks that a failed upload is repeated with the
+// same encrypted bytes, so that backends can resume it.
+func TestUploadKeepsEncrypted(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	defer func(dp string) { config.UploadCacheFolder = dp }(config.UploadCacheFolder)
+	config.UploadCacheFolder = "/uploads"
+	for _, dp := range []string{"/src", config.UploadCacheFolder} {
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.WriteFile("/src/a.txt", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &flakyService{memService: newMemService()}
+	r := New(srv, fs, "/src", testKey)
+	r.retry = retry.Policy{Attempts: 1}
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	h := r.remoteFile(f)
+
+	if err := r.Upload(ctx, f, false); !errors.Is(errors.IO, err) {
+		t.Fatalf("want IO error, got %v", err)
+	}
+	first := srv.files[h.HashRelpath]
+	if entries, _ := fs.ReadDir(config.UploadCacheFolder); len(entries) != 1 {
+		t.Fatalf("want the encrypted file kept, got %v", entries)
+	}
+	if err := r.Upload(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(srv.files[h.HashRelpath], first) {
+		t.Error("repeated upload sent different bytes")
+	}
+	if entries, _ := fs.ReadDir(config.UploadCacheFolder); len(entries) != 0 {
+		t.Errorf("want the encrypted file removed, got %v", entries)
+	}
+
+	// a changed file is encrypted again and the old version is removed.
+	for _, content := range []string{"content", "changed content"} {
+		if err := fs.WriteFile("/src/a.txt", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		delete(srv.files, h.HashRelpath)
+		srv.calls = 0
+		if err := r.Upload(ctx, f, false); !errors.Is(errors.IO, err) {
+			t.Fatalf("want IO error, got %v", err)
+		}
+	}
+	entries, _ := fs.ReadDir(config.UploadCacheFolder)
+	if len(entries) != 1 {
+		t.Fatalf("want one encrypted file, got %v", entries)
+	}
+	raw, _ := fs.ReadFile(config.UploadCacheFolder + "/" + entries[0].Name())
+	plain, err := decrypt(raw, testKey, "/a.txt")
+	if err != nil || string(plain) != "changed content" {
+		t.Errorf("want the changed content, got %q %v", plain, err)
+	}
+}
+
+// TestPruneUploads checks that the encrypted files of files that are no longer
+// in the local index are removed.
+func TestPruneUploads(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	defer func(dp string) { config.UploadCacheFolder = dp }(config.UploadCacheFolder)
+	config.UploadCacheFolder = "/uploads"
+	for _, dp := range []string{"/src", config.UploadCacheFolder} {
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &flakyService{memService: newMemService()}
+	r := New(srv, fs, "/src", testKey)
+	r.retry = retry.Policy{Attempts: 1}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := fs.WriteFile("/src/"+name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		srv.calls = 0
+		if err := r.Upload(ctx, &vfs.File{Relpath: "/" + name, Mode: 0644}, false); !errors.Is(errors.IO, err) {
+			t.Fatalf("want IO error, got %v", err)
+		}
+	}
+	if err := fs.WriteFile(config.UploadCacheFolder+"/stray", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	index := vfs.NewFromMemory(&vfs.File{Relpath: "/", Mode: os.ModeDir | 0755, Children: []vfs.File{
+		{Relpath: "/a.txt", Mode: 0644},
+	}})
+	if err := r.PruneUploads(index); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := fs.ReadDir(config.UploadCacheFolder)
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), r.uploadPrefix("/a.txt")) {
+		t.Errorf("want only the encrypted a.txt kept, got %v", entries)
+	}
+}
+
+// lostCreateService loses the response of the first CreateFile, after the
+// file was created.
+type lostCreateService struct {
+	*memService
+	lost bool
+}
+
+func (l *lostCreateService) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	err := l.memService.CreateFile(ctx, h, src)
+	if err == nil && !l.lost {
+		l.lost = true
+		return errFlaky
+	}
+	return err
+}
+
+// TestRetryCreate checks that an index created by a failed attempt is
+// accepted, but an index of another client is not replaced.
+func TestRetryCreate(t *testing.T) {
+	ctx := context.Background()
+	srv := &lostCreateService{memService: newMemService()}
+	r := New(srv, osx.NewMemMapFs(), "/", testKey)
+	r.retry = retry.Policy{Attempts: 2, Backoff: func(int) time.Duration { return 0 }}
+	index := vfs.NewFromMemory(&vfs.File{Relpath: "/", Mode: os.ModeDir | 0755})
+
+	if err := r.StoreIndex(ctx, index, 1); err != nil {
+		t.Fatalf("index of a failed attempt not accepted: %v", err)
+	}
+	other := New(srv, osx.NewMemMapFs(), "/", testKey)
+	other.retry = r.retry
+	if err := other.StoreIndex(ctx, index, 1); !errors.Is(errors.Exist, err) {
+		t.Errorf("want Exist, got %v", err)
+	}
+	if _, err := r.FetchIndex(ctx, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+// takenLockService creates the lock file of another client and loses the
+// connection on the first CreateFile of a lock.
+type takenLockService struct {
+	*memService
+	other *Remote
+	lock  *Lock
+}
+
+func (t *takenLockService) CreateFile(ctx context.Context, h backend.RemoteFile, src io.Reader) error {
+	if t.lock == nil && strings.HasPrefix(h.HashName, "lock-") {
+		lock, err := t.other.AcquireLock(ctx, 0, time.Minute)
+		if err != nil {
+			return err
+		}
+		t.lock = lock
+		return errFlaky
+	}
+	return t.memService.CreateFile(ctx, h, src)
+}
+
+// TestRetryLock checks that a retried AcquireLock does not replace a lock
+// that another client acquired in the meantime.
+func TestRetryLock(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemService()
+	srv := &takenLockService{memService: mem, other: New(mem, osx.NewMemMapFs(), "/", testKey)}
+	r := New(srv, osx.NewMemMapFs(), "/", testKey)
+	r.retry = retry.Policy{Attempts: 2, Backoff: func(int) time.Duration { return 0 }}
+
+	if _, err := r.AcquireLock(ctx, 0, time.Minute); !errors.Is(errors.Exist, err) {
+		t.Fatalf("want Exist, got %v", err)
+	}
+	info, err := srv.other.ReadLock(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Token != srv.lock.Info().Token {
+		t.Error("lock of the other client was replaced")
+	}
+}
+
+// cutService is a backend.FileRangeReader that breaks off the first read
+// after cut bytes, which have a flipped bit at flip.
+type cutService struct {
+	*memService
+	cut, flip int64
+	calls     int
+	offsets   []int64
+}
+
+func (c *cutService) ReadFile(ctx context.Context, h backend.RemoteFile, dst io.Writer) error {
+	return c.ReadFileFrom(ctx, h, 0, dst)
+}
+
+func (c *cutService) ReadFileFrom(ctx context.Context, h backend.RemoteFile, off int64, dst io.Writer) error {
+	c.calls++
+	c.offsets = append(c.offsets, off)
+	raw := c.files[h.HashRelpath][off:]
+	if c.calls > 1 {
+		_, err := dst.Write(raw)
+		return err
+	}
+	part := append([]byte(nil), raw[:c.cut]...)
+	part[c.flip] ^= 1
+	dst.Write(part)
+	return errFlaky
+}
+
+// TestDownloadResumes checks that a repeated attempt of a download keeps the
+// authentic chunks of the failed one.
+func TestDownloadResumes(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	for _, dp := range []string{"/src", "/dst"} {
+		if err := fs.MkdirAll(dp, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := make([]byte, 3*stream.CHUNK_SIZE)
+	rand.Read(content)
+	if err := fs.WriteFile("/src/a.txt", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &cutService{
+		memService: newMemService(),
+		cut:        stream.ChunkStart(2*stream.CHUNK_SIZE) + 100,
+		flip:       stream.ChunkStart(stream.CHUNK_SIZE) + 5,
+	}
+	f := &vfs.File{Relpath: "/a.txt", Mode: 0644}
+	if err := New(srv, fs, "/src", testKey).Upload(ctx, f, false); err != nil {
+		t.Fatal(err)
+	}
+	r := New(srv, fs, "/dst", testKey)
+	r.retry = retry.Policy{Attempts: 2, Backoff: func(int) time.Duration { return 0 }}
+	if err := r.Download(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fs.ReadFile("/dst/a.txt"); !bytes.Equal(got, content) {
+		t.Error("downloaded content differs")
+	}
+	// the chunk with the flipped bit is downloaded again.
+	want := []int64{0, stream.ChunkStart(stream.CHUNK_SIZE)}
+	if len(srv.offsets) != 2 || srv.offsets[0] != want[0] || srv.offsets[1] != want[1] {
+		t.Errorf("want reads from %v, got %v", want, srv.offsets)
+	}
+}
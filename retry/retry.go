@@ -0,0 +1,100 @@
+// Package retry repeats operations that failed because of transient errors,
+// e. g. a dropped network connection, with exponential backoff.
+package retry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/liamvdv/sharedHome/errors"
+)
+
+/*
+Usage:
+	err := retry.Do(ctx, func() error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err // not of kind errors.IO, thus not retried.
+		}
+		return srv.CreateFile(ctx, h, f)
+	})
+*/
+
+// Backoff returns the delay before the n-th retry, starting at n = 1.
+type Backoff func(n int) time.Duration
+
+// ExponentialBackoff returns a Backoff that starts with base and doubles the
+// delay for every retry up to max. Each delay is randomly changed by up to
+// the fraction jitter in both directions, so that clients that failed at the
+// same time do not retry at the same time.
+func ExponentialBackoff(base, max time.Duration, jitter float64) Backoff {
+	return func(n int) time.Duration {
+		d := float64(base) * math.Pow(2, float64(n-1))
+		if d > float64(max) {
+			d = float64(max)
+		}
+		d += d * jitter * (2*rand.Float64() - 1)
+		return time.Duration(d)
+	}
+}
+
+// Policy describes how often and when an operation is retried.
+type Policy struct {
+	// Attempts is the maximum number of calls, including the first one.
+	Attempts int
+	Backoff  Backoff
+	// Retryable reports whether an error is transient. If nil, Temporary is
+	// used.
+	Retryable func(err error) bool
+}
+
+// DefaultPolicy is used by Do.
+var DefaultPolicy = Policy{
+	Attempts: 5,
+	Backoff:  ExponentialBackoff(500*time.Millisecond, 30*time.Second, 0.5),
+}
+
+// Temporary reports whether err is of kind errors.IO. Only those errors are
+// worth retrying, all others will fail again.
+func Temporary(err error) bool {
+	return errors.Is(errors.IO, err)
+}
+
+// Do calls fn with DefaultPolicy.
+func Do(ctx context.Context, fn func() error) error {
+	return DefaultPolicy.Do(ctx, fn)
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable
+// or p.Attempts is reached. It returns the last error of fn. If ctx is done
+// while waiting, the context error is returned.
+func (p Policy) Do(ctx context.Context, fn func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = Temporary
+	}
+	var err error
+	for n := 0; n < p.Attempts || n == 0; n++ {
+		if n > 0 {
+			var d time.Duration
+			if p.Backoff != nil {
+				d = p.Backoff(n)
+			}
+			t := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		}
+		if err = fn(); err == nil || !retryable(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
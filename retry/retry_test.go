@@ -0,0 +1,71 @@
+package retry_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/retry"
+)
+
+var noDelay = func(int) time.Duration { return 0 }
+
+func TestDo(t *testing.T) {
+	p := retry.Policy{Attempts: 3, Backoff: noDelay}
+	for _, tc := range []struct {
+		name  string
+		errs  []error
+		calls int
+		ok    bool
+	}{
+		{"success", []error{nil}, 1, true},
+		{"transient", []error{errors.E(errors.IO, "timeout"), nil}, 2, true},
+		{"permanent", []error{errors.E(errors.Permission, "denied")}, 1, false},
+		{"exhausted", []error{errors.E(errors.IO, "a"), errors.E(errors.IO, "b"), errors.E(errors.IO, "c"), nil}, 3, false},
+	} {
+		var calls int
+		err := p.Do(context.Background(), func() error {
+			calls++
+			return tc.errs[calls-1]
+		})
+		if calls != tc.calls {
+			t.Errorf("%s: want %d calls, got %d", tc.name, tc.calls, calls)
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if err != nil && err != tc.errs[calls-1] {
+			t.Errorf("%s: want last error, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestDoCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := retry.Policy{Attempts: 10, Backoff: func(int) time.Duration { return time.Hour }}
+	var calls int
+	err := p.Do(ctx, func() error {
+		calls++
+		cancel()
+		return errors.E(errors.IO, "timeout")
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Errorf("want %v after 1 call, got %v after %d", context.Canceled, err, calls)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := retry.ExponentialBackoff(time.Second, 5*time.Second, 0)
+	for n, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := b(n + 1); got != want {
+			t.Errorf("retry %d: want %s, got %s", n+1, want, got)
+		}
+	}
+	jittered := retry.ExponentialBackoff(time.Second, time.Minute, 0.5)
+	for i := 0; i < 100; i++ {
+		if d := jittered(1); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("delay %s exceeds jitter", d)
+		}
+	}
+}
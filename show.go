@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+// Show prints the local index, the latest remote index, the remote index
+// cached by the last sync or the difference between the local and the cached
+// index. The local index is compared to the cached index, so that its files
+// are marked Unmodified, Modified, Deleted or Ignored.
+// The output can be limited to states and subtrees given as relative paths.
+func Show(env config.Env, cfg *config.Config, args []string) error {
+	const op = errors.Op("main.Show")
+	flags := flag.NewFlagSet("show", flag.ContinueOnError)
+	flags.SetOutput(env.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(env.Stderr, "usage: sharedHome show [flags] [relpath ...]")
+		flags.PrintDefaults()
+	}
+	var (
+		remoteIdx = flags.Bool("remote", false, "show the latest remote index")
+		baseIdx   = flags.Bool("base", false, "show the cached remote index of the last sync")
+		diff      = flags.Bool("diff", false, "show only files that differ between local and cached remote index")
+		states    = flags.String("state", "", "comma separated states to show, e. g. Modified,Deleted")
+		asJSON    = flags.Bool("json", false, "print JSON instead of a table")
+	)
+	if err := flags.Parse(args); err != nil {
+		return errors.E(op, errors.Invalid, err)
+	}
+	if *remoteIdx && *baseIdx || (*remoteIdx || *baseIdx) && *diff {
+		return errors.E(op, errors.Invalid, "-remote, -base and -diff are mutually exclusive")
+	}
+	filter, err := newShowFilter(*states, flags.Args())
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if *diff && len(filter.states) == 0 {
+		filter.states[vfs.Modified] = true
+		filter.states[vfs.Deleted] = true
+	}
+
+	var files []vfs.File
+	switch {
+	case *remoteIdx:
+		index, sun, err := fetchLatest(env, cfg)
+		if err != nil {
+			return errors.E(op, err)
+		}
+		fmt.Fprintf(env.Stderr, "remote index %d\n", sun)
+		files = index.Flatten()
+	case *baseIdx:
+		cached, sun, err := loadBase(env.Fs)
+		if err != nil {
+			return errors.E(op, err)
+		}
+		if cached == nil {
+			return errors.E(op, errors.NotExist, "no cached remote index, run sync first")
+		}
+		fmt.Fprintf(env.Stderr, "cached remote index %d\n", sun)
+		files = cached.Flatten()
+	default:
+		cached, _, err := loadBase(env.Fs)
+		if err != nil {
+			return errors.E(op, err)
+		}
+		local, err := buildLocalIndex(env, cfg)
+		if err != nil {
+			return errors.E(op, err)
+		}
+		if cached == nil {
+			fmt.Fprintln(env.Stderr, "no cached remote index, states are unchecked")
+			files = local.Flatten()
+		} else {
+			files = vfs.Diff(cached, local)
+		}
+	}
+
+	shown := files[:0]
+	for _, f := range files {
+		if filter.match(&f) {
+			shown = append(shown, f)
+		}
+	}
+	if *asJSON {
+		return printJSON(env.Stdout, shown)
+	}
+	return printTable(env.Stdout, shown)
+}
+
+// fetchLatest downloads the latest remote index. It does not lock the
+// remote, since stored indexes never change.
+func fetchLatest(env config.Env, cfg *config.Config) (*vfs.FileIndex, int, error) {
+	secret, err := loadKey(env)
+	if err != nil {
+		return nil, 0, err
+	}
+	srv, err := backend.Open(env, cfg.UseBackend)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := openRemote(env, cfg, srv, secret)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx := context.Background()
+	sun, err := r.LatestSun(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, err := r.FetchIndex(ctx, sun)
+	return index, sun, err
+}
+
+type showFilter struct {
+	states   map[vfs.State]bool
+	subtrees []string
+}
+
+func newShowFilter(states string, subtrees []string) (*showFilter, error) {
+	f := &showFilter{states: make(map[vfs.State]bool)}
+	if states != "" {
+		for _, name := range strings.Split(states, ",") {
+			s, err := vfs.ParseState(strings.TrimSpace(name))
+			if err != nil {
+				return nil, err
+			}
+			f.states[s] = true
+		}
+	}
+	for _, st := range subtrees {
+		f.subtrees = append(f.subtrees, path.Clean("/"+st))
+	}
+	return f, nil
+}
+
+func (sf *showFilter) match(f *vfs.File) bool {
+	if len(sf.states) > 0 && !sf.states[f.State] {
+		return false
+	}
+	if len(sf.subtrees) == 0 {
+		return true
+	}
+	for _, st := range sf.subtrees {
+		if st == "/" || f.Relpath == st || strings.HasPrefix(f.Relpath, st+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func printTable(w io.Writer, files []vfs.File) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATE\tMODE\tSIZE\tMODIFIED\tPATH")
+	for _, f := range files {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", f.State, f.Mode, f.Size,
+			time.Unix(0, f.MTime).Format("2006-01-02 15:04:05"), f.Relpath)
+	}
+	return tw.Flush()
+}
+
+// jsonFile is the JSON representation of a vfs.File.
+type jsonFile struct {
+	Relpath string    `json:"relpath"`
+	State   string    `json:"state"`
+	Mode    string    `json:"mode"`
+	Size    int64     `json:"size"`
+	CTime   time.Time `json:"ctime"`
+	MTime   time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode"`
+}
+
+func printJSON(w io.Writer, files []vfs.File) error {
+	out := make([]jsonFile, 0, len(files))
+	for _, f := range files {
+		out = append(out, jsonFile{
+			Relpath: f.Relpath,
+			State:   f.State.String(),
+			Mode:    f.Mode.String(),
+			Size:    f.Size,
+			CTime:   time.Unix(0, f.CTime),
+			MTime:   time.Unix(0, f.MTime),
+			Inode:   f.Inode,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
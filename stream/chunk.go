@@ -0,0 +1,371 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+	VERSION_3 files are split into chunks of CHUNK_SIZE bytes of plaintext,
+	which are encrypted and authenticated on their own with AES-256-GCM:
+		header || chunk 0 || chunk 1 || ... || chunk n
+	There is no footer. The header is the same as for the other versions.
+	Every file has its own key, derived with HKDF-SHA256 from Keys.Chunk with
+	the iv as salt and the identity of the file as info. Thus nonces do not
+	repeat across files and a file cannot be passed off as another.
+	The nonce of chunk i is i as 11 byte big endian integer followed by 1 for
+	the last chunk and 0 otherwise, the header is the additional data. Chunks
+	can therefore neither be reordered nor dropped, and a file truncated at a
+	chunk boundary is detected because its new last chunk is not marked as
+	such. Only the last chunk may be shorter than CHUNK_SIZE, an empty file
+	consists of a single empty chunk.
+	Plaintext offset o is in chunk o / CHUNK_SIZE, which starts at ChunkStart(o)
+	in the encrypted file. Decryption can thus start at any chunk, e. g. to
+	resume a download or to read a byte range.
+	VERSION_4 files have the same format, but their plaintext is compressed,
+	see compression.go.
+*/
+
+const (
+	// CHUNK_SIZE is the size of the plaintext of a full chunk.
+	CHUNK_SIZE = 64 << 10 // bytes
+	// TAG_SIZE is the size of the GCM tag appended to every chunk.
+	TAG_SIZE = 16 // bytes
+)
+
+// ChunkStart returns the offset in a VERSION_3 file of the chunk that
+// contains the plaintext offset off.
+func ChunkStart(off int64) int64 {
+	return int64(HEADER_SIZE) + off/CHUNK_SIZE*(CHUNK_SIZE+TAG_SIZE)
+}
+
+// PlainSize returns the size of the plaintext of a VERSION_3 file of size
+// bytes. It fails if no file has this size.
+func PlainSize(size int64) (int64, error) {
+	body := size - int64(HEADER_SIZE)
+	if body < TAG_SIZE {
+		return 0, errors.E(errors.Invalid, "encrypted data is truncated")
+	}
+	full, rest := body/(CHUNK_SIZE+TAG_SIZE), body%(CHUNK_SIZE+TAG_SIZE)
+	switch {
+	case rest == 0:
+		return full * CHUNK_SIZE, nil
+	case rest < TAG_SIZE:
+		return 0, errors.E(errors.Invalid, "encrypted data is truncated")
+	}
+	return full*CHUNK_SIZE + rest - TAG_SIZE, nil
+}
+
+// NewChunkEncryption encrypts src as a VERSION_3 file. It reads the chunks,
+// the header must be written before them. identity, e. g. the path of the
+// file, binds the content to the file, so that it cannot be passed off as
+// another file.
+func NewChunkEncryption(src io.Reader, keys *Keys, identity string) (*ChunkEncryption, error) {
+	return newChunkEncryption(src, keys, identity, VERSION_3)
+}
+
+// NewCompressedEncryption compresses src with algorithm and encrypts it as a
+// VERSION_4 file. Its plaintext must be read with NewDecompression.
+func NewCompressedEncryption(src io.Reader, keys *Keys, identity string, algorithm byte) (*ChunkEncryption, error) {
+	comp, err := NewCompression(src, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkEncryption(comp, keys, identity, VERSION_4)
+}
+
+func newChunkEncryption(src io.Reader, keys *Keys, identity string, version [VERSION_SIZE]byte) (*ChunkEncryption, error) {
+	h := EncryptionHeader{Version: version, Iv: make([]byte, IV_SIZE)}
+	if _, err := rand.Read(h.Iv); err != nil {
+		return nil, err
+	}
+	aead, err := newChunkAead(keys, h, identity)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkEncryption{
+		header: h,
+		aead:   aead,
+		src:    bufio.NewReaderSize(src, CHUNK_SIZE+1),
+		plain:  make([]byte, CHUNK_SIZE),
+		sealed: make([]byte, CHUNK_SIZE+TAG_SIZE),
+	}, nil
+}
+
+// ChunkEncryption is an io.Reader of the chunks of a VERSION_3 file.
+type ChunkEncryption struct {
+	header EncryptionHeader
+	aead   cipher.AEAD
+	src    *bufio.Reader
+	plain  []byte
+	sealed []byte
+	// out holds the part of the current chunk that has not been read yet.
+	out   []byte
+	chunk int64
+	done  bool
+}
+
+func (enc *ChunkEncryption) Header() EncryptionHeader {
+	return enc.header
+}
+
+func (enc *ChunkEncryption) Read(buf []byte) (int, error) {
+	if len(enc.out) == 0 {
+		if enc.done {
+			return 0, io.EOF
+		}
+		n, last, err := readChunk(enc.src, enc.plain)
+		if err != nil {
+			return 0, err
+		}
+		nonce := chunkNonce(enc.chunk, last)
+		enc.out = enc.aead.Seal(enc.sealed[:0], nonce, enc.plain[:n], enc.header.bytes())
+		enc.chunk++
+		enc.done = last
+	}
+	n := copy(buf, enc.out)
+	enc.out = enc.out[n:]
+	return n, nil
+}
+
+/*========================================== Decryption ==========================================*/
+
+// NewChunkDecryption decrypts the chunks of a chunked file with the header h
+// that are read from src. src must start at chunk, i. e. at ChunkStart of its
+// plaintext offset, use 0 to decrypt the whole file.
+func NewChunkDecryption(keys *Keys, src io.Reader, h EncryptionHeader, identity string, chunk int64) (*ChunkDecryption, error) {
+	if chunk < 0 {
+		return nil, errors.E(errors.Invalid, "negative chunk")
+	}
+	aead, err := newChunkAead(keys, h, identity)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkDecryption{
+		header: h,
+		aead:   aead,
+		src:    bufio.NewReaderSize(src, CHUNK_SIZE+TAG_SIZE+1),
+		sealed: make([]byte, CHUNK_SIZE+TAG_SIZE),
+		plain:  make([]byte, CHUNK_SIZE),
+		chunk:  chunk,
+	}, nil
+}
+
+// ChunkDecryption is an io.Reader of the plaintext of a chunked file.
+// A chunk is only returned after it has been authenticated, Read fails with
+// an error of kind errors.Invalid at the first chunk that is not authentic.
+type ChunkDecryption struct {
+	header EncryptionHeader
+	aead   cipher.AEAD
+	src    *bufio.Reader
+	sealed []byte
+	plain  []byte
+	// out holds the part of the current chunk that has not been read yet.
+	out   []byte
+	chunk int64
+	done  bool
+}
+
+func (dec *ChunkDecryption) Read(buf []byte) (int, error) {
+	if len(dec.out) == 0 {
+		if dec.done {
+			return 0, io.EOF
+		}
+		n, last, err := readChunk(dec.src, dec.sealed)
+		if err != nil {
+			return 0, err
+		}
+		out, err := openChunk(dec.aead, dec.header, dec.chunk, last, dec.plain[:0], dec.sealed[:n])
+		if err != nil {
+			return 0, err
+		}
+		dec.out = out
+		dec.chunk++
+		dec.done = last
+	}
+	n := copy(buf, dec.out)
+	dec.out = dec.out[n:]
+	return n, nil
+}
+
+// NewChunkReaderAt returns random access to the plaintext of the chunked file
+// src of size bytes. The plaintext of VERSION_4 files is compressed.
+func NewChunkReaderAt(keys *Keys, src io.ReaderAt, size int64, identity string) (*ChunkReaderAt, error) {
+	plain, err := PlainSize(size)
+	if err != nil {
+		return nil, err
+	}
+	h, err := ReadHeader(io.NewSectionReader(src, 0, int64(HEADER_SIZE)))
+	if err != nil {
+		return nil, errors.E(errors.Invalid, err)
+	}
+	aead, err := newChunkAead(keys, *h, identity)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkReaderAt{header: *h, aead: aead, src: src, size: size, plain: plain}, nil
+}
+
+// ChunkReaderAt is an io.ReaderAt of the plaintext of a chunked file. It
+// only reads and authenticates the chunks of the requested range.
+type ChunkReaderAt struct {
+	header EncryptionHeader
+	aead   cipher.AEAD
+	src    io.ReaderAt
+	size   int64
+	plain  int64
+}
+
+// Size returns the size of the plaintext.
+func (r *ChunkReaderAt) Size() int64 {
+	return r.plain
+}
+
+func (r *ChunkReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.E(errors.Invalid, "negative offset")
+	}
+	var (
+		n      int
+		sealed = make([]byte, CHUNK_SIZE+TAG_SIZE)
+		plain  = make([]byte, 0, CHUNK_SIZE)
+	)
+	for n < len(buf) {
+		if off >= r.plain {
+			return n, io.EOF
+		}
+		chunk := off / CHUNK_SIZE
+		start := ChunkStart(off)
+		end := start + CHUNK_SIZE + TAG_SIZE
+		if end > r.size {
+			end = r.size
+		}
+		m, err := r.src.ReadAt(sealed[:end-start], start)
+		if m < int(end-start) {
+			if err == nil || err == io.EOF {
+				err = errors.E(errors.Invalid, "encrypted data is truncated")
+			}
+			return n, err
+		}
+		plain, err = openChunk(r.aead, r.header, chunk, end == r.size, plain[:0], sealed[:m])
+		if err != nil {
+			return n, err
+		}
+		c := copy(buf[n:], plain[off-chunk*CHUNK_SIZE:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// VerifiedSize returns the size of the prefix of the incomplete chunked file
+// src of size bytes that consists of the header and authentic chunks that
+// are not the last one. A download of the file can resume after it. It
+// returns 0 if src is not chunked or no chunk is authentic.
+func VerifiedSize(keys *Keys, src io.ReaderAt, size int64, identity string) int64 {
+	if size < int64(HEADER_SIZE) {
+		return 0
+	}
+	h, err := ReadHeader(io.NewSectionReader(src, 0, int64(HEADER_SIZE)))
+	if err != nil || !Chunked(*h) {
+		return 0
+	}
+	aead, err := newChunkAead(keys, *h, identity)
+	if err != nil {
+		return 0
+	}
+	var (
+		chunk  int64
+		off    = int64(HEADER_SIZE)
+		sealed = make([]byte, CHUNK_SIZE+TAG_SIZE)
+		plain  = make([]byte, 0, CHUNK_SIZE)
+	)
+	for off+CHUNK_SIZE+TAG_SIZE <= size {
+		if _, err := src.ReadAt(sealed, off); err != nil {
+			break
+		}
+		if _, err := openChunk(aead, *h, chunk, false, plain[:0], sealed); err != nil {
+			break
+		}
+		chunk++
+		off += CHUNK_SIZE + TAG_SIZE
+	}
+	if chunk == 0 {
+		// the header is only authenticated with a chunk.
+		return 0
+	}
+	return off
+}
+
+// newChunkAead returns the cipher of the file with header h and identity.
+func newChunkAead(keys *Keys, h EncryptionHeader, identity string) (cipher.AEAD, error) {
+	if !Chunked(h) {
+		return nil, errors.E(errors.Invalid, errors.Errorf("unsupported version %x", h.Version))
+	}
+	key := make([]byte, KEY_SIZE)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, keys.Chunk, h.Iv, []byte(identity)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Chunked returns true if the file with the header h consists of chunks.
+func Chunked(h EncryptionHeader) bool {
+	return h.Version == VERSION_3 || h.Version == VERSION_4
+}
+
+// openChunk appends the plaintext of the chunk sealed to dst.
+func openChunk(aead cipher.AEAD, h EncryptionHeader, chunk int64, last bool, dst, sealed []byte) ([]byte, error) {
+	out, err := aead.Open(dst, chunkNonce(chunk, last), sealed, h.bytes())
+	if err != nil {
+		return nil, errors.E(errors.Invalid, errors.Errorf("chunk %d: message authentication failed", chunk))
+	}
+	return out, nil
+}
+
+// readChunk reads up to len(buf) bytes from src into buf. It reports whether
+// the chunk is the last one, i. e. src has nothing left.
+func readChunk(src *bufio.Reader, buf []byte) (n int, last bool, err error) {
+	n, err = io.ReadFull(src, buf)
+	switch err {
+	case nil:
+		if _, err := src.Peek(1); err == io.EOF {
+			return n, true, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+		return n, false, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, true, nil
+	}
+	return 0, false, err
+}
+
+// chunkNonce returns the nonce of the chunk with the index chunk.
+func chunkNonce(chunk int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(chunk))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// bytes returns the header as it is written by WriteTo.
+func (h EncryptionHeader) bytes() []byte {
+	b := make([]byte, 0, HEADER_SIZE)
+	b = append(b, h.Version[:]...)
+	return append(b, h.Iv...)
+}
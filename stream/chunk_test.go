@@ -0,0 +1,211 @@
+package stream_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/stream"
+)
+
+// encryptChunks returns the VERSION_3 file of plain.
+func encryptChunks(t *testing.T, keys *stream.Keys, plain []byte, identity string) []byte {
+	t.Helper()
+	enc, err := stream.NewChunkEncryption(bytes.NewReader(plain), keys, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	enc.Header().WriteTo(&buf)
+	if _, err := io.Copy(&buf, enc); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decryptChunks decrypts the VERSION_3 file raw from its start.
+func decryptChunks(keys *stream.Keys, raw []byte, identity string) ([]byte, error) {
+	src := bytes.NewReader(raw)
+	h, err := stream.ReadHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := stream.NewChunkDecryption(keys, src, *h, identity, 0)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(dec)
+}
+
+func TestChunks(t *testing.T) {
+	keys, err := stream.DeriveKeys(bytes.Repeat([]byte{1}, stream.KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, stream.CHUNK_SIZE - 1, stream.CHUNK_SIZE, stream.CHUNK_SIZE + 1, 3*stream.CHUNK_SIZE + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		raw := encryptChunks(t, keys, plain, "/a.txt")
+		if raw[1] != stream.VERSION_3[1] {
+			t.Errorf("%d: want VERSION_3, got %x", size, raw[:2])
+		}
+		if n, err := stream.PlainSize(int64(len(raw))); err != nil || n != int64(size) {
+			t.Errorf("%d: wrong plain size %d %v", size, n, err)
+		}
+		got, err := decryptChunks(keys, raw, "/a.txt")
+		if err != nil {
+			t.Fatalf("%d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d: decrypted content differs", size)
+		}
+		if _, err := decryptChunks(keys, raw, "/b.txt"); !errors.Is(errors.Invalid, err) {
+			t.Errorf("%d: want Invalid for another identity, got %v", size, err)
+		}
+	}
+}
+
+func TestChunksTampered(t *testing.T) {
+	keys, err := stream.DeriveKeys(bytes.Repeat([]byte{1}, stream.KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("0123456789abcdef"), 3*stream.CHUNK_SIZE/16)
+	raw := encryptChunks(t, keys, plain, "/a.txt")
+	chunk := int(stream.ChunkStart(stream.CHUNK_SIZE) - stream.ChunkStart(0))
+	start := int(stream.ChunkStart(0))
+
+	// a modified chunk is rejected before any of its content is returned.
+	modified := append([]byte{}, raw...)
+	modified[start+chunk+10] ^= 1
+	src := bytes.NewReader(modified)
+	h, err := stream.ReadHeader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := stream.NewChunkDecryption(keys, src, *h, "/a.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(dec)
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("want Invalid, got %v", err)
+	}
+	if !bytes.Equal(got, plain[:stream.CHUNK_SIZE]) {
+		t.Errorf("want only the first chunk, got %d bytes", len(got))
+	}
+
+	swapped := append([]byte{}, raw[:start]...)
+	swapped = append(swapped, raw[start+chunk:start+2*chunk]...)
+	swapped = append(swapped, raw[start:start+chunk]...)
+	swapped = append(swapped, raw[start+2*chunk:]...)
+	for name, data := range map[string][]byte{
+		"truncated at a chunk":  raw[:start+2*chunk],
+		"truncated in a chunk":  raw[:len(raw)-1],
+		"reordered":             swapped,
+		"appended":              append(append([]byte{}, raw...), raw[start:start+chunk]...),
+		"header":                append([]byte{0, 3, raw[2] ^ 1}, raw[3:]...),
+		"version":               append([]byte{0, 4}, raw[2:]...),
+		"without chunks":        raw[:start],
+		"empty last chunk only": raw[:start+16],
+	} {
+		if _, err := decryptChunks(keys, data, "/a.txt"); !errors.Is(errors.Invalid, err) {
+			t.Errorf("%s: want Invalid, got %v", name, err)
+		}
+	}
+}
+
+func TestChunkRandomAccess(t *testing.T) {
+	keys, err := stream.DeriveKeys(bytes.Repeat([]byte{1}, stream.KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 2*stream.CHUNK_SIZE+100)
+	rand.Read(plain)
+	raw := encryptChunks(t, keys, plain, "/a.txt")
+
+	r, err := stream.NewChunkReaderAt(keys, bytes.NewReader(raw), int64(len(raw)), "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(plain)) {
+		t.Errorf("want size %d, got %d", len(plain), r.Size())
+	}
+	for _, rng := range [][2]int{{0, 10}, {stream.CHUNK_SIZE - 5, stream.CHUNK_SIZE + 5}, {100, 2*stream.CHUNK_SIZE + 100}} {
+		buf := make([]byte, rng[1]-rng[0])
+		if n, err := r.ReadAt(buf, int64(rng[0])); err != nil || n != len(buf) {
+			t.Fatalf("%v: read %d %v", rng, n, err)
+		}
+		if !bytes.Equal(buf, plain[rng[0]:rng[1]]) {
+			t.Errorf("%v: content differs", rng)
+		}
+	}
+	buf := make([]byte, 200)
+	if n, err := r.ReadAt(buf, int64(len(plain)-100)); err != io.EOF || n != 100 {
+		t.Errorf("want 100 bytes and EOF, got %d %v", n, err)
+	}
+
+	// a truncated file fails at its last chunk.
+	short := raw[:stream.ChunkStart(stream.CHUNK_SIZE)]
+	r, err = stream.NewChunkReaderAt(keys, bytes.NewReader(short), int64(len(short)), "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadAt(buf, 0); !errors.Is(errors.Invalid, err) {
+		t.Errorf("want Invalid, got %v", err)
+	}
+
+	// a download can be resumed at any chunk.
+	off := int64(stream.CHUNK_SIZE + 7)
+	h, err := stream.ReadHeader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := off / stream.CHUNK_SIZE
+	dec, err := stream.NewChunkDecryption(keys, bytes.NewReader(raw[stream.ChunkStart(off):]), *h, "/a.txt", chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain[chunk*stream.CHUNK_SIZE:]) {
+		t.Error("resumed content differs")
+	}
+}
+
+func TestVerifiedSize(t *testing.T) {
+	keys, err := stream.DeriveKeys(bytes.Repeat([]byte{1}, stream.KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 3*stream.CHUNK_SIZE)
+	rand.Read(plain)
+	raw := encryptChunks(t, keys, plain, "/a.txt")
+	full := stream.ChunkStart(stream.CHUNK_SIZE) - int64(stream.HEADER_SIZE)
+
+	tampered := append([]byte(nil), raw...)
+	tampered[stream.ChunkStart(stream.CHUNK_SIZE)+3] ^= 1
+	for _, c := range []struct {
+		name     string
+		raw      []byte
+		identity string
+		want     int64
+	}{
+		{"header only", raw[:stream.HEADER_SIZE], "/a.txt", 0},
+		{"partial chunk", raw[:stream.ChunkStart(0)+100], "/a.txt", 0},
+		{"one chunk", raw[:stream.ChunkStart(stream.CHUNK_SIZE)+100], "/a.txt", stream.ChunkStart(stream.CHUNK_SIZE)},
+		{"two chunks", raw[:stream.ChunkStart(2*stream.CHUNK_SIZE)], "/a.txt", stream.ChunkStart(2 * stream.CHUNK_SIZE)},
+		// the last chunk is verified with the whole file only.
+		{"complete", raw, "/a.txt", int64(len(raw)) - full},
+		{"tampered", tampered, "/a.txt", stream.ChunkStart(stream.CHUNK_SIZE)},
+		{"identity", raw, "/b.txt", 0},
+	} {
+		if got := stream.VerifiedSize(keys, bytes.NewReader(c.raw), int64(len(c.raw)), c.identity); got != c.want {
+			t.Errorf("%s: want %d, got %d", c.name, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/liamvdv/sharedHome/errors"
+)
+
+/*
+	The content of VERSION_4 files starts with a compression header, which is
+	encrypted with the content, i. e. Enc(Comp(File)) as in spec.txt:
+		algorithm || content
+	with the algorithm as a single byte. Content that is already compressed
+	is stored with COMPRESSION_NONE, see ChooseCompression.
+*/
+
+// The compression algorithms.
+const (
+	COMPRESSION_NONE    byte = 0
+	COMPRESSION_DEFLATE byte = 1
+)
+
+// SNIFF_SIZE is the number of bytes ChooseCompression looks at.
+const SNIFF_SIZE = 512 // bytes
+
+// compressedExts are file extensions of formats that are compressed already.
+var compressedExts = map[string]bool{
+	".7z": true, ".apk": true, ".avi": true, ".br": true, ".bz2": true,
+	".docx": true, ".epub": true, ".flac": true, ".gif": true, ".gz": true,
+	".heic": true, ".jar": true, ".jpeg": true, ".jpg": true, ".lz4": true,
+	".m4a": true, ".mkv": true, ".mov": true, ".mp3": true, ".mp4": true,
+	".odp": true, ".ods": true, ".odt": true, ".ogg": true, ".opus": true,
+	".png": true, ".pptx": true, ".rar": true, ".tgz": true, ".webm": true,
+	".webp": true, ".woff2": true, ".xlsx": true, ".xz": true, ".zip": true,
+	".zst": true,
+}
+
+// compressedMagic are the first bytes of formats that are compressed already.
+var compressedMagic = [][]byte{
+	[]byte("PK\x03\x04"),         // zip and the formats based on it
+	[]byte("\x1f\x8b"),           // gzip
+	[]byte("BZh"),                // bzip2
+	[]byte("\xfd7zXZ\x00"),       // xz
+	[]byte("\x28\xb5\x2f\xfd"),   // zstd
+	[]byte("7z\xbc\xaf\x27\x1c"), // 7z
+	[]byte("Rar!\x1a\x07"),       // rar
+	[]byte("\x89PNG\r\n\x1a\n"),  // png
+	[]byte("\xff\xd8\xff"),       // jpeg
+	[]byte("GIF8"),               // gif
+	[]byte("OggS"),               // ogg
+	[]byte("fLaC"),               // flac
+	[]byte("ID3"),                // mp3
+	[]byte("\x1a\x45\xdf\xa3"),   // matroska and webm
+	[]byte("wOF2"),               // woff2
+}
+
+// ChooseCompression returns the algorithm for the file name whose content
+// starts with head, which should hold the first SNIFF_SIZE bytes.
+func ChooseCompression(name string, head []byte) byte {
+	if compressedExts[strings.ToLower(path.Ext(name))] {
+		return COMPRESSION_NONE
+	}
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(head, magic) {
+			return COMPRESSION_NONE
+		}
+	}
+	// mp4, mov and heic have the type at offset 4, webp is a RIFF container.
+	if len(head) >= 12 && (string(head[4:8]) == "ftyp" || string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP") {
+		return COMPRESSION_NONE
+	}
+	return COMPRESSION_DEFLATE
+}
+
+// NewCompression returns the compression header followed by the content of
+// src compressed with algorithm.
+func NewCompression(src io.Reader, algorithm byte) (*Compression, error) {
+	c := &Compression{Source: src, Algorithm: algorithm}
+	c.out.WriteByte(algorithm)
+	switch algorithm {
+	case COMPRESSION_NONE:
+	case COMPRESSION_DEFLATE:
+		w, err := flate.NewWriter(&c.out, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		c.w = w
+	default:
+		return nil, errors.E(errors.Invalid, errors.Errorf("unsupported compression %d", algorithm))
+	}
+	return c, nil
+}
+
+// Compression is an io.Reader wrapping an io.Reader.
+type Compression struct {
+	Source    io.Reader
+	Algorithm byte
+	// w compresses into out, it is nil for COMPRESSION_NONE.
+	w    *flate.Writer
+	in   []byte
+	out  bytes.Buffer
+	done bool
+}
+
+func (c *Compression) Read(buf []byte) (int, error) {
+	for c.out.Len() == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if c.w == nil {
+			return c.Source.Read(buf)
+		}
+		if c.in == nil {
+			c.in = make([]byte, BUFFER_SIZE)
+		}
+		n, err := c.Source.Read(c.in)
+		if _, wErr := c.w.Write(c.in[:n]); wErr != nil {
+			return 0, wErr
+		}
+		if err == io.EOF {
+			if err := c.w.Close(); err != nil {
+				return 0, err
+			}
+			c.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return c.out.Read(buf)
+}
+
+// NewDecompression reads the compression header from src and returns the
+// decompressed content that follows it.
+func NewDecompression(src io.Reader) (*Decompression, error) {
+	var algorithm [1]byte
+	if _, err := io.ReadFull(src, algorithm[:]); err != nil {
+		return nil, errors.E(errors.Invalid, errors.Errorf("cannot read compression header: %v", err))
+	}
+	d := &Decompression{Algorithm: algorithm[0]}
+	switch d.Algorithm {
+	case COMPRESSION_NONE:
+		d.r = src
+	case COMPRESSION_DEFLATE:
+		// flate does not read ahead of a io.ByteReader, thus src is left
+		// right after the compressed content.
+		d.src = bufio.NewReader(src)
+		d.r = flate.NewReader(d.src)
+	default:
+		return nil, errors.E(errors.Invalid, errors.Errorf("unsupported compression %d", d.Algorithm))
+	}
+	return d, nil
+}
+
+// Decompression is an io.Reader wrapping an io.Reader. It reads the source up
+// to its end, so that a decrypting source authenticates all of it.
+type Decompression struct {
+	Algorithm byte
+	// src is the source of the decompressor r, it is nil for COMPRESSION_NONE.
+	src *bufio.Reader
+	r   io.Reader
+}
+
+func (d *Decompression) Read(buf []byte) (int, error) {
+	n, err := d.r.Read(buf)
+	if err == io.ErrUnexpectedEOF {
+		return n, errors.E(errors.Invalid, "compressed data is truncated")
+	}
+	if err != io.EOF || d.src == nil {
+		return n, err
+	}
+	// the compressed content must end with the source.
+	if _, err := d.src.ReadByte(); err == nil {
+		return n, errors.E(errors.Invalid, "data after the compressed content")
+	} else if err != io.EOF {
+		return n, err
+	}
+	return n, io.EOF
+}
@@ -0,0 +1,133 @@
+package stream_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/stream"
+)
+
+func TestCompression(t *testing.T) {
+	text := bytes.Repeat([]byte("package stream\n\nfunc main() {}\n"), 4096)
+	random := make([]byte, 3*stream.BUFFER_SIZE+1)
+	rand.Read(random)
+	for _, algorithm := range []byte{stream.COMPRESSION_NONE, stream.COMPRESSION_DEFLATE} {
+		for _, plain := range [][]byte{nil, []byte("a"), text, random} {
+			comp, err := stream.NewCompression(bytes.NewReader(plain), algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed, err := io.ReadAll(comp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed[0] != algorithm {
+				t.Errorf("want algorithm %d in the header, got %d", algorithm, compressed[0])
+			}
+			dec, err := stream.NewDecompression(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(dec)
+			if err != nil {
+				t.Fatalf("%d: %v", algorithm, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("%d: content of %d bytes differs", algorithm, len(plain))
+			}
+		}
+	}
+
+	comp, err := stream.NewCompression(bytes.NewReader(text), stream.COMPRESSION_DEFLATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := io.ReadAll(comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) > len(text)/10 {
+		t.Errorf("text compressed to %d of %d bytes", len(compressed), len(text))
+	}
+	for name, data := range map[string][]byte{
+		"truncated": compressed[:len(compressed)/2],
+		"trailing":  append(append([]byte{}, compressed...), 0),
+		"unknown":   append([]byte{0xff}, compressed[1:]...),
+		"empty":     nil,
+	} {
+		dec, err := stream.NewDecompression(bytes.NewReader(data))
+		if err == nil {
+			_, err = io.ReadAll(dec)
+		}
+		if !errors.Is(errors.Invalid, err) {
+			t.Errorf("%s: want Invalid, got %v", name, err)
+		}
+	}
+}
+
+func TestChooseCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		head string
+		want byte
+	}{
+		{"/src/main.go", "package main", stream.COMPRESSION_DEFLATE},
+		{"/docs/notes.txt", "", stream.COMPRESSION_DEFLATE},
+		{"/photos/IMG_1.JPG", "", stream.COMPRESSION_NONE},
+		{"/backup.tar.gz", "", stream.COMPRESSION_NONE},
+		{"/photos/no extension", "\xff\xd8\xff\xe0", stream.COMPRESSION_NONE},
+		{"/archive", "PK\x03\x04", stream.COMPRESSION_NONE},
+		{"/video", "\x00\x00\x00\x20ftypisom", stream.COMPRESSION_NONE},
+		{"/image", "RIFF\x00\x00\x00\x00WEBPVP8 ", stream.COMPRESSION_NONE},
+	} {
+		if got := stream.ChooseCompression(tc.name, []byte(tc.head)); got != tc.want {
+			t.Errorf("%s: want %d, got %d", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestCompressedEncryption(t *testing.T) {
+	keys, err := stream.DeriveKeys(bytes.Repeat([]byte{1}, stream.KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("a line of a document\n"), 2*stream.CHUNK_SIZE/8)
+	enc, err := stream.NewCompressedEncryption(bytes.NewReader(plain), keys, "/a.txt", stream.COMPRESSION_DEFLATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	enc.Header().WriteTo(&buf)
+	if _, err := io.Copy(&buf, enc); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(plain)/10 {
+		t.Errorf("content was not compressed: %d of %d bytes", buf.Len(), len(plain))
+	}
+
+	h, err := stream.ReadHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != stream.VERSION_4 {
+		t.Fatalf("want VERSION_4, got %x", h.Version)
+	}
+	dec, err := stream.NewChunkDecryption(keys, &buf, *h, "/a.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decomp, err := stream.NewDecompression(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(decomp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("decrypted content differs")
+	}
+}
@@ -1,7 +1,6 @@
 package stream
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
@@ -17,6 +16,8 @@ const (
 	IV_SIZE int = 16 // bytes
 	// Buffer must be multiple of block size.
 	BUFFER_SIZE = 4096 // bytes
+	// MAC_SIZE is the size of the footer.
+	MAC_SIZE = sha256.Size // bytes
 )
 
 // Versioning the files ensures that the encryption is never broken,
@@ -27,12 +28,28 @@ var (
 
 	// VERSION_1 is the first version in the versioning model.
 	VERSION_1 = [VERSION_SIZE]byte{0x00, 0x01}
+	// VERSION_2 uses separate keys for encryption and MAC, see Keys. Like
+	// VERSION_1, its MAC only covers the ciphertext.
+	VERSION_2 = [VERSION_SIZE]byte{0x00, 0x02}
+	// VERSION_3 encrypts and authenticates chunks of the content on their own,
+	// see NewChunkEncryption. Unlike the MAC of the earlier versions, this
+	// also authenticates the header, the length and the identity of a file.
+	VERSION_3 = [VERSION_SIZE]byte{0x00, 0x03}
+	// VERSION_4 is VERSION_3 with compressed content, see
+	// NewCompressedEncryption.
+	VERSION_4 = [VERSION_SIZE]byte{0x00, 0x04}
 )
 
-const headerSize = VERSION_SIZE + IV_SIZE
+// HEADER_SIZE is the size of the EncryptionHeader.
+const HEADER_SIZE = VERSION_SIZE + IV_SIZE
 
-func NewEncryption(src io.Reader, key []byte) (*Encryption, error) {
-	block, err := aes.NewCipher(key)
+// NewEncryption encrypts src as a VERSION_2 file.
+func NewEncryption(src io.Reader, keys *Keys) (*Encryption, error) {
+	encKey, macKey, err := keys.contentKeys(VERSION_2)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(encKey)
 	if err != nil {
 		return nil, err
 	}
@@ -41,11 +58,11 @@ func NewEncryption(src io.Reader, key []byte) (*Encryption, error) {
 		return nil, err
 	}
 	return &Encryption{
-		Version: VERSION_1,
+		Version: VERSION_2,
 		Source:  src,
 		Block:   block,
 		Stream:  cipher.NewCTR(block, iv),
-		Mac:     hmac.New(sha256.New, key),
+		Mac:     hmac.New(sha256.New, macKey),
 		Iv:      iv,
 	}, nil
 }
@@ -75,7 +92,7 @@ func (enc *Encryption) Read(buf []byte) (int, error) {
 
 		return n, rErr
 	}
-	return 0, io.EOF
+	return 0, rErr
 }
 
 func (enc *Encryption) Header() EncryptionHeader {
@@ -92,11 +109,11 @@ type EncryptionHeader struct {
 	Iv []byte
 }
 
-// WriteTo always returns headerSize and nil.
+// WriteTo always returns HEADER_SIZE and nil.
 func (h EncryptionHeader) WriteTo(w io.Writer) (int64, error) {
 	w.Write(h.Version[:])
 	w.Write(h.Iv)
-	return int64(headerSize), nil
+	return int64(HEADER_SIZE), nil
 }
 
 // Footer must only be called after the content of the stream has been fully read.
@@ -118,18 +135,22 @@ func (f EncryptionFooter) WriteTo(w io.Writer) (int64, error) {
 /*========================================== Decryption ==========================================*/
 
 func ReadHeader(src io.Reader) (*EncryptionHeader, error) {
-	buf := make([]byte, headerSize)
-	n, rErr := src.Read(buf)
-	if n != headerSize {
-		return nil, fmt.Errorf("cannot read full header.")
+	buf := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(src, buf); err != nil {
+		return nil, fmt.Errorf("cannot read full header: %w", err)
 	}
 	h := EncryptionHeader{Iv: buf[VERSION_SIZE:]}
 	copy(h.Version[:], buf[:VERSION_SIZE])
-	return &h, rErr
+	return &h, nil
 }
 
-func NewDecryption(key []byte, src io.Reader, h EncryptionHeader) (*Decryption, error) {
-	block, err := aes.NewCipher(key)
+// NewDecryption decrypts src with the keys of the version of h.
+func NewDecryption(keys *Keys, src io.Reader, h EncryptionHeader) (*Decryption, error) {
+	encKey, macKey, err := keys.contentKeys(h.Version)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(encKey)
 	if err != nil {
 		return nil, err
 	}
@@ -138,7 +159,7 @@ func NewDecryption(key []byte, src io.Reader, h EncryptionHeader) (*Decryption,
 		Source:  src,
 		Block:   block,
 		Stream:  cipher.NewCTR(block, h.Iv),
-		Mac:     hmac.New(sha256.New, key),
+		Mac:     hmac.New(sha256.New, macKey),
 	}, nil
 }
 
@@ -164,10 +185,25 @@ func (dec *Decryption) Read(buf []byte) (int, error) {
 		dec.Stream.XORKeyStream(buf[:n], buf[:n])
 		return n, rErr
 	}
-	return 0, io.EOF
+	return 0, rErr
 }
 
 // ValidMac must only be called after all encoded content has been read.
 func (dec *Decryption) ValidMac(mac []byte) bool {
-	return bytes.Compare(mac, dec.Mac.Sum(nil)) == 0
+	return hmac.Equal(mac, dec.Mac.Sum(nil))
+}
+
+// VerifyMac reads the encrypted content from src and returns true if it
+// matches mac under the MAC key of the version of h. Use it to authenticate
+// content before decrypting it.
+func VerifyMac(keys *Keys, h EncryptionHeader, src io.Reader, mac []byte) (bool, error) {
+	_, macKey, err := keys.contentKeys(h.Version)
+	if err != nil {
+		return false, err
+	}
+	m := hmac.New(sha256.New, macKey)
+	if _, err := io.Copy(m, src); err != nil {
+		return false, err
+	}
+	return hmac.Equal(mac, m.Sum(nil)), nil
 }
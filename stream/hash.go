@@ -3,27 +3,29 @@ package stream
 import (
 	"crypto/sha256"
 	"encoding/base64"
-	"os"
 	"strings"
 )
 
+// HashKey derives a key from s with a single unsalted SHA-256, which is
+// trivially brute-forced for passwords.
+//
+// Deprecated: use a random key protected with WrapKey.
 func HashKey(s string) []byte {
 	k := sha256.Sum256([]byte(s))
 	return k[:]
 }
 
-// Hash should be used to hash file names.
+// HashName hashes a file name without a key, as shares did before keys were
+// derived. New shares use Keys.HashName.
 func HashName(s string) string {
 	k := sha256.Sum256([]byte(s))
 	return base64.URLEncoding.EncodeToString(k[:])
 }
 
-// HashPath expects a HashPath with trailing path separator.
+// HashPath expects a relpath in slash form, see vfs.File.
 // It returns the hashed file names separated by a forward slash.
 func HashPath(s string) string {
-	const pathSep = string(os.PathSeparator)
-
-	names := strings.Split(s, pathSep)
+	names := strings.Split(s, "/")
 	for i, name := range names[1:] {
 		names[1+i] = HashName(name)
 	}
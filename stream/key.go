@@ -0,0 +1,159 @@
+package stream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+	All data is encrypted with a random master key. The key file stores the
+	master key encrypted with AES-256-GCM under a key encryption key, which is
+	derived from a password with scrypt. Salt and cost parameters are stored
+	with it, so that the parameters can be raised for new key files without
+	breaking old ones. GCM authenticates the master key, a wrong password
+	thus results in an error instead of a wrong key.
+*/
+
+// KEY_SIZE is the size of the master key, it selects AES-256.
+const KEY_SIZE = 32 // bytes
+
+// KEY_FILE_VERSION_1 wraps the master key with scrypt and AES-256-GCM.
+const KEY_FILE_VERSION_1 = 1
+
+// The scrypt parameters of new key files. N = 2^15 takes about 100ms and 32MB,
+// see https://pkg.go.dev/golang.org/x/crypto/scrypt#Key.
+var (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// maxScryptMemory bounds the memory of the parameters of a key file, since
+// the remote copy cannot be trusted.
+const maxScryptMemory = 1 << 30 // bytes
+
+// Secret is the content of a key file.
+type Secret struct {
+	// Key is the master key.
+	Key []byte
+	// KeyedNames is set if file names are hashed with Keys.HashName. Shares
+	// created before keys were derived use the package function HashName.
+	KeyedNames bool
+}
+
+// keyFile is the JSON encoded content of a key file.
+type keyFile struct {
+	Version int
+	KDF     string
+	Salt    []byte
+	N, R, P int
+	Nonce   []byte
+	// Key is the encrypted master key.
+	Key []byte
+	// KeyedNames is authenticated as additional data of Key.
+	KeyedNames bool `json:",omitempty"`
+}
+
+// NewKey returns a new random master key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapKey returns the key file of the secret s, protected by password.
+func WrapKey(s Secret, password string) ([]byte, error) {
+	const op = errors.Op("stream.WrapKey")
+	if len(s.Key) != KEY_SIZE {
+		return nil, errors.E(op, errors.Invalid, "master key has the wrong size")
+	}
+	if password == "" {
+		return nil, errors.E(op, errors.Invalid, "empty password")
+	}
+	f := keyFile{
+		Version:    KEY_FILE_VERSION_1,
+		KDF:        "scrypt",
+		Salt:       make([]byte, 16),
+		N:          scryptN,
+		R:          scryptR,
+		P:          scryptP,
+		KeyedNames: s.KeyedNames,
+	}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return nil, errors.E(op, err)
+	}
+	aead, err := f.aead(password)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	f.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return nil, errors.E(op, err)
+	}
+	f.Key = aead.Seal(nil, f.Nonce, s.Key, f.additionalData())
+	raw, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	return raw, nil
+}
+
+// UnwrapKey returns the secret of the key file raw. It returns an error of
+// kind errors.CannotDecrypt if the password is wrong.
+func UnwrapKey(raw []byte, password string) (Secret, error) {
+	const op = errors.Op("stream.UnwrapKey")
+	var f keyFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return Secret{}, errors.E(op, errors.Invalid, errors.Errorf("malformed key file: %v", err))
+	}
+	if f.Version != KEY_FILE_VERSION_1 || f.KDF != "scrypt" {
+		return Secret{}, errors.E(op, errors.Invalid, errors.Errorf("unsupported key file version %d", f.Version))
+	}
+	if f.N <= 1 || f.R <= 0 || f.P <= 0 || 128*int64(f.N)*int64(f.R) > maxScryptMemory || f.P > 16 || len(f.Salt) < 16 {
+		return Secret{}, errors.E(op, errors.Invalid, "key file has invalid parameters")
+	}
+	aead, err := f.aead(password)
+	if err != nil {
+		return Secret{}, errors.E(op, err)
+	}
+	if len(f.Nonce) != aead.NonceSize() {
+		return Secret{}, errors.E(op, errors.Invalid, "key file has invalid parameters")
+	}
+	key, err := aead.Open(nil, f.Nonce, f.Key, f.additionalData())
+	if err != nil {
+		return Secret{}, errors.E(op, errors.CannotDecrypt, "wrong password or modified key file")
+	}
+	if len(key) != KEY_SIZE {
+		return Secret{}, errors.E(op, errors.Invalid, "master key has the wrong size")
+	}
+	return Secret{Key: key, KeyedNames: f.KeyedNames}, nil
+}
+
+// additionalData authenticates the options of the key file. It is empty for
+// key files without options, which were written before there were any.
+func (f *keyFile) additionalData() []byte {
+	if !f.KeyedNames {
+		return nil
+	}
+	return []byte("keyed names")
+}
+
+// aead returns the cipher of the key encryption key derived from password.
+func (f *keyFile) aead(password string) (cipher.AEAD, error) {
+	kek, err := scrypt.Key([]byte(password), f.Salt, f.N, f.R, f.P, KEY_SIZE)
+	if err != nil {
+		return nil, errors.E(errors.Invalid, err)
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,65 @@
+package stream_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/stream"
+)
+
+func TestWrapKey(t *testing.T) {
+	key, err := stream.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := stream.Secret{Key: key, KeyedNames: true}
+	raw, err := stream.WrapKey(secret, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, key) {
+		t.Fatal("key file contains the plain key")
+	}
+	got, err := stream.UnwrapKey(raw, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Key, key) || !got.KeyedNames {
+		t.Errorf("unwrapped secret differs: %+v", got)
+	}
+	if _, err := stream.UnwrapKey(raw, "wrong horse"); !errors.Is(errors.CannotDecrypt, err) {
+		t.Errorf("want CannotDecrypt for a wrong password, got %v", err)
+	}
+
+	// the salt is random, so are the key files of the same key.
+	other, err := stream.WrapKey(secret, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(raw, other) {
+		t.Error("key files of the same key are equal")
+	}
+
+	var f map[string]interface{}
+	if err := json.Unmarshal(raw, &f); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]interface{}{
+		"N":          float64(1 << 30), // too much memory
+		"Version":    float64(2),
+		"KeyedNames": false,
+	} {
+		old := f[name]
+		f[name] = value
+		tampered, _ := json.Marshal(f)
+		f[name] = old
+		if _, err := stream.UnwrapKey(tampered, "correct horse"); err == nil {
+			t.Errorf("%s = %v: want error", name, value)
+		}
+	}
+	if _, err := stream.WrapKey(secret, ""); !errors.Is(errors.Invalid, err) {
+		t.Errorf("want Invalid for an empty password, got %v", err)
+	}
+}
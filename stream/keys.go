@@ -0,0 +1,83 @@
+package stream
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/liamvdv/sharedHome/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+	Each key is only used for one purpose. The keys are derived from the master
+	key with HKDF-SHA256, see RFC 5869, with the purpose as info:
+	- Encryption encrypts the content of VERSION_2 files with AES-CTR.
+	- Mac authenticates the content of VERSION_2 files with HMAC-SHA256.
+	- Chunk derives the keys of VERSION_3 files, see chunk.go.
+	- Name hashes file names with HMAC-SHA256, so that only holders of the key
+	  can confirm a guessed name.
+	VERSION_1 files use the master key for both encryption and MAC.
+*/
+
+// Keys are the keys derived from a master key.
+type Keys struct {
+	Master     []byte
+	Encryption []byte
+	Mac        []byte
+	Chunk      []byte
+	Name       []byte
+}
+
+// DeriveKeys returns the keys derived from the master key.
+func DeriveKeys(master []byte) (*Keys, error) {
+	const op = errors.Op("stream.DeriveKeys")
+	if len(master) != KEY_SIZE {
+		return nil, errors.E(op, errors.Invalid, "master key has the wrong size")
+	}
+	k := &Keys{Master: master}
+	for _, d := range []struct {
+		key  *[]byte
+		info string
+	}{
+		{&k.Encryption, "sharedHome content encryption"},
+		{&k.Mac, "sharedHome content mac"},
+		{&k.Chunk, "sharedHome content chunks"},
+		{&k.Name, "sharedHome file name"},
+	} {
+		*d.key = make([]byte, KEY_SIZE)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte(d.info)), *d.key); err != nil {
+			return nil, errors.E(op, err)
+		}
+	}
+	return k, nil
+}
+
+// HashName is the keyed counterpart of the package function HashName.
+func (k *Keys) HashName(s string) string {
+	m := hmac.New(sha256.New, k.Name)
+	m.Write([]byte(s))
+	return base64.URLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// HashPath is the keyed counterpart of the package function HashPath.
+func (k *Keys) HashPath(s string) string {
+	names := strings.Split(s, "/")
+	for i, name := range names[1:] {
+		names[1+i] = k.HashName(name)
+	}
+	return strings.Join(names, "/")
+}
+
+// contentKeys returns the encryption and MAC key of files of the version v.
+func (k *Keys) contentKeys(v [VERSION_SIZE]byte) (enc, mac []byte, err error) {
+	switch v {
+	case VERSION_1:
+		return k.Master, k.Master, nil
+	case VERSION_2:
+		return k.Encryption, k.Mac, nil
+	}
+	return nil, nil, errors.E(errors.Invalid, errors.Errorf("unsupported version %x", v))
+}
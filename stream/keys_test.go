@@ -0,0 +1,134 @@
+package stream_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/liamvdv/sharedHome/stream"
+)
+
+func TestDeriveKeys(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, stream.KEY_SIZE)
+	keys, err := stream.DeriveKeys(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived := [][]byte{keys.Master, keys.Encryption, keys.Mac, keys.Chunk, keys.Name}
+	for i := range derived {
+		for j := i + 1; j < len(derived); j++ {
+			if bytes.Equal(derived[i], derived[j]) {
+				t.Errorf("keys %d and %d are equal", i, j)
+			}
+		}
+	}
+	again, err := stream.DeriveKeys(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Encryption, keys.Encryption) {
+		t.Error("derivation is not deterministic")
+	}
+	if _, err := stream.DeriveKeys(master[1:]); err == nil {
+		t.Error("want error for a short master key")
+	}
+
+	other, err := stream.DeriveKeys(bytes.Repeat([]byte{2}, stream.KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := keys.HashPath("/docs/a.txt")
+	if name == stream.HashPath("/docs/a.txt") || name == other.HashPath("/docs/a.txt") {
+		t.Error("keyed names must depend on the key")
+	}
+	if want := "/" + keys.HashName("docs") + "/" + keys.HashName("a.txt"); name != want {
+		t.Errorf("want %s, got %s", want, name)
+	}
+}
+
+// TestVersion1 checks that files of VERSION_1, which use the master key for
+// encryption and MAC, stay readable.
+func TestVersion1(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, stream.KEY_SIZE)
+	keys, err := stream.DeriveKeys(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("written before keys were derived")
+	iv := bytes.Repeat([]byte{7}, stream.IV_SIZE)
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, len(plain))
+	cipher.NewCTR(block, iv).XORKeyStream(body, plain)
+	m := hmac.New(sha256.New, master)
+	m.Write(body)
+	mac := m.Sum(nil)
+
+	h := stream.EncryptionHeader{Version: stream.VERSION_1, Iv: iv}
+	ok, err := stream.VerifyMac(keys, h, bytes.NewReader(body), mac)
+	if err != nil || !ok {
+		t.Fatalf("VERSION_1 mac not accepted: %v", err)
+	}
+	dec, err := stream.NewDecryption(keys, bytes.NewReader(body), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("want %q, got %q", plain, got)
+	}
+
+	// the same data as VERSION_2 is rejected.
+	h.Version = stream.VERSION_2
+	if ok, _ := stream.VerifyMac(keys, h, bytes.NewReader(body), mac); ok {
+		t.Error("VERSION_2 must not use the master key")
+	}
+}
+
+// TestVersion2 checks that a VERSION_2 file written by an earlier release
+// stays readable.
+func TestVersion2(t *testing.T) {
+	keys, err := stream.DeriveKeys(bytes.Repeat([]byte{7}, stream.KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// encrypted by NewEncryption.
+	raw, err := hex.DecodeString("00020a02528683e003101371e7c4a4abb89b2e38b0aed553c5d478cac293ab4d4a0fbf6053a13286dfc8c9ed90dd37509368d27a6930819bc55bc7705d08f3f1412da6a2470c964ebc5fbbc4cc1f05eb2af23466d21211a5d3a462")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := "written before the MAC bound the identity"
+	h, err := stream.ReadHeader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != stream.VERSION_2 {
+		t.Fatalf("want VERSION_2, got %x", h.Version)
+	}
+	body, mac := raw[stream.HEADER_SIZE:len(raw)-stream.MAC_SIZE], raw[len(raw)-stream.MAC_SIZE:]
+	ok, err := stream.VerifyMac(keys, *h, bytes.NewReader(body), mac)
+	if err != nil || !ok {
+		t.Fatalf("VERSION_2 mac not accepted: %v", err)
+	}
+	dec, err := stream.NewDecryption(keys, bytes.NewReader(body), *h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != plain || !dec.ValidMac(mac) {
+		t.Errorf("want valid %q, got %q", plain, got)
+	}
+}
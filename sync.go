@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/core"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+const (
+	networkWorkers = 4
+	diskWorkers    = 2
+	// lockAttempts is the number of times lockLatest tries to lock the latest
+	// index while other clients store new ones.
+	lockAttempts = 3
+)
+
+// lockRefresh is the interval in which the lock of a sync is refreshed.
+var lockRefresh = remote.LockTTL / 3
+
+// Sync synchronises cfg.RootFilepath with the remote:
+// 1. build the local index
+// 2. get and lock the remote index, the lock is released on return
+// 3. use the core package to compare both indexes and execute the tasks
+// 4. upload the new remote index and cache the new base index
+func Sync(env config.Env, cfg *config.Config) error {
+	const op = errors.Op("main.Sync")
+	// cancel on interrupt, so that the lock is still released.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	secret, err := loadKey(env)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	srv, err := backend.Open(env, cfg.UseBackend)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	r, err := openRemote(env, cfg, srv, secret)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	sun, lock, err := lockLatest(ctx, r)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	// the sync must not change the remote once the lock is lost.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopKeep := make(chan struct{})
+	lost := make(chan error, 1)
+	go keepLock(ctx, env, lock, stopKeep, func(err error) {
+		lost <- err
+		cancel()
+	})
+	defer func() {
+		close(stopKeep)
+		// ctx may be cancelled already.
+		if err := lock.Release(context.Background()); err != nil {
+			fmt.Fprintln(env.Stderr, err)
+		}
+	}()
+
+	remoteIndex, err := r.FetchIndex(ctx, sun)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	localIndex, err := buildLocalIndex(env, cfg)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if err := r.PruneUploads(localIndex); err != nil {
+		fmt.Fprintf(env.Stderr, "cannot prune the upload cache: %v\n", err)
+	}
+	base, _, err := loadBase(env.Fs)
+	if err != nil {
+		// without base we only lose deletion detection, thus continue.
+		fmt.Fprintf(env.Stderr, "ignoring unreadable base index: %v\n", err)
+	}
+
+	s := core.New(localIndex, remoteIndex, base)
+	tasks := make(chan core.Task)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Compare(tasks)
+	}()
+
+	x := core.Executor{
+		NetworkWorkers: networkWorkers,
+		DiskWorkers:    diskWorkers,
+		Handle:         core.NewHandler(env.Fs, cfg.RootFilepath, r),
+	}
+	var done, failed int
+	for res := range x.Run(ctx, tasks) {
+		if res.Err != nil {
+			failed++
+			fmt.Fprintf(env.Stderr, "%s: %v\n", res.Task, res.Err)
+			continue
+		}
+		if err := s.Commit(res.Task); err != nil {
+			return errors.E(op, err)
+		}
+		done++
+		fmt.Fprintln(env.Stdout, res.Task)
+	}
+	if err := <-errc; err != nil {
+		return errors.E(op, err)
+	}
+	select {
+	case err := <-lost:
+		return errors.E(op, errors.Errorf("lost the remote lock, the remote index was not updated: %v", err))
+	default:
+	}
+
+	next := sun
+	if s.RemoteChanged() {
+		next = sun + 1
+		index, err := s.Remote()
+		if err != nil {
+			return errors.E(op, err)
+		}
+		if err := r.StoreIndex(ctx, index, next); err != nil {
+			return errors.E(op, err)
+		}
+	}
+	newBase, err := s.Base()
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if err := storeBase(env.Fs, newBase, next); err != nil {
+		return errors.E(op, err)
+	}
+
+	fmt.Fprintf(env.Stdout, "%d tasks done, %d failed.\n", done, failed)
+	if failed > 0 {
+		return errors.E(op, errors.Errorf("%d tasks failed, run sync again to retry them", failed))
+	}
+	return nil
+}
+
+// lockLatest acquires the lock of the latest remote index and returns its
+// sun. Another client may store a new index between LatestSun and
+// AcquireLock, thus the latest sun is read again once the lock is held.
+func lockLatest(ctx context.Context, r *remote.Remote) (int, *remote.Lock, error) {
+	for attempt := 1; ; attempt++ {
+		sun, err := r.LatestSun(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		lock, err := r.AcquireLock(ctx, sun, remote.LockTTL)
+		if err != nil {
+			return 0, nil, err
+		}
+		latest, err := r.LatestSun(ctx)
+		if err == nil && latest == sun {
+			return sun, lock, nil
+		}
+		if rErr := lock.Release(ctx); err == nil {
+			err = rErr
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if attempt == lockAttempts {
+			return 0, nil, errors.E(errors.Exist, "other clients keep changing the remote, run sync again later")
+		}
+	}
+}
+
+// buildLocalIndex walks cfg.RootFilepath. Errors of single files are printed.
+func buildLocalIndex(env config.Env, cfg *config.Config) (*vfs.FileIndex, error) {
+	walk := vfs.NewFromWalk(env.Fs, cfg.RootFilepath, cfg.IgnoreFilenames)
+	done := make(chan struct{})
+	go func() {
+		for err := range walk.Errc {
+			fmt.Fprintln(env.Stderr, err)
+		}
+		close(done)
+	}()
+	index, err := walk.DoAndWait()
+	<-done
+	return index, err
+}
+
+// loadBase reads the latest index cached in config.IndexCacheFolder. It returns
+// a nil index if there is none.
+func loadBase(fs osx.Fs) (*vfs.FileIndex, int, error) {
+	suns, err := cachedSuns(fs)
+	if err != nil || len(suns) == 0 {
+		return nil, 0, err
+	}
+	sun := suns[len(suns)-1]
+	f, err := fs.Open(filepath.Join(config.IndexCacheFolder, fmt.Sprintf(config.IndexFileTemplate, sun)))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	index, err := vfs.Load(f)
+	return index, sun, err
+}
+
+// storeBase caches index in config.IndexCacheFolder and removes older ones.
+func storeBase(fs osx.Fs, index *vfs.FileIndex, sun int) error {
+	old, err := cachedSuns(fs)
+	if err != nil {
+		return err
+	}
+	f, err := fs.Create(filepath.Join(config.IndexCacheFolder, fmt.Sprintf(config.IndexFileTemplate, sun)))
+	if err != nil {
+		return err
+	}
+	if err := index.Store(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	for _, n := range old {
+		if n == sun {
+			continue
+		}
+		if err := fs.Remove(filepath.Join(config.IndexCacheFolder, fmt.Sprintf(config.IndexFileTemplate, n))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cachedSuns returns the sequential update numbers of all cached indexes in
+// ascending order.
+func cachedSuns(fs osx.Fs) ([]int, error) {
+	entries, err := fs.ReadDir(config.IndexCacheFolder)
+	if err != nil {
+		return nil, err
+	}
+	var suns []int
+	for _, e := range entries {
+		var n int
+		if _, err := fmt.Sscanf(e.Name(), config.IndexFileTemplate, &n); err != nil {
+			continue
+		}
+		if e.Name() == fmt.Sprintf(config.IndexFileTemplate, n) {
+			suns = append(suns, n)
+		}
+	}
+	sort.Ints(suns)
+	return suns, nil
+}
+
+// keepLock refreshes lock until done is closed or ctx is cancelled. It calls
+// lost if the lock was taken over or expires before it can be refreshed again.
+// Other errors are printed and the refresh is retried.
+func keepLock(ctx context.Context, env config.Env, lock *remote.Lock, done <-chan struct{}, lost func(error)) {
+	t := time.NewTicker(lockRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			err := lock.Refresh(ctx)
+			if err == nil {
+				continue
+			}
+			if errors.Is(errors.Permission, err) || time.Now().Add(lockRefresh).After(lock.Info().Expires) {
+				lost(err)
+				return
+			}
+			fmt.Fprintf(env.Stderr, "cannot refresh lock: %v\n", err)
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/backend/local"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+	"github.com/liamvdv/sharedHome/osx"
+	"github.com/liamvdv/sharedHome/remote"
+	"github.com/liamvdv/sharedHome/stream"
+	"github.com/liamvdv/sharedHome/vfs"
+)
+
+var testKeys, _ = stream.DeriveKeys(bytes.Repeat([]byte("k"), stream.KEY_SIZE))
+
+// newTestRemote returns an initialised remote on a local backend in fs.
+func newTestRemote(t *testing.T, fs osx.Fs) backend.Service {
+	t.Helper()
+	if err := fs.MkdirAll("/backend", 0700); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := local.New(fs, "/backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.New(srv, fs, "/", testKeys).Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// hookService calls hook before the first file is created whose name
+// starts with prefix.
+type hookService struct {
+	backend.Service
+	prefix string
+	hook   func()
+}
+
+func (h *hookService) CreateFile(ctx context.Context, f backend.RemoteFile, src io.Reader) error {
+	if h.hook != nil && strings.HasPrefix(f.HashName, h.prefix) {
+		hook := h.hook
+		h.hook = nil
+		hook()
+	}
+	return h.Service.CreateFile(ctx, f, src)
+}
+
+// TestLockLatest checks that an index stored while the lock is acquired is
+// not missed.
+func TestLockLatest(t *testing.T) {
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	srv := newTestRemote(t, fs)
+	other := remote.New(srv, fs, "/", testKeys)
+	index := vfs.NewFromMemory(&vfs.File{Relpath: "/", Mode: os.ModeDir | 0755})
+
+	hooked := &hookService{Service: srv, prefix: "lock-", hook: func() {
+		if err := other.StoreIndex(ctx, index, 1); err != nil {
+			t.Error(err)
+		}
+	}}
+	sun, lock, err := lockLatest(ctx, remote.New(hooked, fs, "/", testKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sun != 1 || lock.Info().Sun != 1 {
+		t.Errorf("want the lock of sun 1, got %d %d", sun, lock.Info().Sun)
+	}
+	// the lock of the outdated sun was released.
+	if suns, err := other.Locks(ctx); err != nil || len(suns) != 1 || suns[0] != 1 {
+		t.Errorf("want only the lock of sun 1, got %v %v", suns, err)
+	}
+}
+
+// TestKeepLock checks that a lock taken over by another client is reported.
+func TestKeepLock(t *testing.T) {
+	defer func(d time.Duration) { lockRefresh = d }(lockRefresh)
+	lockRefresh = time.Millisecond
+	ctx := context.Background()
+	fs := osx.NewMemMapFs()
+	r := remote.New(newTestRemote(t, fs), fs, "/", testKeys)
+	lock, err := r.AcquireLock(ctx, 0, remote.LockTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another client considered the lock stale.
+	if err := r.BreakLock(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.AcquireLock(ctx, 0, remote.LockTTL); err != nil {
+		t.Fatal(err)
+	}
+
+	lost := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go keepLock(ctx, config.Env{Stderr: io.Discard}, lock, done, func(err error) { lost <- err })
+	select {
+	case err := <-lost:
+		if !errors.Is(errors.Permission, err) {
+			t.Errorf("want Permission, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lost lock not reported")
+	}
+}
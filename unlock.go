@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/liamvdv/sharedHome/backend"
+	"github.com/liamvdv/sharedHome/config"
+	"github.com/liamvdv/sharedHome/errors"
+)
+
+// Unlock shows the holders of all remote locks and removes them after
+// confirmation. Fresh locks are only removed with -force, since their holder
+// may still be synchronising.
+func Unlock(env config.Env, cfg *config.Config, args []string) error {
+	const op = errors.Op("main.Unlock")
+	flags := flag.NewFlagSet("unlock", flag.ContinueOnError)
+	flags.SetOutput(env.Stderr)
+	var (
+		force = flags.Bool("force", false, "also remove locks that have not expired yet")
+		yes   = flags.Bool("yes", false, "do not ask for confirmation")
+	)
+	if err := flags.Parse(args); err != nil {
+		return errors.E(op, errors.Invalid, err)
+	}
+
+	ctx := context.Background()
+	secret, err := loadKey(env)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	srv, err := backend.Open(env, cfg.UseBackend)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	r, err := openRemote(env, cfg, srv, secret)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	suns, err := r.Locks(ctx)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	if len(suns) == 0 {
+		fmt.Fprintln(env.Stdout, "The remote is not locked.")
+		return nil
+	}
+
+	var refused int
+	for _, sun := range suns {
+		info, err := r.ReadLock(ctx, sun)
+		switch {
+		case err != nil:
+			// e. g. written with another key, we cannot tell if it is stale.
+			fmt.Fprintf(env.Stdout, "Unreadable lock of index %d: %v\n", sun, err)
+			if !*force {
+				refused++
+				continue
+			}
+		case !info.Stale(time.Now()):
+			fmt.Fprintf(env.Stdout, "Active %s\n", info)
+			if !*force {
+				refused++
+				continue
+			}
+		default:
+			fmt.Fprintf(env.Stdout, "Stale %s\n", info)
+		}
+		if !*yes && !config.Confirm(env, "Remove this lock?") {
+			continue
+		}
+		if err := r.BreakLock(ctx, sun); err != nil {
+			return errors.E(op, err)
+		}
+		fmt.Fprintf(env.Stdout, "Removed lock of index %d.\n", sun)
+	}
+	if refused > 0 {
+		return errors.E(op, errors.Exist, errors.Errorf("%d locks may still be in use, use -force to remove them anyway", refused))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package vfs
+
+import (
+	"sort"
+	"strings"
+)
+
+// Flatten returns copies of all files of the index without their children,
+// sorted in pre-order of their Relpath.
+func (i *FileIndex) Flatten() []File {
+	i.Mu.RLock()
+	defer i.Mu.RUnlock()
+	var files []File
+	if root, ok := i.Files["/"]; ok {
+		files = append(files, leaf(root))
+	}
+	for _, dir := range i.Files {
+		for n := range dir.Children {
+			files = append(files, leaf(&dir.Children[n]))
+		}
+	}
+	sortFiles(files)
+	return files
+}
+
+// Diff compares cur against the older index base and returns the files of both
+// in pre-order of their Relpath. Files of cur are marked Unmodified if base
+// has the same version or else Modified. Ignored files keep their state. Files
+// that are only in base are marked Deleted. Like Flatten, the returned files
+// have no children.
+func Diff(base, cur *FileIndex) []File {
+	files := cur.Flatten()
+	old := make(map[string]*File)
+	for _, f := range base.Flatten() {
+		f := f
+		old[f.Relpath] = &f
+	}
+	for n := range files {
+		f := &files[n]
+		b, ok := old[f.Relpath]
+		delete(old, f.Relpath)
+		switch {
+		case f.State == Ignored:
+		case f.Relpath == "/":
+			// the metadata of the root is not synchronised.
+			f.State = Unmodified
+		case !ok || b.State == Ignored || b.Mode.IsDir() != f.Mode.IsDir():
+			f.State = Modified
+		case f.Mode.IsDir() && b.Mode == f.Mode, !f.Mode.IsDir() && b.StrongEquals(f):
+			f.State = Unmodified
+		default:
+			f.State = Modified
+		}
+	}
+	for _, b := range old {
+		if b.State == Ignored {
+			continue
+		}
+		b.State = Deleted
+		files = append(files, *b)
+	}
+	sortFiles(files)
+	return files
+}
+
+func leaf(f *File) File {
+	cp := *f
+	cp.Children = nil
+	return cp
+}
+
+// sortFiles sorts by Relpath, but children always follow their parent.
+func sortFiles(files []File) {
+	sort.Slice(files, func(a, b int) bool {
+		return strings.ReplaceAll(files[a].Relpath, "/", "\x00") < strings.ReplaceAll(files[b].Relpath, "/", "\x00")
+	})
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	stdfs "io/fs"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/liamvdv/sharedHome/errors"
 	"github.com/liamvdv/sharedHome/osx"
 )
 
@@ -91,6 +93,17 @@ var toString = []string{
 	Ignored:    "Ignored",
 }
 
+// ParseState returns the State named s, e. g. "Modified". The case of s is
+// ignored.
+func ParseState(s string) (State, error) {
+	for n, name := range toString {
+		if strings.EqualFold(name, s) {
+			return State(n), nil
+		}
+	}
+	return 0, errors.E(errors.Invalid, errors.Errorf("unknown state %q", s))
+}
+
 func (s State) String() string {
 	if i := int(s); !(0 <= i && i < len(toString)) {
 		panic("invalid state")
@@ -21,6 +21,9 @@ type IgnoreFunc func(string) bool
 
 func getGlobalIgnoreFunc(patterns []string) IgnoreFunc {
 	return func(name string) bool {
+		if isPartialFile(name) {
+			return true
+		}
 		for _, p := range patterns {
 			if name == p {
 				return true
@@ -30,6 +33,12 @@ func getGlobalIgnoreFunc(patterns []string) IgnoreFunc {
 	}
 }
 
+// isPartialFile returns true for the files of unfinished downloads, see
+// config.PartialFileSuffix.
+func isPartialFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, config.PartialFileSuffix)
+}
+
 // getIgnoreFunc returns a function that accepts a name and return whether it
 // should be EXCLUDED (true) or INCLUDED (false).
 func getIgnoreFunc(fs osx.Fs, dp string, names []string) (IgnoreFunc, error) {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
@@ -52,14 +53,14 @@ func (i *FileIndex) Store(w io.Writer) error {
 	defer i.Mu.RUnlock()
 	root, err := i.GetDir("/")
 	if err != nil {
-		return nil
+		return err
 	}
 	// root references every node (most indirectly). gob will traverse all nodes
 	return gob.NewEncoder(w).Encode(root)
 }
 
 var (
-	ErrFileNotFound = errors.E("file not found")
+	ErrFileNotFound = errors.E(errors.NotExist, "file not found")
 )
 
 // Get can be used to retrieve both a dir file and a normal file.
@@ -93,6 +94,116 @@ func (i *FileIndex) GetDir(relpath string) (*File, error) {
 	return dir, nil
 }
 
+// Put inserts f into the index or replaces the file with the same Relpath.
+// The parent directory of f must already be in the index. Children of f are
+// ignored: a new directory starts empty and an existing one keeps its children.
+func (i *FileIndex) Put(f File) error {
+	const op = errors.Op("vfs.FileIndex.Put")
+	if f.Relpath == "/" {
+		return errors.E(op, errors.Invalid, "cannot replace root")
+	}
+	i.Mu.Lock()
+	defer i.Mu.Unlock()
+	dir, ok := i.Files[path.Dir(f.Relpath)]
+	if !ok {
+		return errors.E(op, errors.Path(f.Relpath), errors.NotExist, "parent directory not in index")
+	}
+
+	f.Children = nil
+	if f.Mode.IsDir() {
+		f.Children = []File{}
+	}
+	for n := range dir.Children {
+		old := &dir.Children[n]
+		if old.Relpath != f.Relpath {
+			continue
+		}
+		if old.Mode.IsDir() {
+			if f.Mode.IsDir() {
+				f.Children = old.Children
+			} else {
+				i.removeDirs(old.Relpath)
+			}
+		}
+		*old = f
+		i.relink(dir)
+		return nil
+	}
+	dir.Children = append(dir.Children, f)
+	i.relink(dir)
+	return nil
+}
+
+// Remove removes the file or directory with relpath including all children.
+func (i *FileIndex) Remove(relpath string) error {
+	const op = errors.Op("vfs.FileIndex.Remove")
+	if relpath == "/" {
+		return errors.E(op, errors.Invalid, "cannot remove root")
+	}
+	i.Mu.Lock()
+	defer i.Mu.Unlock()
+	dir, ok := i.Files[path.Dir(relpath)]
+	if !ok {
+		return errors.E(op, errors.Path(relpath), ErrFileNotFound)
+	}
+	for n := range dir.Children {
+		if dir.Children[n].Relpath != relpath {
+			continue
+		}
+		if dir.Children[n].Mode.IsDir() {
+			i.removeDirs(relpath)
+		}
+		dir.Children = append(dir.Children[:n], dir.Children[n+1:]...)
+		i.relink(dir)
+		return nil
+	}
+	return errors.E(op, errors.Path(relpath), ErrFileNotFound)
+}
+
+// removeDirs removes the dir and all its sub dirs from the Files map.
+// The caller must hold the write lock.
+func (i *FileIndex) removeDirs(relpath string) {
+	prefix := relpath + "/"
+	for dp := range i.Files {
+		if dp == relpath || strings.HasPrefix(dp, prefix) {
+			delete(i.Files, dp)
+		}
+	}
+}
+
+// relink updates the Files map for the sub dirs of dir, since changing
+// dir.Children may have moved them in memory. The caller must hold the write lock.
+func (i *FileIndex) relink(dir *File) {
+	for n := range dir.Children {
+		if dir.Children[n].Mode.IsDir() {
+			i.Files[dir.Children[n].Relpath] = &dir.Children[n]
+		}
+	}
+}
+
+// Clone returns a deep copy of the index.
+func (i *FileIndex) Clone() (*FileIndex, error) {
+	root, err := i.GetDir("/")
+	if err != nil {
+		return nil, err
+	}
+	i.Mu.RLock()
+	cp := cloneFile(root)
+	i.Mu.RUnlock()
+	return NewFromMemory(&cp), nil
+}
+
+func cloneFile(f *File) File {
+	cp := *f
+	if f.Children != nil {
+		cp.Children = make([]File, len(f.Children))
+		for n := range f.Children {
+			cp.Children[n] = cloneFile(&f.Children[n])
+		}
+	}
+	return cp
+}
+
 // Equals returns the number of differences as a string array.
 // if len(a.Equals(b)) is 0, then they are deep equal.
 func (a *FileIndex) Equals(b *FileIndex) (diffs []string) {
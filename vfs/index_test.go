@@ -166,3 +166,106 @@ func TestFileIndexFromWalk(t *testing.T) {
 		}
 	}
 }
+
+func TestFileIndexPutRemove(t *testing.T) {
+	index := vfs.NewFromMemory(&testVfs)
+	clone, err := index.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := vfs.File{Relpath: "/new", Mode: os.ModeDir | 0755}
+	if err := clone.Put(dir); err != nil {
+		t.Error(err)
+	}
+	if err := clone.Put(vfs.File{Relpath: "/new/f.txt", Mode: 0644, Size: 3}); err != nil {
+		t.Error(err)
+	}
+	if err := clone.Put(vfs.File{Relpath: "/missing/f.txt", Mode: 0644}); err == nil {
+		t.Error("put without parent must fail")
+	}
+	// replacing a dir keeps its children
+	dir.MTime = 42
+	if err := clone.Put(dir); err != nil {
+		t.Error(err)
+	}
+	if f, err := clone.Get("/new/f.txt"); err != nil || f.Size != 3 {
+		t.Errorf("lost child after replacing its dir: %v", err)
+	}
+	if d, err := clone.GetDir("/new"); err != nil || d.MTime != 42 {
+		t.Errorf("dir not replaced: %v", err)
+	}
+
+	if err := clone.Remove("/docs"); err != nil {
+		t.Error(err)
+	}
+	for _, dp := range []string{"/docs", "/docs/hpi", "/docs/tum/application"} {
+		if _, err := clone.GetDir(dp); err == nil {
+			t.Errorf("%s still in index after removing parent", dp)
+		}
+	}
+	if err := clone.Remove("/docs"); err == nil {
+		t.Error("removing missing file must fail")
+	}
+
+	// the original must not be affected by changes to the clone.
+	if _, err := index.GetDir("/docs/hpi"); err != nil {
+		t.Error("clone shares state with original")
+	}
+	if _, err := index.GetDir("/new"); err == nil {
+		t.Error("clone shares state with original")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	base := vfs.NewFromMemory(&testVfs)
+	cur, err := base.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := cur.Get("/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed.Size = 10
+	if err := cur.Put(vfs.File{Relpath: "/docs/new.txt", Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cur.Remove("/docs/tum"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]vfs.State{
+		"/b.txt":                vfs.Modified,
+		"/docs/new.txt":         vfs.Modified,
+		"/docs/d.pdf":           vfs.Ignored,
+		"/docs/tum":             vfs.Deleted,
+		"/docs/tum/application": vfs.Deleted,
+		"/docs/tum/application/wise202122/inform.txt": vfs.Deleted,
+		"/a.txt":    vfs.Unmodified,
+		"/docs/hpi": vfs.Unmodified,
+	}
+	root, err := cur.GetDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Mode = os.ModeDir | 0700
+	want["/"] = vfs.Unmodified
+
+	files := vfs.Diff(base, cur)
+	got := make(map[string]vfs.State)
+	for n, f := range files {
+		got[f.Relpath] = f.State
+		if n > 0 && strings.HasPrefix(files[n-1].Relpath, f.Relpath+"/") {
+			t.Errorf("%s listed after its child %s", f.Relpath, files[n-1].Relpath)
+		}
+	}
+	if files[0].Relpath != "/" {
+		t.Errorf("root must be first, got %s", files[0].Relpath)
+	}
+	for relpath, state := range want {
+		if got[relpath] != state {
+			t.Errorf("%s: want %s, got %s", relpath, state, got[relpath])
+		}
+	}
+}